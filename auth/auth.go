@@ -0,0 +1,214 @@
+// Package auth authenticates the clients creating and administering
+// streams, with basic credentials, bearer tokens or JWTs.
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Operations a principal may be allowed.
+const (
+	OpCreate = "create" // creating streams
+	OpAdmin  = "admin"  // the admin API
+)
+
+var (
+	// ErrNoCredentials is returned by authenticators when the request
+	// carries no credentials they handle.
+	ErrNoCredentials = errors.New("No credentials")
+
+	// ErrInvalidCredentials is returned for unknown credentials.
+	ErrInvalidCredentials = errors.New("Invalid credentials")
+)
+
+// Principal is an authenticated client.
+type Principal struct {
+	Name string
+
+	// Prefixes of the stream keys the principal may access, an
+	// empty prefix matching every key.
+	Prefixes []string
+
+	// Operations the principal may perform.
+	Operations []string
+}
+
+// Allows returns whether the principal may perform op on the stream
+// key. An empty key, e.g. when listing streams, checks op only.
+func (p *Principal) Allows(op, key string) bool {
+	return p.can(op) && (key == "" || p.HasKey(key))
+}
+
+// HasKey returns whether the stream key is within the prefixes of
+// the principal.
+func (p *Principal) HasKey(key string) bool {
+	for _, prefix := range p.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Principal) can(op string) bool {
+	for _, o := range p.Operations {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator authenticates requests.
+type Authenticator interface {
+	// Authenticate returns the principal of the request, or
+	// ErrNoCredentials if the request carries no credentials
+	// handled by the authenticator.
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Options configures the authenticators returned by New.
+type Options struct {
+	Basic  string // name:password|name:password|...
+	Bearer string // name:token|name:token|...
+
+	// JWTs are verified against the keys of a JWKS file, and
+	// their iss and aud claims checked if set.
+	JWKSFile    string
+	JWTIssuer   string
+	JWTAudience string
+}
+
+// New returns the authenticators configured by opts, tried in
+// turn, or nil if none is.
+func New(opts Options) (Authenticator, error) {
+	var chain Chain
+
+	if opts.Basic != "" {
+		clients, err := parseClients(opts.Basic)
+		if err != nil {
+			return nil, fmt.Errorf("basic credentials: %v", err)
+		}
+		chain = append(chain, &Basic{clients})
+	}
+
+	if opts.Bearer != "" {
+		clients, err := parseClients(opts.Bearer)
+		if err != nil {
+			return nil, fmt.Errorf("bearer tokens: %v", err)
+		}
+		chain = append(chain, &Bearer{clients})
+	}
+
+	if opts.JWKSFile != "" {
+		jwt, err := NewJWT(opts.JWKSFile, opts.JWTIssuer, opts.JWTAudience)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, jwt)
+	}
+
+	if len(chain) == 0 {
+		return nil, nil
+	}
+	return chain, nil
+}
+
+// Chain tries each of its authenticators until one of them finds
+// credentials in the request.
+type Chain []Authenticator
+
+// Authenticate returns the first principal found, or else the
+// first error other than ErrNoCredentials.
+func (c Chain) Authenticate(r *http.Request) (*Principal, error) {
+	err := ErrNoCredentials
+	for _, a := range c {
+		p, e := a.Authenticate(r)
+		if e == nil {
+			return p, nil
+		}
+		if err == ErrNoCredentials {
+			err = e
+		}
+	}
+	return nil, err
+}
+
+// clients maps the names of static clients to their secrets. Several
+// secrets per client let them be rotated.
+type clients map[string][]string
+
+// parseClients reads name:secret|name:secret|..., a name being
+// repeated for each of its secrets.
+func parseClients(s string) (clients, error) {
+	c := clients{}
+	for _, client := range strings.Split(s, "|") {
+		parts := strings.SplitN(client, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("unable to parse client %q", parts[0])
+		}
+		c[parts[0]] = append(c[parts[0]], parts[1])
+	}
+	return c, nil
+}
+
+// find returns the principal of the client the secret belongs to.
+// Static clients may access every stream.
+func (c clients) find(name, secret string) (*Principal, error) {
+	for n, secrets := range c {
+		if name != "" && n != name {
+			continue
+		}
+		for _, s := range secrets {
+			if subtle.ConstantTimeCompare([]byte(s), []byte(secret)) == 1 {
+				return &Principal{
+					Name:       n,
+					Prefixes:   []string{""},
+					Operations: []string{OpCreate, OpAdmin},
+				}, nil
+			}
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// Basic authenticates HTTP basic credentials.
+type Basic struct {
+	clients clients
+}
+
+// Authenticate implements Authenticator.
+func (b *Basic) Authenticate(r *http.Request) (*Principal, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	return b.clients.find(user, password)
+}
+
+// Bearer authenticates static bearer tokens.
+type Bearer struct {
+	clients clients
+}
+
+// Authenticate implements Authenticator.
+func (b *Bearer) Authenticate(r *http.Request) (*Principal, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, ErrNoCredentials
+	}
+	return b.clients.find("", token)
+}
+
+func bearerToken(r *http.Request) string {
+	const bearer = "Bearer "
+	h := r.Header.Get("Authorization")
+	if len(h) > len(bearer) && strings.EqualFold(h[:len(bearer)], bearer) {
+		return strings.TrimSpace(h[len(bearer):])
+	}
+	return ""
+}
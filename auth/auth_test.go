@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBasic(t *testing.T) {
+	a, err := New(Options{Basic: "ci:old|ci:new|ops:secret"})
+	assert.Nil(t, err)
+
+	for user, password := range map[string]string{"ci": "new", "ops": "secret"} {
+		r, _ := http.NewRequest("PUT", "/streams/1", nil)
+		r.SetBasicAuth(user, password)
+		p, err := a.Authenticate(r)
+		assert.Nil(t, err)
+		assert.Equal(t, user, p.Name)
+		assert.True(t, p.Allows(OpCreate, "any/key"))
+		assert.True(t, p.Allows(OpAdmin, ""))
+	}
+
+	r, _ := http.NewRequest("PUT", "/streams/1", nil)
+	r.SetBasicAuth("ops", "new")
+	_, err = a.Authenticate(r)
+	assert.Equal(t, ErrInvalidCredentials, err)
+
+	r, _ = http.NewRequest("PUT", "/streams/1", nil)
+	_, err = a.Authenticate(r)
+	assert.Equal(t, ErrNoCredentials, err)
+}
+
+func TestBearer(t *testing.T) {
+	a, err := New(Options{Basic: "ci:password", Bearer: "deploys:token1|deploys:token2"})
+	assert.Nil(t, err)
+
+	r, _ := http.NewRequest("PUT", "/streams/1", nil)
+	r.Header.Set("Authorization", "Bearer token2")
+	p, err := a.Authenticate(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "deploys", p.Name)
+
+	r.Header.Set("Authorization", "bearer password")
+	_, err = a.Authenticate(r)
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
+
+func TestNew(t *testing.T) {
+	a, err := New(Options{})
+	assert.Nil(t, err)
+	assert.Nil(t, a)
+
+	for _, opts := range []Options{
+		{Basic: "user"},
+		{Basic: "user:pass|"},
+		{Bearer: ":token"},
+		{JWKSFile: "/nonexistent"},
+	} {
+		_, err := New(opts)
+		assert.NotNil(t, err, "%+v", opts)
+	}
+}
+
+func TestPrincipalAllows(t *testing.T) {
+	p := &Principal{Prefixes: []string{"builds/", "releases/"}, Operations: []string{OpCreate}}
+	assert.True(t, p.Allows(OpCreate, "builds/1"))
+	assert.True(t, p.Allows(OpCreate, "releases/1"))
+	assert.False(t, p.Allows(OpCreate, "other/1"))
+	assert.False(t, p.Allows(OpAdmin, "builds/1"))
+	assert.False(t, p.Allows(OpAdmin, ""))
+
+	assert.False(t, (&Principal{}).Allows(OpCreate, "builds/1"))
+}
@@ -0,0 +1,329 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers the hashes used by the algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clockSkew is tolerated when checking the exp and nbf claims.
+const clockSkew = time.Minute
+
+var (
+	errJWTMalformed = errors.New("Malformed JWT")
+	errJWTAlgorithm = errors.New("Unsupported JWT algorithm")
+	errJWTKey       = errors.New("Unknown JWT key")
+	errJWTSignature = errors.New("Invalid JWT signature")
+	errJWTExpired   = errors.New("JWT expired")
+	errJWTClaims    = errors.New("Invalid JWT claims")
+)
+
+// algorithms are the supported JWS algorithms, mapped to their hash.
+var algorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// JWT authenticates bearer JWTs signed by the keys of a local JWKS
+// file, reloaded when modified. Their busl_prefixes and busl_operations
+// claims scope the stream keys and operations the principal, named by
+// the sub claim, is allowed. The sub and exp claims are required.
+type JWT struct {
+	path     string
+	issuer   string
+	audience string
+
+	mu      sync.Mutex
+	modTime time.Time
+	keys    []*jwk
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject    string   `json:"sub"`
+	Issuer     string   `json:"iss"`
+	Audience   audience `json:"aud"`
+	Expires    float64  `json:"exp"`
+	NotBefore  float64  `json:"nbf"`
+	Prefixes   []string `json:"busl_prefixes"`
+	Operations []string `json:"busl_operations"`
+}
+
+// audience is either a string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(p []byte) error {
+	var s string
+	if err := json.Unmarshal(p, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	return json.Unmarshal(p, (*[]string)(a))
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	key crypto.PublicKey
+}
+
+// NewJWT returns an authenticator verifying JWTs against the JWKS
+// file at path, checking the iss and aud claims unless empty.
+func NewJWT(path, issuer, audience string) (*JWT, error) {
+	j := &JWT{path: path, issuer: issuer, audience: audience}
+	if _, err := j.currentKeys(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Authenticate implements Authenticator.
+func (j *JWT) Authenticate(r *http.Request) (*Principal, error) {
+	token := bearerToken(r)
+	if strings.Count(token, ".") != 2 {
+		return nil, ErrNoCredentials
+	}
+
+	claims, err := j.verify(token)
+	if err != nil {
+		return nil, err
+	}
+	return &Principal{
+		Name:       claims.Subject,
+		Prefixes:   claims.Prefixes,
+		Operations: claims.Operations,
+	}, nil
+}
+
+func (j *JWT) verify(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	header := &jwtHeader{}
+	if err := decodeSegment(parts[0], header); err != nil {
+		return nil, errJWTMalformed
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errJWTMalformed
+	}
+
+	hash, ok := algorithms[header.Alg]
+	if !ok {
+		return nil, errJWTAlgorithm
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+
+	keys, err := j.currentKeys()
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, k := range keys {
+		if (header.Kid != "" && k.Kid != header.Kid) || (k.Alg != "" && k.Alg != header.Alg) {
+			continue
+		}
+		found = true
+		if verifySignature(k.key, header.Alg, hash, digest, signature) {
+			return j.checkClaims(parts[1])
+		}
+	}
+	if !found {
+		return nil, errJWTKey
+	}
+	return nil, errJWTSignature
+}
+
+func (j *JWT) checkClaims(segment string) (*jwtClaims, error) {
+	claims := &jwtClaims{}
+	if err := decodeSegment(segment, claims); err != nil {
+		return nil, errJWTMalformed
+	}
+
+	// Tokens that never expire couldn't be revoked, and principals
+	// without a name couldn't be told apart in the logs.
+	if claims.Expires == 0 || claims.Subject == "" {
+		return nil, errJWTClaims
+	}
+
+	now := float64(time.Now().Unix())
+	skew := clockSkew.Seconds()
+	if now > claims.Expires+skew || (claims.NotBefore != 0 && now < claims.NotBefore-skew) {
+		return nil, errJWTExpired
+	}
+	if j.issuer != "" && claims.Issuer != j.issuer {
+		return nil, errJWTClaims
+	}
+	if j.audience != "" && !claims.Audience.contains(j.audience) {
+		return nil, errJWTClaims
+	}
+	return claims, nil
+}
+
+func (a audience) contains(aud string) bool {
+	for _, v := range a {
+		if v == aud {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	p, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(p, v)
+}
+
+func verifySignature(key crypto.PublicKey, alg string, hash crypto.Hash, digest, signature []byte) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size || hash.Size()*8 != curveHashSize(k.Curve) {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+	return false
+}
+
+// curveHashSize returns the hash size mandated for the curve by the
+// ES256, ES384 and ES512 algorithms.
+func curveHashSize(c elliptic.Curve) int {
+	if size := c.Params().BitSize; size < 512 {
+		return size
+	}
+	return 512
+}
+
+// currentKeys returns the keys of the JWKS file, reloading it when
+// modified. The previous keys are kept if it can't be reloaded.
+func (j *JWT) currentKeys() ([]*jwk, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	info, err := os.Stat(j.path)
+	if err != nil {
+		if j.keys != nil {
+			log.Printf("auth.jwks.stat error=%v", err)
+			return j.keys, nil
+		}
+		return nil, err
+	}
+	if j.keys != nil && info.ModTime().Equal(j.modTime) {
+		return j.keys, nil
+	}
+
+	keys, err := loadJWKS(j.path)
+	if err != nil {
+		if j.keys != nil {
+			log.Printf("auth.jwks.reload error=%v", err)
+			return j.keys, nil
+		}
+		return nil, err
+	}
+	j.keys, j.modTime = keys, info.ModTime()
+	return keys, nil
+}
+
+func loadJWKS(path string) ([]*jwk, error) {
+	p, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []*jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(p, &set); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	keys := set.Keys[:0]
+	for _, k := range set.Keys {
+		if k.key, err = k.publicKey(); err != nil {
+			return nil, fmt.Errorf("%s: key %q: %v", path, k.Kid, err)
+		}
+		if k.key != nil {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+// publicKey decodes RSA and EC keys, other key types being ignored.
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, nil
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	p, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(p) == 0 {
+		return nil, errors.New("invalid integer")
+	}
+	return new(big.Int).SetBytes(p), nil
+}
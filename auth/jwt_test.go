@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	rsaKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _  = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+)
+
+func b64(p []byte) string {
+	return base64.RawURLEncoding.EncodeToString(p)
+}
+
+func writeJWKS(t *testing.T, path string, keys ...map[string]string) {
+	p, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	assert.Nil(t, ioutil.WriteFile(path, p, 0600))
+}
+
+func rsaJWK(kid string) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"n":   b64(rsaKey.N.Bytes()),
+		"e":   b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string) map[string]string {
+	return map[string]string{
+		"kty": "EC",
+		"kid": kid,
+		"crv": "P-256",
+		"x":   b64(padded(ecKey.X)),
+		"y":   b64(padded(ecKey.Y)),
+	}
+}
+
+// padded returns the 32 bytes big-endian encoding of a P-256 integer.
+func padded(n *big.Int) []byte {
+	b := make([]byte, 32)
+	nb := n.Bytes()
+	copy(b[len(b)-len(nb):], nb)
+	return b
+}
+
+func signJWT(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+
+	var hash crypto.Hash = crypto.SHA256
+	h := hash.New()
+	h.Write([]byte(signed))
+
+	var signature []byte
+	switch alg {
+	case "RS256":
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, rsaKey, hash, h.Sum(nil))
+		assert.Nil(t, err)
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, h.Sum(nil))
+		assert.Nil(t, err)
+		signature = append(padded(r), padded(s)...)
+	}
+	return signed + "." + b64(signature)
+}
+
+func bearerRequest(token string) *http.Request {
+	r, _ := http.NewRequest("PUT", "/streams/1", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestJWT(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "jwks")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jwks.json")
+	writeJWKS(t, path, rsaJWK("rsa"), ecJWK("ec"))
+
+	a, err := New(Options{JWKSFile: path, JWTIssuer: "https://issuer", JWTAudience: "busl"})
+	assert.Nil(t, err)
+
+	claims := map[string]interface{}{
+		"sub":             "builds",
+		"iss":             "https://issuer",
+		"aud":             []string{"other", "busl"},
+		"exp":             time.Now().Add(time.Hour).Unix(),
+		"busl_prefixes":   []string{"builds/"},
+		"busl_operations": []string{OpCreate},
+	}
+	for alg, kid := range map[string]string{"RS256": "rsa", "ES256": "ec"} {
+		p, err := a.Authenticate(bearerRequest(signJWT(t, alg, kid, claims)))
+		assert.Nil(t, err, alg)
+		assert.Equal(t, "builds", p.Name)
+		assert.True(t, p.Allows(OpCreate, "builds/1"))
+		assert.False(t, p.Allows(OpCreate, "other/1"))
+		assert.False(t, p.Allows(OpAdmin, "builds/1"))
+	}
+
+	// Not a JWT.
+	_, err = a.Authenticate(bearerRequest("token"))
+	assert.Equal(t, ErrNoCredentials, err)
+}
+
+func TestJWTInvalid(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "jwks")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jwks.json")
+	writeJWKS(t, path, rsaJWK("rsa"))
+
+	a, err := NewJWT(path, "", "busl")
+	assert.Nil(t, err)
+
+	valid := map[string]interface{}{"sub": "builds", "aud": "busl", "exp": time.Now().Add(time.Hour).Unix()}
+	token := signJWT(t, "RS256", "rsa", valid)
+	// with returns the valid claims, with the given claim changed
+	with := func(claim string, value interface{}) map[string]interface{} {
+		claims := map[string]interface{}{claim: value}
+		for k, v := range valid {
+			if k != claim {
+				claims[k] = v
+			}
+		}
+		if value == nil {
+			delete(claims, claim)
+		}
+		return claims
+	}
+
+	for name, tc := range map[string]struct {
+		token string
+		err   error
+	}{
+		"expired":       {signJWT(t, "RS256", "rsa", with("exp", time.Now().Add(-time.Hour).Unix())), errJWTExpired},
+		"not yet valid": {signJWT(t, "RS256", "rsa", with("nbf", time.Now().Add(time.Hour).Unix())), errJWTExpired},
+		"no expiry":     {signJWT(t, "RS256", "rsa", with("exp", nil)), errJWTClaims},
+		"no subject":    {signJWT(t, "RS256", "rsa", with("sub", "")), errJWTClaims},
+		"audience":      {signJWT(t, "RS256", "rsa", with("aud", "other")), errJWTClaims},
+		"unknown key":   {signJWT(t, "RS256", "other", valid), errJWTKey},
+		"wrong key":     {signJWT(t, "ES256", "", valid), errJWTSignature},
+		"tampered":      {token[:len(token)-4] + "AAAA", errJWTSignature},
+		"none":          {b64([]byte(`{"alg":"none"}`)) + "." + b64([]byte(`{"aud":"busl"}`)) + ".", errJWTAlgorithm},
+		"malformed":     {"a.b.c", errJWTMalformed},
+	} {
+		_, err := a.Authenticate(bearerRequest(tc.token))
+		assert.Equal(t, tc.err, err, name)
+	}
+}
+
+func TestJWTReload(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "jwks")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jwks.json")
+	writeJWKS(t, path, rsaJWK("rsa"))
+
+	a, err := NewJWT(path, "", "")
+	assert.Nil(t, err)
+	token := signJWT(t, "ES256", "ec", map[string]interface{}{"sub": "builds", "exp": time.Now().Add(time.Hour).Unix()})
+
+	_, err = a.Authenticate(bearerRequest(token))
+	assert.Equal(t, errJWTKey, err)
+
+	// Rotate the keys.
+	writeJWKS(t, path, ecJWK("ec"))
+	future := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(path, future, future))
+
+	p, err := a.Authenticate(bearerRequest(token))
+	assert.Nil(t, err)
+	assert.Equal(t, "builds", p.Name)
+
+	// Invalid files are ignored, keeping the current keys.
+	assert.Nil(t, ioutil.WriteFile(path, []byte("{"), 0600))
+	future = future.Add(time.Minute)
+	assert.Nil(t, os.Chtimes(path, future, future))
+
+	_, err = a.Authenticate(bearerRequest(token))
+	assert.Nil(t, err)
+}
@@ -1,7 +1,244 @@
 package broker
 
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// known errors
+var (
+	ErrNotRegistered     = errors.New("Channel is not registered.")
+	ErrAlreadyRegistered = errors.New("Channel is already registered.")
+	ErrClosed            = errors.New("Channel is closed.")
+	ErrTooLarge          = errors.New("Channel exceeds its maximum size.")
+	ErrInvalidCursor     = errors.New("Invalid cursor.")
+)
+
+// TruncatedMarker is appended to the streams truncated by OverflowTruncate
+const TruncatedMarker = "\n[busl: output truncated, the stream exceeded its maximum size]\n"
+
+// Overflow is the policy applied to writes past the maximum size of a stream
+type Overflow string
+
+// Overflow policies
+const (
+	// OverflowReject fails the writes past the maximum
+	// size with ErrTooLarge. This is the default.
+	OverflowReject Overflow = "reject"
+
+	// OverflowTruncate appends TruncatedMarker to the stream,
+	// and then silently drops every write past the maximum size.
+	OverflowTruncate Overflow = "truncate"
+
+	// OverflowRolling drops the oldest content of the stream to keep
+	// it under its maximum size. Offsets keep counting from the start
+	// of the stream, and readers lagging behind skip what got dropped.
+	OverflowRolling Overflow = "rolling"
+)
+
+// ParseOverflow returns the overflow policy with the given name,
+// the empty name standing for OverflowReject.
+func ParseOverflow(name string) (Overflow, error) {
+	switch o := Overflow(name); o {
+	case "":
+		return OverflowReject, nil
+	case OverflowReject, OverflowTruncate, OverflowRolling:
+		return o, nil
+	default:
+		return "", fmt.Errorf("Unknown overflow policy %q", name)
+	}
+}
+
+// StreamOptions holds the settings of a stream, given at registration
+type StreamOptions struct {
+	MaxSize  int64 // maximum size in bytes, zero for no limit
+	Overflow Overflow
+
+	ContentType string
+	RequestID   string // of the request creating the stream
+}
+
+// StreamMeta describes a stream
+type StreamMeta struct {
+	StreamOptions
+
+	Created     time.Time
+	LastWrite   time.Time // zero until the first write
+	Length      int64
+	Done        bool
+	TTL         time.Duration // left before the stream expires
+	Subscribers int64
+
+	// Nonce is drawn at random whenever the stream gets registered,
+	// or reset, so that what's bound to it doesn't outlive it.
+	Nonce string
+
+	LocalSubscribers int64 // readers in this process
+}
+
+// newNonce returns the random nonce of a new stream.
+func newNonce() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// limited returns whether the options limit the stream size
+func (o *StreamOptions) limited() bool {
+	return o != nil && o.MaxSize > 0
+}
+
+// rollingKeep returns how many bytes to keep once a rolling stream
+// exceeds max. Trimming copies the content kept, so some room is made
+// at once rather than trimming on every write.
+func rollingKeep(max int64) int64 {
+	return max - max/8
+}
+
 // Registrar is a basic broker interface
 type Registrar interface {
-	Register(key string) error
-	IsRegistered(key string) bool
+	// Register creates the stream, failing with ErrAlreadyRegistered
+	// if it exists. Nil options mean no size limit.
+	Register(key string, opts *StreamOptions) error
+
+	// Reset creates the stream, wiping it if it exists.
+	Reset(key string, opts *StreamOptions) error
+
+	IsRegistered(key string) (bool, error)
+}
+
+// Broker stores the content of streams and notifies
+// their subscribers whenever new content is published.
+type Broker interface {
+	Registrar
+
+	// NewWriter returns a writer appending to the given stream.
+	// Closing the writer marks the stream as done. Writes past the
+	// maximum size of the stream follow its overflow policy.
+	NewWriter(key string) (io.WriteCloser, error)
+
+	// NewReader returns a reader for the given stream. The reader
+	// implements io.Seeker, and blocks until more content is
+	// published or the stream is done.
+	NewReader(key string) (io.ReadCloser, error)
+
+	// Get returns the full content of a stream, or what's left
+	// of it for rolling streams.
+	Get(key string) ([]byte, error)
+
+	// Len returns the length of the content published to a stream,
+	// including what rolling streams dropped.
+	Len(key string) (int64, error)
+
+	// IsDone returns whether a stream has been closed by its publisher.
+	IsDone(key string) (bool, error)
+
+	// RenewExpiry extends the lifetime of a stream.
+	RenewExpiry(key string) error
+
+	// Meta returns the metadata of a stream,
+	// or ErrNotRegistered if there's no such stream.
+	Meta(key string) (*StreamMeta, error)
+
+	// Delete removes a stream. Its readers reach EOF.
+	Delete(key string) error
+
+	// List pages through the keys of the streams. Starting from an
+	// empty cursor, it returns about count keys and the cursor to
+	// continue from, which is empty once every stream got listed.
+	List(cursor string, count int) (keys []string, next string, err error)
+
+	// TailOffset returns the offset the last given number of lines
+	// of a stream start at, or ErrNotRegistered if there's no such
+	// stream. A trailing newline doesn't start a line.
+	TailOffset(key string, lines int) (int64, error)
+
+	// TimeOffset returns the offset of the first content written at
+	// or after t, or the length of the stream if nothing was. It
+	// fails with ErrNotRegistered if there's no such stream.
+	TimeOffset(key string, t time.Time) (int64, error)
+}
+
+// NoContent returns whether the stream is done and
+// has no content past the given offset.
+func NoContent(b Broker, key string, offset int64) bool {
+	done, err := b.IsDone(key)
+	if err != nil || !done {
+		return false
+	}
+
+	length, err := b.Len(key)
+	if err != nil {
+		return false
+	}
+
+	return offset > (length - 1)
+}
+
+// writeMark records when the content at offset got written
+type writeMark struct {
+	offset int64
+	at     time.Time
+}
+
+// writeTime returns the time of the last mark at or before offset,
+// or the zero time if there's none.
+func writeTime(marks []writeMark, offset int64) time.Time {
+	i := sort.Search(len(marks), func(i int) bool { return marks[i].offset > offset })
+	if i == 0 {
+		return time.Time{}
+	}
+	return marks[i-1].at
+}
+
+// pruneMarks drops the marks preceding the one offset was written at,
+// for readers only asking about what's next.
+func pruneMarks(marks []writeMark, offset int64) []writeMark {
+	i := sort.Search(len(marks), func(i int) bool { return marks[i].offset > offset })
+	if i > 1 {
+		return marks[i-1:]
+	}
+	return marks
+}
+
+// TailChunkSize is how much content is read at once looking for lines
+const TailChunkSize = 32 * 1024
+
+// FindTail returns the offset the last given number of lines of a
+// stream of the given length start at. prev returns the content of the
+// stream backwards, chunk by chunk, and an empty chunk once done.
+// It's shared by the brokers and the storage fallback.
+func FindTail(lines int, length int64, prev func() (chunk []byte, offset int64, err error)) (int64, error) {
+	if lines <= 0 {
+		return length, nil
+	}
+
+	start := length
+	for {
+		chunk, offset, err := prev()
+		if err != nil {
+			return 0, err
+		}
+		if len(chunk) == 0 {
+			return start, nil
+		}
+
+		for i := len(chunk) - 1; i >= 0; i-- {
+			pos := offset + int64(i)
+			if chunk[i] != '\n' || pos >= length-1 {
+				continue
+			}
+			if lines--; lines == 0 {
+				return pos + 1, nil
+			}
+		}
+		start = offset
+	}
 }
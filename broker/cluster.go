@@ -0,0 +1,488 @@
+package broker
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/util"
+)
+
+const (
+	clusterSlots        = 16384
+	clusterMaxRedirects = 5
+	clusterRetryDelay   = 100 * time.Millisecond
+)
+
+// cluster routes commands to the nodes of a redis cluster, based on
+// the hash slot of their keys. The slots are loaded on first use, and
+// reloaded in the background whenever a node redirects a command.
+type cluster struct {
+	dialer *dialer
+	seed   string // address of the URL
+
+	load      sync.Once
+	reloading int32
+
+	mutex sync.RWMutex
+	slots []string // master address of every slot
+	pools map[string]*redis.Pool
+}
+
+func newCluster(d *dialer) *cluster {
+	return &cluster{
+		dialer: d,
+		seed:   d.address(),
+		slots:  make([]string, clusterSlots),
+		pools:  make(map[string]*redis.Pool),
+	}
+}
+
+// conn returns a connection borrowing from the pools of the nodes
+func (c *cluster) conn() redis.Conn {
+	return &clusterConn{cluster: c, get: func(address string) (redis.Conn, error) {
+		return c.pool(address).Get(), nil
+	}}
+}
+
+// dialAny connects to any node of the cluster
+func (c *cluster) dialAny(readTimeout time.Duration) (redis.Conn, error) {
+	conn, err := c.dialer.dialAddr(c.addr(""), readTimeout)
+	if err != nil {
+		return c.dialer.dialAddr(c.seed, readTimeout)
+	}
+	return conn, err
+}
+
+func (c *cluster) pool(address string) *redis.Pool {
+	c.mutex.RLock()
+	p, ok := c.pools[address]
+	c.mutex.RUnlock()
+	if ok {
+		return p
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if p, ok := c.pools[address]; ok {
+		return p
+	}
+	p = newRedisPool(c.dialer.opts, func() (redis.Conn, error) {
+		return c.dialer.dialAddr(address, c.dialer.opts.ReadTimeout)
+	})
+	c.pools[address] = p
+	return p
+}
+
+// addr returns the address of the node serving the key,
+// or of any node if the key is empty.
+func (c *cluster) addr(key string) string {
+	c.load.Do(func() { c.reload() })
+
+	slot := 0
+	if key != "" {
+		slot = keySlot(key)
+	}
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if address := c.slots[slot]; address != "" {
+		return address
+	}
+	return c.seed
+}
+
+// moved records the new address of a slot, and reloads
+// all of them since a resharding may be in progress.
+func (c *cluster) moved(slot int, address string) {
+	c.mutex.Lock()
+	c.slots[slot] = address
+	c.mutex.Unlock()
+
+	if atomic.CompareAndSwapInt32(&c.reloading, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&c.reloading, 0)
+			c.reload()
+		}()
+	}
+}
+
+// reload fetches the slots from the first node answering
+func (c *cluster) reload() error {
+	var err error
+	for _, address := range append(c.masters(), c.seed) {
+		conn := c.pool(address).Get()
+		var slots []string
+		slots, err = loadSlots(conn, address)
+		conn.Close()
+
+		if err == nil {
+			c.mutex.Lock()
+			c.slots = slots
+			c.mutex.Unlock()
+			return nil
+		}
+	}
+
+	util.CountWithData("RedisBroker.cluster.reload.error", 1, "err=%s", err)
+	return err
+}
+
+func loadSlots(conn redis.Conn, address string) ([]string, error) {
+	reply, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+
+	slots := make([]string, clusterSlots)
+	for _, r := range reply {
+		r, err := redis.Values(r, nil)
+		if err != nil || len(r) < 3 {
+			return nil, fmt.Errorf("Unexpected CLUSTER SLOTS reply: %v", r)
+		}
+		start, _ := redis.Int(r[0], nil)
+		end, _ := redis.Int(r[1], nil)
+		master, err := redis.Values(r[2], nil)
+		if err != nil || len(master) < 2 {
+			return nil, fmt.Errorf("Unexpected CLUSTER SLOTS reply: %v", r)
+		}
+		host, _ := redis.String(master[0], nil)
+		port, _ := redis.Int(master[1], nil)
+		if host == "" {
+			// Nodes may not know their own address.
+			host, _, _ = net.SplitHostPort(address)
+		}
+
+		for i := start; i <= end && i < clusterSlots; i++ {
+			slots[i] = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+	}
+	return slots, nil
+}
+
+// masters returns the address of every node serving slots
+func (c *cluster) masters() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	seen := make(map[string]bool)
+	var masters []string
+	for _, address := range c.slots {
+		if address != "" && !seen[address] {
+			seen[address] = true
+			masters = append(masters, address)
+		}
+	}
+	return masters
+}
+
+// scan calls fn for every key matching the pattern on every master
+func (c *cluster) scan(pattern string, fn func(key string) error) error {
+	c.load.Do(func() { c.reload() })
+
+	masters := c.masters()
+	if len(masters) == 0 {
+		masters = []string{c.seed}
+	}
+
+	for _, address := range masters {
+		conn := c.pool(address).Get()
+		err := scanConn(conn, pattern, fn)
+		conn.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanPage runs a single SCAN on one of the masters. Cursors are
+// prefixed with the index of the master scanned, e.g. 1:42, moving
+// on to the next master once done with one.
+func (c *cluster) scanPage(pattern, cursor string, count int) ([]string, string, error) {
+	c.load.Do(func() { c.reload() })
+
+	masters := c.masters()
+	if len(masters) == 0 {
+		masters = []string{c.seed}
+	}
+
+	i := 0
+	if cursor != "" {
+		parts := strings.SplitN(cursor, ":", 2)
+		n, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 || n < 0 {
+			return nil, "", ErrInvalidCursor
+		}
+		i, cursor = n, parts[1]
+	}
+	if i >= len(masters) {
+		return nil, "", nil
+	}
+
+	conn := c.pool(masters[i]).Get()
+	defer conn.Close()
+
+	keys, next, err := scanPage(conn, pattern, cursor, count)
+	if err != nil {
+		return nil, "", err
+	}
+	if next != "" {
+		next = fmt.Sprintf("%d:%s", i, next)
+	} else if i+1 < len(masters) {
+		next = fmt.Sprintf("%d:", i+1)
+	}
+	return keys, next, nil
+}
+
+func (c *cluster) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, p := range c.pools {
+		p.Close()
+	}
+}
+
+// clusterConn sends the commands queued until a reply is expected to
+// the node owning the first key they refer to. A stream's keys share
+// the same slot, so that MULTI blocks and scripts run on a single
+// node. Do follows MOVED and ASK redirections, replaying the queued
+// commands on the right node; Flush and Receive don't.
+type clusterConn struct {
+	cluster *cluster
+	get     func(address string) (redis.Conn, error)
+	queue   []command
+
+	mutex   sync.Mutex // guards conn, which may get closed while in use
+	conn    redis.Conn
+	address string
+	closed  bool
+}
+
+type command struct {
+	name string
+	args []interface{}
+}
+
+func (c *clusterConn) Send(cmd string, args ...interface{}) error {
+	c.queue = append(c.queue, command{cmd, args})
+	return nil
+}
+
+func (c *clusterConn) Flush() error {
+	conn, err := c.send(c.route(c.queue), false)
+	if err != nil {
+		return err
+	}
+	return conn.Flush()
+}
+
+func (c *clusterConn) Receive() (interface{}, error) {
+	conn, err := c.bind(c.address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.Receive()
+}
+
+func (c *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd != "" {
+		c.Send(cmd, args...)
+	}
+	queue := c.queue
+	address := c.route(queue)
+	asking := false
+
+	for i := 0; ; i++ {
+		c.queue = queue
+		if cmd != "" {
+			c.queue = queue[:len(queue)-1]
+		}
+		conn, err := c.send(address, asking)
+		if err != nil {
+			return nil, err
+		}
+
+		reply, err := conn.Do(cmd, args...)
+		if cmd == "" && asking {
+			if replies, ok := reply.([]interface{}); ok && len(replies) > 0 {
+				reply = replies[1:]
+			}
+		}
+
+		e, ok := err.(redis.Error)
+		if !ok || i == clusterMaxRedirects {
+			return reply, err
+		}
+
+		switch fields := strings.Fields(string(e)); {
+		case len(fields) == 3 && (fields[0] == "MOVED" || fields[0] == "ASK"):
+			util.CountWithData("RedisBroker.cluster.redirect", 1, "kind=%s", fields[0])
+			asking = fields[0] == "ASK"
+			if slot, err := strconv.Atoi(fields[1]); err == nil && !asking {
+				c.cluster.moved(slot, fields[2])
+			}
+			address = fields[2]
+		case len(fields) > 0 && fields[0] == "TRYAGAIN":
+			// Keys of a multi-key command are being migrated.
+			asking = false
+			time.Sleep(clusterRetryDelay)
+		default:
+			return reply, err
+		}
+	}
+}
+
+// route returns the address of the node owning the first key of the
+// queue, or an empty address if any node can handle the queue.
+func (c *clusterConn) route(queue []command) string {
+	if key := queueKey(queue); key != "" {
+		return c.cluster.addr(key)
+	}
+	return ""
+}
+
+// send writes the queued commands to the node at address
+func (c *clusterConn) send(address string, asking bool) (redis.Conn, error) {
+	queue := c.queue
+	c.queue = nil
+
+	conn, err := c.bind(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if asking {
+		conn.Send("ASKING")
+	}
+	for _, cmd := range queue {
+		if err := conn.Send(cmd.name, cmd.args...); err != nil {
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// bind makes the connection to address the current one. An empty
+// address keeps the current connection, or picks any node.
+func (c *clusterConn) bind(address string) (redis.Conn, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+	if c.conn != nil && (c.address == address || address == "") {
+		return c.conn, nil
+	}
+	if address == "" {
+		address = c.cluster.addr("")
+	}
+
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	conn, err := c.get(address)
+	if err != nil {
+		return nil, err
+	}
+	c.conn, c.address = conn, address
+	return conn, nil
+}
+
+func (c *clusterConn) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Err()
+}
+
+func (c *clusterConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.closed = true
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// queueKey returns the first key the queued commands refer to
+func queueKey(queue []command) string {
+	for _, cmd := range queue {
+		if key := commandKey(cmd.name, cmd.args); key != "" {
+			return key
+		}
+	}
+	return ""
+}
+
+// commandKey returns the first key of a command, if any
+func commandKey(name string, args []interface{}) string {
+	switch strings.ToUpper(name) {
+	case "MULTI", "EXEC", "DISCARD", "WATCH", "UNWATCH", "PING", "ECHO", "ASKING",
+		"SCAN", "ROLE", "INFO", "CLUSTER", "SCRIPT", "PUBLISH", "SUBSCRIBE", "UNSUBSCRIBE":
+		return ""
+	case "EVAL", "EVALSHA":
+		if len(args) > 2 && argString(args[1]) != "0" {
+			return argString(args[2])
+		}
+		return ""
+	}
+
+	if len(args) == 0 {
+		return ""
+	}
+	return argString(args[0])
+}
+
+func argString(arg interface{}) string {
+	switch arg := arg.(type) {
+	case string:
+		return arg
+	case []byte:
+		return string(arg)
+	default:
+		return fmt.Sprint(arg)
+	}
+}
+
+// keySlot returns the cluster hash slot of a key. Only the part between
+// braces is hashed when present, so that related keys share a slot.
+func keySlot(key string) int {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		if j := strings.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+// crc16 implements the CRC16-CCITT (XMODEM) checksum used by redis cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
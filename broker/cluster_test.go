@@ -0,0 +1,208 @@
+package broker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeySlot(t *testing.T) {
+	assert.Equal(t, uint16(0x31c3), crc16("123456789"))
+	assert.Equal(t, 12182, keySlot("foo"))
+	assert.Equal(t, keySlot("{user1000}.following"), keySlot("{user1000}.followers"))
+	assert.Equal(t, keySlot("user1000"), keySlot("{user1000}:id"))
+	assert.Equal(t, int(crc16("foo{}{bar}")%clusterSlots), keySlot("foo{}{bar}"))
+}
+
+func TestCommandKey(t *testing.T) {
+	assert.Equal(t, "", commandKey("MULTI", nil))
+	assert.Equal(t, "a", commandKey("SETEX", []interface{}{"a", 1, "b"}))
+	assert.Equal(t, "a", commandKey("GET", []interface{}{[]byte("a")}))
+	assert.Equal(t, "", commandKey("PUBLISH", []interface{}{"a", 1}))
+	assert.Equal(t, "a", commandKey("EVALSHA", []interface{}{"sha", 2, "a", "b"}))
+	assert.Equal(t, "", commandKey("EVAL", []interface{}{"src", 0}))
+}
+
+// fakeNode replies to the commands it receives with reply
+type fakeNode struct {
+	received []string
+	reply    func(cmd string) (interface{}, error)
+	pending  int
+}
+
+func (n *fakeNode) Close() error { return nil }
+func (n *fakeNode) Err() error   { return nil }
+func (n *fakeNode) Flush() error { return nil }
+
+func (n *fakeNode) Send(cmd string, args ...interface{}) error {
+	n.received = append(n.received, cmd)
+	n.pending++
+	return nil
+}
+
+func (n *fakeNode) Receive() (interface{}, error) {
+	n.pending--
+	return nil, nil
+}
+
+func (n *fakeNode) Do(cmd string, args ...interface{}) (interface{}, error) {
+	n.received = append(n.received, cmd)
+	n.pending = 0
+	return n.reply(cmd)
+}
+
+func newFakeCluster(nodes map[string]*fakeNode) *clusterConn {
+	c := &cluster{seed: "a:1", slots: make([]string, clusterSlots), reloading: 1}
+	c.load.Do(func() {})
+	return &clusterConn{cluster: c, get: func(address string) (redis.Conn, error) {
+		n, ok := nodes[address]
+		if !ok {
+			return nil, fmt.Errorf("unknown node %s", address)
+		}
+		return n, nil
+	}}
+}
+
+func TestClusterMoved(t *testing.T) {
+	a := &fakeNode{reply: func(string) (interface{}, error) { return nil, redis.Error("MOVED 12182 b:2") }}
+	b := &fakeNode{reply: func(string) (interface{}, error) { return "OK", nil }}
+	conn := newFakeCluster(map[string]*fakeNode{"a:1": a, "b:2": b})
+
+	conn.Send("MULTI")
+	conn.Send("SET", "foo", "bar")
+	reply, err := conn.Do("EXEC")
+	assert.Nil(t, err)
+	assert.Equal(t, "OK", reply)
+
+	assert.Equal(t, []string{"MULTI", "SET", "EXEC"}, a.received)
+	assert.Equal(t, []string{"MULTI", "SET", "EXEC"}, b.received)
+	assert.Equal(t, "b:2", conn.cluster.slots[12182])
+}
+
+func TestClusterAsk(t *testing.T) {
+	a := &fakeNode{reply: func(string) (interface{}, error) { return nil, redis.Error("ASK 12182 b:2") }}
+	b := &fakeNode{reply: func(string) (interface{}, error) { return "bar", nil }}
+	conn := newFakeCluster(map[string]*fakeNode{"a:1": a, "b:2": b})
+
+	reply, err := conn.Do("GET", "foo")
+	assert.Nil(t, err)
+	assert.Equal(t, "bar", reply)
+
+	assert.Equal(t, []string{"ASKING", "GET"}, b.received)
+	assert.Equal(t, "", conn.cluster.slots[12182])
+}
+
+func TestClusterTooManyRedirects(t *testing.T) {
+	a := &fakeNode{reply: func(string) (interface{}, error) { return nil, redis.Error("ASK 12182 a:1") }}
+	conn := newFakeCluster(map[string]*fakeNode{"a:1": a})
+
+	_, err := conn.Do("GET", "foo")
+	assert.Equal(t, redis.Error("ASK 12182 a:1"), err)
+	// The first attempt, then every redirect preceded by ASKING.
+	assert.Equal(t, 1+2*clusterMaxRedirects, len(a.received))
+}
+
+// TestClusterBroker runs against REDIS_URL as a single node cluster
+func TestClusterBroker(t *testing.T) {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		t.Skip("REDIS_URL is required")
+	}
+
+	b, err := NewRedisBroker(RedisOptions{URL: url, Cluster: true})
+	assert.Nil(t, err)
+	defer b.Close()
+	testClusterStreams(t, b)
+
+	testListDelete(t, b)
+	testTailOffset(t, b)
+
+	conn := b.pool.Get()
+	defer conn.Close()
+	uuid, _ := util.NewUUID()
+	b.Register(uuid, nil)
+	exists, _ := redis.Bool(conn.Do("EXISTS", "{"+uuid+"}:id"))
+	assert.True(t, exists)
+}
+
+func TestClusterNodes(t *testing.T) {
+	var nodes []string
+	for i := 0; i < 3; i++ {
+		node, stop := startRedis(t, "", "--cluster-enabled", "yes", "--cluster-node-timeout", "1000")
+		defer stop()
+		nodes = append(nodes, node)
+	}
+
+	for i, node := range nodes {
+		var slots []interface{}
+		for slot := i * clusterSlots / 3; slot < (i+1)*clusterSlots/3; slot++ {
+			slots = append(slots, slot)
+		}
+		redisDo(t, node, "CLUSTER", append([]interface{}{"ADDSLOTS"}, slots...)...)
+		host, port, _ := net.SplitHostPort(nodes[0])
+		redisDo(t, node, "CLUSTER", "MEET", host, port)
+	}
+	for _, node := range nodes {
+		node := node
+		waitFor(t, func() bool {
+			info, _ := redis.String(redisDo(t, node, "CLUSTER", "INFO"), nil)
+			return strings.Contains(info, "cluster_state:ok")
+		})
+	}
+
+	b, err := NewRedisBroker(RedisOptions{URL: "redis://" + nodes[1], Cluster: true})
+	assert.Nil(t, err)
+	defer b.Close()
+	testClusterStreams(t, b)
+	assert.Equal(t, 3, len(b.pool.cluster.masters()))
+
+	// Stale slots get fixed by redirections.
+	c := b.pool.cluster
+	c.mutex.Lock()
+	for i := range c.slots {
+		c.slots[i] = nodes[0]
+	}
+	c.mutex.Unlock()
+	testClusterStreams(t, b)
+
+	s := &RedisStreamBroker{b}
+	uuid, _ := util.NewUUID()
+	assert.Nil(t, s.Register(uuid, nil))
+	w, _ := s.NewWriter(uuid)
+	w.Write([]byte("hello"))
+	w.Close()
+	r, _ := s.NewReader(uuid)
+	defer r.Close()
+	buf, _ := ioutil.ReadAll(r)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func testClusterStreams(t *testing.T, b *RedisBroker) {
+	for i := 0; i < 10; i++ {
+		uuid, _ := util.NewUUID()
+		assert.Nil(t, b.Register(uuid, nil))
+
+		r, err := b.NewReader(uuid)
+		assert.Nil(t, err)
+		w, err := b.NewWriter(uuid)
+		assert.Nil(t, err)
+
+		w.Write([]byte("busl"))
+		w.Write([]byte(" hello"))
+		w.Close()
+
+		buf, _ := ioutil.ReadAll(r)
+		r.Close()
+		assert.Equal(t, "busl hello", string(buf))
+
+		done, _ := b.IsDone(uuid)
+		assert.True(t, done)
+	}
+}
@@ -0,0 +1,272 @@
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/util"
+)
+
+const (
+	hubReconnectDelay   = time.Second
+	hubSubscribeTimeout = 5 * time.Second
+)
+
+// hub multiplexes the subscriptions of all the readers of a process
+// over a single pub/sub connection. Subscriptions are reference
+// counted per stream: the first reader subscribes to the stream's
+// channels, and the last one to leave unsubscribes from them.
+type hub struct {
+	dial    func() (redis.Conn, error)
+	newTail func(channel) tail // nil when tail caching is disabled
+
+	mutex  sync.Mutex
+	psc    *redis.PubSubConn        // nil while disconnected
+	subs   map[string]*subscription // keyed by channel name
+	start  sync.Once
+	closed bool
+}
+
+type subscription struct {
+	channel   channel
+	listeners map[*listener]struct{}
+	ready     chan struct{} // closed once redis confirmed the subscription
+	tail      tail
+}
+
+// tail caches the head of a stream for the readers of a subscription,
+// in the layout of the broker: a *tailCache for strings and a
+// *streamTail for redis streams.
+type tail interface {
+	// invalidate marks the cache as needing a refresh on the next read.
+	invalidate()
+}
+
+// listener is notified whenever something is published to
+// the stream it's subscribed to.
+type listener struct {
+	C   chan struct{}
+	sub *subscription
+}
+
+func newHub(dial func() (redis.Conn, error), newTail func(channel) tail) *hub {
+	return &hub{dial: dial, newTail: newTail, subs: make(map[string]*subscription)}
+}
+
+// subscribe registers a new listener for the given channel. It returns
+// once redis confirmed the subscription, so that nothing published
+// afterwards can be missed.
+func (h *hub) subscribe(c channel) *listener {
+	h.start.Do(func() { go h.run() })
+
+	h.mutex.Lock()
+	sub, ok := h.subs[c.id()]
+	if !ok {
+		sub = &subscription{
+			channel:   c,
+			listeners: make(map[*listener]struct{}),
+			ready:     make(chan struct{}),
+		}
+		if h.newTail != nil {
+			sub.tail = h.newTail(c)
+		}
+		h.subs[c.id()] = sub
+		h.subs[c.killID()] = sub
+		h.send("SUBSCRIBE", c.id(), c.killID())
+	}
+
+	l := &listener{C: make(chan struct{}, 1), sub: sub}
+	sub.listeners[l] = struct{}{}
+	ready := sub.ready
+	h.mutex.Unlock()
+
+	select {
+	case <-ready:
+	case <-time.After(hubSubscribeTimeout):
+		util.Count("RedisBroker.hub.subscribe.timeout")
+	}
+	return l
+}
+
+// unsubscribe removes the listener, and unsubscribes from
+// the stream once no listeners are left.
+func (h *hub) unsubscribe(l *listener) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	sub := l.sub
+	delete(sub.listeners, l)
+	if len(sub.listeners) > 0 || h.subs[sub.channel.id()] != sub {
+		return
+	}
+
+	delete(h.subs, sub.channel.id())
+	delete(h.subs, sub.channel.killID())
+	h.send("UNSUBSCRIBE", sub.channel.id(), sub.channel.killID())
+}
+
+// send writes a command to the pub/sub connection. Commands sent
+// while disconnected are replayed on reconnection. The caller
+// must hold the mutex.
+func (h *hub) send(cmd string, args ...interface{}) {
+	if h.psc == nil {
+		return
+	}
+
+	h.psc.Conn.Send(cmd, args...)
+	if err := h.psc.Conn.Flush(); err != nil {
+		util.CountWithData("RedisBroker.hub.send.error", 1, "err=%s", err)
+	}
+}
+
+// run keeps the pub/sub connection alive, dispatching the
+// messages it receives, until the hub gets closed.
+func (h *hub) run() {
+	for {
+		conn, err := h.dial()
+		if err != nil {
+			util.CountWithData("RedisBroker.hub.dial.error", 1, "err=%s", err)
+			if h.isClosed() {
+				return
+			}
+			time.Sleep(hubReconnectDelay)
+			continue
+		}
+
+		psc := &redis.PubSubConn{Conn: conn}
+		if !h.connect(psc) {
+			conn.Close()
+			return
+		}
+
+		err = h.receive(psc)
+		util.CountWithData("RedisBroker.hub.receive.error", 1, "err=%s", err)
+		if !h.disconnect() {
+			return
+		}
+		time.Sleep(hubReconnectDelay)
+	}
+}
+
+// connect makes psc the hub's connection, resubscribing to every
+// active stream. It returns false if the hub has been closed.
+func (h *hub) connect(psc *redis.PubSubConn) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.closed {
+		return false
+	}
+
+	h.psc = psc
+	for name, sub := range h.subs {
+		if name == sub.channel.id() {
+			h.send("SUBSCRIBE", sub.channel.id(), sub.channel.killID())
+		}
+	}
+	return true
+}
+
+// disconnect drops the current connection and wakes every listener
+// up, since anything published while reconnecting won't be received.
+// It returns false if the hub has been closed.
+func (h *hub) disconnect() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.psc != nil {
+		h.psc.Close()
+		h.psc = nil
+	}
+
+	for name, sub := range h.subs {
+		if name != sub.channel.id() {
+			continue
+		}
+		select {
+		case <-sub.ready:
+			sub.ready = make(chan struct{})
+		default:
+		}
+		sub.notify()
+	}
+	return !h.closed
+}
+
+func (h *hub) receive(psc *redis.PubSubConn) error {
+	for {
+		switch msg := psc.Receive().(type) {
+		case redis.Message:
+			h.dispatch(msg.Channel)
+		case redis.Subscription:
+			if msg.Kind == "subscribe" {
+				h.confirm(msg.Channel)
+			}
+		case error:
+			return msg
+		}
+	}
+}
+
+func (h *hub) dispatch(name string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if sub, ok := h.subs[name]; ok {
+		sub.notify()
+	}
+}
+
+func (h *hub) confirm(name string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	sub, ok := h.subs[name]
+	if !ok || name != sub.channel.killID() {
+		return
+	}
+
+	select {
+	case <-sub.ready:
+	default:
+		close(sub.ready)
+	}
+}
+
+func (h *hub) isClosed() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.closed
+}
+
+func (h *hub) close() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.closed = true
+	if h.psc == nil {
+		return nil
+	}
+	return h.psc.Close()
+}
+
+// notify invalidates the tail cache before waking every listener up,
+// so that only the first of them has to refresh it.
+func (s *subscription) notify() {
+	if s.tail != nil {
+		s.tail.invalidate()
+	}
+	for l := range s.listeners {
+		l.notify()
+	}
+}
+
+// notify wakes the listener up without blocking. Notifications
+// are coalesced until the listener gets to handle them.
+func (l *listener) notify() {
+	select {
+	case l.C <- struct{}{}:
+	default:
+	}
+}
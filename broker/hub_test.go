@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func testRedisBroker(t *testing.T) *RedisBroker {
+	b, ok := testBroker.(*RedisBroker)
+	if !ok {
+		t.Skip("REDIS_URL is required")
+	}
+	return b
+}
+
+func TestHubSharesSubscriptions(t *testing.T) {
+	b := testRedisBroker(t)
+	uuid := setup()
+	h := b.hub(uuid)
+
+	var readers []io.ReadCloser
+	for i := 0; i < 10; i++ {
+		r, err := b.NewReader(uuid)
+		assert.Nil(t, err)
+		readers = append(readers, r)
+	}
+
+	h.mutex.Lock()
+	sub := h.subs[channel(uuid).id()]
+	assert.Equal(t, 10, len(sub.listeners))
+	h.mutex.Unlock()
+
+	for _, r := range readers {
+		r.Close()
+	}
+
+	h.mutex.Lock()
+	_, ok := h.subs[channel(uuid).id()]
+	assert.False(t, ok)
+	h.mutex.Unlock()
+}
+
+func TestHubFanOut(t *testing.T) {
+	b := testRedisBroker(t)
+	uuid := setup()
+
+	done := make(chan string)
+	for i := 0; i < 5; i++ {
+		r, _ := b.NewReader(uuid)
+		go func() {
+			defer r.Close()
+			buf, _ := ioutil.ReadAll(r)
+			done <- string(buf)
+		}()
+	}
+
+	w, _ := b.NewWriter(uuid)
+	w.Write([]byte("busl"))
+	w.Write([]byte(" hello"))
+	w.Close()
+
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, "busl hello", <-done)
+	}
+}
+
+func TestHubReconnect(t *testing.T) {
+	b := testRedisBroker(t)
+	uuid, _ := util.NewUUID()
+	b.Register(uuid, nil)
+
+	r, _ := b.NewReader(uuid)
+	defer r.Close()
+
+	h := b.hub(uuid)
+	h.mutex.Lock()
+	h.psc.Close()
+	h.mutex.Unlock()
+
+	w, _ := b.NewWriter(uuid)
+	w.Write([]byte("hello"))
+	w.Close()
+
+	buf, _ := ioutil.ReadAll(r)
+	assert.Equal(t, "hello", string(buf))
+}
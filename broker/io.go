@@ -2,26 +2,147 @@ package broker
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 	"github.com/heroku/busl/util"
 )
 
+// writeScript appends to a stream, enforcing its maximum size, and
+// records the write time. The offset of the first write of every second
+// is indexed by KEYS[4]. It returns how many bytes got accepted.
+var writeScript = redis.NewScript(4, `
+local data = ARGV[1]
+local accepted = string.len(data)
+local meta = redis.call('HMGET', KEYS[3], 'max_size', 'overflow', 'truncated', 'trim')
+local max, overflow = tonumber(meta[1]), meta[2]
+local offset = (tonumber(meta[4]) or 0) + redis.call('STRLEN', KEYS[1])
+
+if max then
+	local size = redis.call('STRLEN', KEYS[1])
+	if overflow == 'truncate' then
+		if meta[3] then
+			return accepted
+		end
+		if size + string.len(data) > max then
+			data = string.sub(data, 1, max - size) .. ARGV[3]
+			redis.call('HSET', KEYS[3], 'truncated', 1)
+		end
+	elseif overflow ~= 'rolling' and size + string.len(data) > max then
+		accepted = math.max(max - size, 0)
+		data = string.sub(data, 1, accepted)
+	end
+end
+
+local size = redis.call('APPEND', KEYS[1], data)
+redis.call('HSET', KEYS[3], 'written', ARGV[4])
+local second = math.floor(tonumber(ARGV[4]) / 1000)
+local last = redis.call('ZREVRANGE', KEYS[4], 0, 0, 'WITHSCORES')
+if string.len(data) > 0 and (#last == 0 or tonumber(last[2]) < second) then
+	redis.call('ZADD', KEYS[4], second, offset)
+end
+if max and overflow == 'rolling' and size > max then
+	local drop = size - (max - math.floor(max / 8))
+	redis.call('SET', KEYS[1], redis.call('GETRANGE', KEYS[1], drop, -1))
+	redis.call('HINCRBY', KEYS[3], 'trim', drop)
+end
+
+redis.call('EXPIRE', KEYS[1], ARGV[2])
+redis.call('EXPIRE', KEYS[3], ARGV[2])
+redis.call('EXPIRE', KEYS[4], ARGV[2])
+redis.call('DEL', KEYS[2])
+redis.call('PUBLISH', KEYS[1], 1)
+return accepted
+`)
+
+// readScript reads count bytes from a stream at the given offset, or
+// up to its end when count is zero, or at most its last -count bytes
+// when count is negative. Negative offsets count from the end. It
+// returns the data, its offset, the stream length and whether the
+// stream is done, or gone. Offsets account for the content rolling
+// streams dropped, and reading from dropped content skips to what's
+// left.
+var readScript = redis.NewScript(4, `
+local trim = tonumber(redis.call('HGET', KEYS[3], 'trim')) or 0
+local size = redis.call('STRLEN', KEYS[1])
+local start, count = tonumber(ARGV[1]), tonumber(ARGV[2])
+if start < 0 then
+	start = math.max(size + start, 0)
+else
+	start = math.max(start - trim, 0)
+end
+
+local stop = -1
+if count > 0 then
+	stop = start + count - 1
+elseif count < 0 then
+	start = math.max(start, size + count)
+end
+
+local data = ''
+if start < size then
+	data = redis.call('GETRANGE', KEYS[1], start, stop)
+end
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+redis.call('EXPIRE', KEYS[3], ARGV[3])
+redis.call('EXPIRE', KEYS[4], ARGV[3])
+
+-- Streams that expired or got deleted are done too.
+local done = redis.call('EXISTS', KEYS[2])
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	done = 1
+end
+return {data, trim + start, trim + size, done}
+`)
+
+// subscribeScript adds to the subscriber count of a stream,
+// unless its metadata expired or got reset by a new registration.
+var subscribeScript = redis.NewScript(1, `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+local n = redis.call('HINCRBY', KEYS[1], 'subscribers', ARGV[1])
+if n < 0 then
+	redis.call('HSET', KEYS[1], 'subscribers', 0)
+	return 0
+end
+return n
+`)
+
+// readRange runs readScript
+func readRange(conn redis.Conn, c channel, offset int64, count int, expire int) (data []byte, start, size int64, done bool, err error) {
+	list, err := redis.Values(readScript.Do(conn, c.id(), c.doneID(), c.metaID(), c.timesID(), offset, count, expire))
+	if err != nil {
+		return nil, 0, 0, false, err
+	}
+	if len(list) != 4 {
+		return nil, 0, 0, false, fmt.Errorf("Unexpected read reply: %v", list)
+	}
+
+	if data, err = redis.Bytes(list[0], nil); err != nil {
+		return
+	}
+	if start, err = redis.Int64(list[1], nil); err != nil {
+		return
+	}
+	if size, err = redis.Int64(list[2], nil); err != nil {
+		return
+	}
+	done, err = redis.Bool(list[3], nil)
+	return
+}
+
 type writer struct {
 	channel channel
+	broker  *RedisBroker
 }
 
-// known errors
-var (
-	ErrNotRegistered = errors.New("Channel is not registered.")
-	ErrClosed        = errors.New("Channel is closed.")
-)
-
 // NewWriter creates a new redis channel writer
-func NewWriter(key string) (io.WriteCloser, error) {
-	r, err := NewRedisRegistrar().IsRegistered(key)
+func (b *RedisBroker) NewWriter(key string) (io.WriteCloser, error) {
+	r, err := b.IsRegistered(key)
 	if err != nil {
 		return nil, err
 	}
@@ -30,48 +151,55 @@ func NewWriter(key string) (io.WriteCloser, error) {
 		return nil, ErrNotRegistered
 	}
 
-	return &writer{channel(key)}, nil
+	return &writer{channel: b.channel(key), broker: b}, nil
 }
 
 func (w *writer) Close() error {
-	conn := redisPool.Get()
+	conn := w.broker.pool.Get()
 	defer conn.Close()
 
 	conn.Send("MULTI")
-	conn.Send("EXPIRE", w.channel.id(), redisKeyExpire)
-	conn.Send("SETEX", w.channel.doneID(), redisChannelExpire, []byte{1})
+	conn.Send("EXPIRE", w.channel.id(), w.broker.keyExpire)
+	conn.Send("EXPIRE", w.channel.metaID(), w.broker.keyExpire)
+	conn.Send("EXPIRE", w.channel.timesID(), w.broker.keyExpire)
+	conn.Send("SETEX", w.channel.doneID(), w.broker.channelExpire, []byte{1})
 	conn.Send("PUBLISH", w.channel.killID(), 1)
 	_, err := conn.Do("EXEC")
 	return err
 }
 
 func (w *writer) Write(p []byte) (int, error) {
-	conn := redisPool.Get()
+	conn := w.broker.pool.Get()
 	defer conn.Close()
 
-	conn.Send("MULTI")
-	conn.Send("APPEND", w.channel.id(), p)
-	conn.Send("EXPIRE", w.channel.id(), redisChannelExpire)
-	conn.Send("DEL", w.channel.doneID())
-	conn.Send("PUBLISH", w.channel.id(), 1)
-
-	_, err := conn.Do("EXEC")
-	return len(p), err
+	n, err := redis.Int(writeScript.Do(conn, w.channel.id(), w.channel.doneID(), w.channel.metaID(), w.channel.timesID(),
+		p, w.broker.channelExpire, TruncatedMarker, unixMilli(time.Now())))
+	if err != nil {
+		return 0, err
+	}
+	if n < len(p) {
+		return n, ErrTooLarge
+	}
+	return n, nil
 }
 
 type reader struct {
-	channel  channel
-	psc      redis.PubSubConn
-	offset   int64
-	replayed bool
-	closed   bool
-	mutex    *sync.Mutex
-	buffered bool
+	key       string
+	channel   channel
+	broker    *RedisBroker
+	listener  *listener
+	offset    int64
+	stale     bool // whether there might be content we haven't fetched yet
+	buffered  bool
+	marks     []writeMark
+	timed     int64 // offset up to which the marks got loaded
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 // NewReader creates a new redis channel reader
-func NewReader(key string) (io.ReadCloser, error) {
-	r, err := NewRedisRegistrar().IsRegistered(key)
+func (b *RedisBroker) NewReader(key string) (io.ReadCloser, error) {
+	r, err := b.IsRegistered(key)
 	if err != nil {
 		return nil, err
 	}
@@ -80,14 +208,16 @@ func NewReader(key string) (io.ReadCloser, error) {
 		return nil, ErrNotRegistered
 	}
 
-	psc := redis.PubSubConn{Conn: redisPool.Get()}
-	channel := channel(key)
-	psc.PSubscribe(channel.wildcardID())
-
+	channel := b.channel(key)
 	rd := &reader{
-		channel: channel,
-		psc:     psc,
-		mutex:   &sync.Mutex{}}
+		key:      key,
+		channel:  channel,
+		broker:   b,
+		listener: b.hub(key).subscribe(channel),
+		stale:    true,
+		closed:   make(chan struct{}),
+	}
+	b.subscribed(channel, 1)
 
 	return rd, nil
 }
@@ -111,199 +241,116 @@ func (r *reader) Seek(offset int64, whence int) (int64, error) {
 	return r.offset, nil
 }
 
-func (r *reader) Read(p []byte) (n int, err error) {
-	if r.closed { // Don't read from a closed redigo connection
-		return 0, io.EOF
-	}
-
-	if n, err := r.replay(p); n > 0 || err != nil {
-		return n, err
-	}
-
-	switch msg := r.psc.Receive().(type) {
-	case redis.Message:
-	case redis.PMessage:
-		return r.read(msg, p)
-	case redis.Subscription:
-	case error:
-		util.CountWithData("RedisBroker.redisSubscribe.ReceiveError", 1, "err=%s", msg)
-		err = msg
-		return
-	}
-	return
-}
+func (r *reader) Read(p []byte) (int, error) {
+	for {
+		select {
+		case <-r.closed:
+			return 0, io.EOF
+		default:
+		}
 
-func (r *reader) replay(p []byte) (n int, err error) {
-	var buf []byte
+		if r.stale {
+			n, err := r.readTail(p)
+			r.offset += int64(n)
+			r.stale = r.buffered
 
-	if !r.replayed {
-		buf, err = r.fetch(len(p))
-		n = len(buf)
+			if err == io.EOF {
+				util.Count("RedisBroker.reader.channelDone")
+				r.Close()
+			}
 
-		if n > 0 {
-			r.offset += int64(n)
-			copy(p, buf)
+			if n > 0 || err != nil {
+				return n, err
+			}
 		}
 
-		// Only mark as fully replayed if
-		// we're no longer in buffered state.
-		r.replayed = (!r.buffered || err == io.EOF)
-
-		if err == io.EOF {
-			util.Count("RedisBroker.replay.channelDone")
+		// Wait for the publisher to notify us of new content.
+		select {
+		case <-r.listener.C:
+			r.stale = true
+		case <-r.closed:
+			return 0, io.EOF
 		}
 	}
-
-	return n, err
 }
 
-func (r *reader) read(msg redis.PMessage, p []byte) (n int, err error) {
-	var buf []byte
-
-	if msg.Channel == r.channel.killID() || msg.Channel == r.channel.id() {
-		buf, err = r.fetch(len(p))
-
-		if n = len(buf); n > 0 {
-			copy(p, buf)
-			r.offset += int64(n)
+// readTail reads from the shared tail cache, falling back to
+// fetching from redis when lagging behind what it holds.
+func (r *reader) readTail(p []byte) (int, error) {
+	if tail, ok := r.listener.sub.tail.(*tailCache); ok {
+		n, more, ok, err := tail.readAt(p, r.offset)
+		if ok || err != nil {
+			r.buffered = more
+			return n, err
 		}
 	}
 
-	if msg.Channel == r.channel.killID() || err == io.EOF {
-		util.Count("RedisBroker.redisSubscribe.Channel.kill")
-		r.Close()
-		err = io.EOF
-	}
-
-	return n, err
+	buf, err := r.fetch(len(p))
+	return copy(p, buf), err
 }
 
 func (r *reader) fetch(length int) ([]byte, error) {
-	conn := redisPool.Get()
+	conn := r.broker.pool.Get()
 	defer conn.Close()
 
-	start, end := r.offset, r.offset+int64(length)
-
-	err := conn.Send("MULTI")
-	if err != nil {
-		return nil, err
-	}
-	err = conn.Send("GETRANGE", r.channel.id(), start, end-1)
-	if err != nil {
-		return nil, err
-	}
-	err = conn.Send("STRLEN", r.channel.id())
-	if err != nil {
-		return nil, err
-	}
-	err = conn.Send("EXISTS", r.channel.doneID())
-	if err != nil {
-		return nil, err
-	}
-	err = conn.Send("EXPIRE", r.channel.id(), redisChannelExpire)
+	data, start, size, done, err := readRange(conn, r.channel, r.offset, length, r.broker.channelExpire)
 	if err != nil {
 		return nil, err
 	}
 
-	list, err := redis.Values(conn.Do("EXEC"))
-	if err != nil {
-		return nil, err
-	}
-	data, err := redis.Bytes(list[0], err)
-	if err != nil {
-		return nil, err
-	}
-	size, err := redis.Int64(list[1], err)
-	if err != nil {
-		return nil, err
-	}
-	done, err := redis.Bool(list[2], err)
-	if err != nil {
-		return nil, err
-	}
-
-	if r.buffered = end < size; !r.buffered && done {
+	// Skip whatever a rolling stream dropped.
+	r.offset = start
+	if r.buffered = start+int64(len(data)) < size; !r.buffered && done {
 		err = io.EOF
 	}
 
 	return data, err
 }
 
-func (r *reader) Close() error {
-	if r.closed {
-		return nil
+// WriteTime returns when the content at offset got written, to the
+// second, as recorded by writeScript.
+func (r *reader) WriteTime(offset int64) time.Time {
+	if offset >= r.timed {
+		r.loadMarks()
 	}
-
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
-
-	r.closed = true
-	r.psc.Unsubscribe()
-	return r.psc.Close()
+	r.marks = pruneMarks(r.marks, offset)
+	return writeTime(r.marks, offset)
 }
 
-func readerDone(rd io.Reader) bool {
-	r, ok := rd.(*reader)
-	if !ok {
-		return false
-	}
-
-	if r.closed {
-		return true
-	}
-
-	conn := redisPool.Get()
+// loadMarks fetches the write times recorded since the last ones loaded
+func (r *reader) loadMarks() {
+	conn := r.broker.pool.Get()
 	defer conn.Close()
 
-	done, _ := redis.Bool(conn.Do("EXISTS", r.channel.doneID()))
-	return done
-}
-
-// NoContent returns whether the channel already has content pushed or not
-func NoContent(rd io.Reader, offset int64) bool {
-	if !readerDone(rd) {
-		return false
+	min := "-inf"
+	if len(r.marks) > 0 {
+		min = fmt.Sprintf("(%d", r.marks[len(r.marks)-1].at.Unix())
 	}
-
-	conn := redisPool.Get()
-	defer conn.Close()
-
-	strlen, err := redis.Int64(conn.Do("STRLEN", rd.(*reader).channel.id()))
+	values, err := redis.Values(conn.Do("ZRANGEBYSCORE", r.channel.timesID(), min, "+inf", "WITHSCORES"))
 	if err != nil {
-		return false
-	}
-
-	return offset > (strlen - 1)
-}
-
-// RenewExpiry renews the channel expiration
-func RenewExpiry(rd io.Reader) {
-	r, ok := rd.(*reader)
-	if !ok {
+		util.CountWithData("RedisBroker.reader.marks.error", 1, "error=%s", err)
 		return
 	}
 
-	conn := redisPool.Get()
-	defer conn.Close()
-
-	conn.Send("MULTI")
-	conn.Send("EXPIRE", r.channel.id(), redisChannelExpire)
-	conn.Do("EXEC")
-}
-
-// Len returns the length of data already send to the reader
-func Len(wd io.WriteCloser) (int64, error) {
-	w, ok := wd.(*writer)
-	if !ok {
-		return 0, errors.New("Cannot cast argument to `writer`")
-	}
-	conn := redisPool.Get()
-	defer conn.Close()
-
-	strlen, err := redis.Int64(conn.Do("STRLEN", w.channel.id()))
-	if err != nil {
-		return 0, err
+	for i := 0; i+1 < len(values); i += 2 {
+		offset, err := redis.Int64(values[i], nil)
+		if err != nil {
+			continue
+		}
+		second, err := redis.Int64(values[i+1], nil)
+		if err != nil {
+			continue
+		}
+		r.marks = append(r.marks, writeMark{offset, time.Unix(second, 0)})
 	}
+	r.timed = r.offset
+}
 
-	return strlen, nil
+func (r *reader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		r.broker.hub(r.key).unsubscribe(r.listener)
+		r.broker.subscribed(r.channel, -1)
+	})
+	return nil
 }
@@ -6,27 +6,24 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
-	"strings"
 	"testing"
+	"time"
 
 	"github.com/heroku/busl/util"
 	"github.com/stretchr/testify/assert"
 )
 
 func setup() string {
-	registrar := NewRedisRegistrar()
 	uuid, _ := util.NewUUID()
-	registrar.Register(uuid)
+	testBroker.Register(uuid, nil)
 
 	return uuid
 }
 
 func newReaderWriter() (io.ReadCloser, io.WriteCloser) {
-	registrar := NewRedisRegistrar()
-	uuid, _ := util.NewUUID()
-	registrar.Register(uuid)
-	r, _ := NewReader(uuid)
-	w, _ := NewWriter(uuid)
+	uuid := setup()
+	r, _ := testBroker.NewReader(uuid)
+	w, _ := testBroker.NewWriter(uuid)
 
 	return r, w
 }
@@ -34,7 +31,7 @@ func newReaderWriter() (io.ReadCloser, io.WriteCloser) {
 func Example_pub_sub() {
 	uuid := setup()
 
-	r, _ := NewReader(uuid)
+	r, _ := testBroker.NewReader(uuid)
 	defer r.(io.Closer).Close()
 
 	pub := make(chan bool)
@@ -49,7 +46,7 @@ func Example_pub_sub() {
 	go func() {
 		pub <- true
 
-		w, _ := NewWriter(uuid)
+		w, _ := testBroker.NewWriter(uuid)
 		w.Write([]byte("busl"))
 		w.Write([]byte(" hello"))
 		w.Write([]byte(" world"))
@@ -65,12 +62,12 @@ func Example_pub_sub() {
 func Example_full_replay() {
 	uuid := setup()
 
-	w, _ := NewWriter(uuid)
+	w, _ := testBroker.NewWriter(uuid)
 	w.Write([]byte("busl"))
 	w.Write([]byte(" hello"))
 	w.Write([]byte(" world"))
 
-	r, _ := NewReader(uuid)
+	r, _ := testBroker.NewReader(uuid)
 	defer r.(io.Closer).Close()
 
 	buf := make([]byte, 16)
@@ -85,13 +82,13 @@ func Example_full_replay() {
 func TestSeekCorrect(t *testing.T) {
 	uuid := setup()
 
-	w, _ := NewWriter(uuid)
+	w, _ := testBroker.NewWriter(uuid)
 	w.Write([]byte("busl"))
 	w.Write([]byte(" hello"))
 	w.Write([]byte(" world"))
 	w.Close()
 
-	r, _ := NewReader(uuid)
+	r, _ := testBroker.NewReader(uuid)
 	r.(io.Seeker).Seek(10, 0)
 	defer r.(io.Closer).Close()
 
@@ -102,13 +99,13 @@ func TestSeekCorrect(t *testing.T) {
 func TestSeekBeyond(t *testing.T) {
 	uuid := setup()
 
-	w, _ := NewWriter(uuid)
+	w, _ := testBroker.NewWriter(uuid)
 	w.Write([]byte("busl"))
 	w.Write([]byte(" hello"))
 	w.Write([]byte(" world"))
 	w.Close()
 
-	r, _ := NewReader(uuid)
+	r, _ := testBroker.NewReader(uuid)
 	r.(io.Seeker).Seek(16, 0)
 	defer r.Close()
 
@@ -119,10 +116,10 @@ func TestSeekBeyond(t *testing.T) {
 func Example_half_replay_half_subscribed() {
 	uuid := setup()
 
-	w, _ := NewWriter(uuid)
+	w, _ := testBroker.NewWriter(uuid)
 	w.Write([]byte("busl"))
 
-	r, _ := NewReader(uuid)
+	r, _ := testBroker.NewReader(uuid)
 
 	pub := make(chan bool)
 	done := make(chan bool)
@@ -150,7 +147,7 @@ func Example_half_replay_half_subscribed() {
 func TestOverflowingBuffer(t *testing.T) {
 	uuid := setup()
 
-	w, _ := NewWriter(uuid)
+	w, _ := testBroker.NewWriter(uuid)
 	w.Write(bytes.Repeat([]byte("0"), 4096))
 	w.Write(bytes.Repeat([]byte("1"), 4096))
 	w.Write(bytes.Repeat([]byte("2"), 4096))
@@ -161,7 +158,7 @@ func TestOverflowingBuffer(t *testing.T) {
 	w.Write(bytes.Repeat([]byte("7"), 4096))
 	w.Write(bytes.Repeat([]byte("A"), 1))
 
-	r, _ := NewReader(uuid)
+	r, _ := testBroker.NewReader(uuid)
 	defer r.(io.Closer).Close()
 
 	done := make(chan int64)
@@ -196,44 +193,345 @@ func Example_subscribe_concurrent() {
 	// busl
 }
 
-func TestRedisReadFromClosed(t *testing.T) {
-	r, w := newReaderWriter()
-	p := make([]byte, 10)
-
-	r.Read(p)
+func TestReadFromClosed(t *testing.T) {
+	uuid := setup()
+	r, _ := testBroker.NewReader(uuid)
+	w, _ := testBroker.NewWriter(uuid)
 	w.Write([]byte("hello"))
 	w.Close()
+	ioutil.ReadAll(r)
 
 	// this read should short circuit with EOF
-	_, err := r.Read(p)
+	_, err := r.Read(make([]byte, 10))
 	assert.Equal(t, err, io.EOF)
 
-	// We'll get true here because r.closed is already set
-	assert.True(t, readerDone(r))
-
-	// We should still get true here because doneID is set
-	r, _ = NewReader(string(r.(*reader).channel))
-	assert.True(t, readerDone(r))
-
-	// Reader done on a regular io.Reader should return false
-	// and not panic
-	assert.False(t, readerDone(strings.NewReader("hello")))
+	// We should get true here because the channel is done
+	done, err := testBroker.IsDone(uuid)
+	assert.Nil(t, err)
+	assert.True(t, done)
 
 	// NoContent should respond accordingly based on offset
-	assert.False(t, NoContent(r, 0))
-	assert.True(t, NoContent(r, 5))
+	assert.False(t, NoContent(testBroker, uuid, 0))
+	assert.True(t, NoContent(testBroker, uuid, 5))
 }
 
 func TestLen(t *testing.T) {
-	_, w := newReaderWriter()
+	uuid := setup()
+	w, _ := testBroker.NewWriter(uuid)
 
-	l, err := Len(w)
+	l, err := testBroker.Len(uuid)
 	assert.Nil(t, err)
 	assert.Equal(t, int64(0), l)
 
 	w.Write([]byte("hello"))
 
-	l, err = Len(w)
+	l, err = testBroker.Len(uuid)
 	assert.Nil(t, err)
 	assert.Equal(t, int64(5), l)
 }
+
+func registerLimited(t *testing.T, b Broker, overflow Overflow) string {
+	uuid, _ := util.NewUUID()
+	assert.Nil(t, b.Register(uuid, &StreamOptions{MaxSize: 8, Overflow: overflow}))
+	return uuid
+}
+
+func testOverflowReject(t *testing.T, b Broker) {
+	uuid := registerLimited(t, b, OverflowReject)
+	w, _ := b.NewWriter(uuid)
+
+	n, err := w.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+
+	n, err = w.Write([]byte(" world"))
+	assert.Equal(t, ErrTooLarge, err)
+	assert.Equal(t, 3, n)
+
+	_, err = w.Write([]byte("!"))
+	assert.Equal(t, ErrTooLarge, err)
+
+	buf, _ := b.Get(uuid)
+	assert.Equal(t, "hello wo", string(buf))
+}
+
+func testOverflowTruncate(t *testing.T, b Broker) {
+	uuid := registerLimited(t, b, OverflowTruncate)
+	w, _ := b.NewWriter(uuid)
+
+	for _, p := range []string{"hello", " world", "!"} {
+		n, err := w.Write([]byte(p))
+		assert.Nil(t, err)
+		assert.Equal(t, len(p), n)
+	}
+
+	buf, _ := b.Get(uuid)
+	assert.Equal(t, "hello wo"+TruncatedMarker, string(buf))
+}
+
+func testOverflowRolling(t *testing.T, b Broker) {
+	uuid := registerLimited(t, b, OverflowRolling)
+	w, _ := b.NewWriter(uuid)
+
+	r, _ := b.NewReader(uuid)
+	defer r.Close()
+	p := make([]byte, 5)
+	w.Write([]byte("hello"))
+	n, _ := r.Read(p)
+	assert.Equal(t, "hello", string(p[:n]))
+
+	for _, p := range []string{" world", " of", " busl"} {
+		_, err := w.Write([]byte(p))
+		assert.Nil(t, err)
+	}
+	w.Close()
+
+	l, _ := b.Len(uuid)
+	assert.Equal(t, int64(19), l)
+
+	buf, _ := b.Get(uuid)
+	assert.True(t, len(buf) <= 8)
+	assert.Equal(t, "hello world of busl"[19-len(buf):], string(buf))
+
+	// The reader lagging behind skips what got dropped.
+	rest, _ := ioutil.ReadAll(r)
+	assert.Equal(t, string(buf), string(rest))
+}
+
+func TestOverflowReject(t *testing.T) {
+	testOverflowReject(t, testBroker)
+}
+
+func TestOverflowTruncate(t *testing.T) {
+	testOverflowTruncate(t, testBroker)
+}
+
+func TestOverflowRolling(t *testing.T) {
+	testOverflowRolling(t, testBroker)
+}
+
+func testMeta(t *testing.T, b Broker) {
+	_, err := b.Meta("missing")
+	assert.Equal(t, ErrNotRegistered, err)
+
+	uuid, _ := util.NewUUID()
+	before := time.Now().Add(-time.Second)
+	assert.Nil(t, b.Register(uuid, &StreamOptions{ContentType: "text/plain", RequestID: "abc"}))
+
+	meta, err := b.Meta(uuid)
+	assert.Nil(t, err)
+	assert.Equal(t, "text/plain", meta.ContentType)
+	assert.Equal(t, "abc", meta.RequestID)
+	assert.True(t, meta.Created.After(before))
+	assert.True(t, meta.LastWrite.IsZero())
+	assert.True(t, meta.TTL > 0)
+	assert.Equal(t, int64(0), meta.Subscribers)
+
+	r, _ := b.NewReader(uuid)
+	w, _ := b.NewWriter(uuid)
+	w.Write([]byte("hello"))
+
+	meta, _ = b.Meta(uuid)
+	assert.Equal(t, int64(5), meta.Length)
+	assert.False(t, meta.Done)
+	assert.False(t, meta.LastWrite.Before(meta.Created))
+	assert.Equal(t, int64(1), meta.Subscribers)
+	assert.Equal(t, int64(1), meta.LocalSubscribers)
+
+	w.Close()
+	r.Close()
+	meta, _ = b.Meta(uuid)
+	assert.True(t, meta.Done)
+	assert.Equal(t, int64(0), meta.Subscribers)
+}
+
+func TestMeta(t *testing.T) {
+	testMeta(t, testBroker)
+}
+
+func testRegisterExisting(t *testing.T, b Broker) {
+	uuid, _ := util.NewUUID()
+	assert.Nil(t, b.Register(uuid, nil))
+	w, _ := b.NewWriter(uuid)
+	w.Write([]byte("hello"))
+
+	meta, _ := b.Meta(uuid)
+	nonce := meta.Nonce
+	assert.NotEmpty(t, nonce)
+
+	assert.Equal(t, ErrAlreadyRegistered, b.Register(uuid, nil))
+	buf, _ := b.Get(uuid)
+	assert.Equal(t, "hello", string(buf))
+	meta, _ = b.Meta(uuid)
+	assert.Equal(t, nonce, meta.Nonce)
+
+	assert.Nil(t, b.Reset(uuid, nil))
+	buf, _ = b.Get(uuid)
+	assert.Equal(t, "", string(buf))
+	meta, _ = b.Meta(uuid)
+	assert.NotEmpty(t, meta.Nonce)
+	assert.NotEqual(t, nonce, meta.Nonce)
+
+	fresh, _ := util.NewUUID()
+	assert.Nil(t, b.Reset(fresh, nil))
+	registered, _ := b.IsRegistered(fresh)
+	assert.True(t, registered)
+
+	// Resetting a closed stream reopens it.
+	w.Close()
+	done, _ := b.IsDone(uuid)
+	assert.True(t, done)
+	assert.Nil(t, b.Reset(uuid, nil))
+	done, _ = b.IsDone(uuid)
+	assert.False(t, done)
+	meta, _ = b.Meta(uuid)
+	assert.False(t, meta.Done)
+}
+
+func TestRegisterExisting(t *testing.T) {
+	testRegisterExisting(t, testBroker)
+}
+
+func testListDelete(t *testing.T, b Broker) {
+	var created []string
+	for i := 0; i < 3; i++ {
+		uuid, _ := util.NewUUID()
+		assert.Nil(t, b.Register(uuid, nil))
+		created = append(created, uuid)
+	}
+
+	listed := make(map[string]bool)
+	cursor := ""
+	for {
+		keys, next, err := b.List(cursor, 2)
+		assert.Nil(t, err)
+		for _, key := range keys {
+			listed[key] = true
+		}
+		if cursor = next; cursor == "" {
+			break
+		}
+	}
+	for _, key := range created {
+		assert.True(t, listed[key])
+	}
+
+	assert.Nil(t, b.Delete(created[0]))
+	registered, _ := b.IsRegistered(created[0])
+	assert.False(t, registered)
+	_, err := b.Meta(created[0])
+	assert.Equal(t, ErrNotRegistered, err)
+}
+
+func TestListDelete(t *testing.T) {
+	testListDelete(t, testBroker)
+}
+
+func testTailOffset(t *testing.T, b Broker) {
+	_, err := b.TailOffset("missing", 1)
+	assert.Equal(t, ErrNotRegistered, err)
+
+	uuid, _ := util.NewUUID()
+	b.Register(uuid, nil)
+	w, _ := b.NewWriter(uuid)
+	w.Write([]byte("one\ntwo\n"))
+	w.Write([]byte("three\nfour\n"))
+
+	for lines, offset := range map[int]int64{0: 19, 1: 14, 2: 8, 3: 4, 4: 0, 10: 0} {
+		tail, err := b.TailOffset(uuid, lines)
+		assert.Nil(t, err)
+		assert.Equal(t, offset, tail, "%d lines", lines)
+	}
+
+	w.Write([]byte("five"))
+	tail, _ := b.TailOffset(uuid, 2)
+	assert.Equal(t, int64(14), tail)
+
+	// Long streams are read backwards in several chunks.
+	long, _ := util.NewUUID()
+	b.Register(long, nil)
+	w, _ = b.NewWriter(long)
+	line := append(bytes.Repeat([]byte("x"), 199), '\n')
+	for i := 0; i < 300; i++ {
+		w.Write(line)
+	}
+	tail, _ = b.TailOffset(long, 299)
+	assert.Equal(t, int64(200), tail)
+	tail, _ = b.TailOffset(long, 300)
+	assert.Equal(t, int64(0), tail)
+}
+
+func TestTailOffset(t *testing.T) {
+	testTailOffset(t, testBroker)
+}
+
+func testTimeOffset(t *testing.T, b Broker) {
+	_, err := b.TimeOffset("missing", time.Now())
+	assert.Equal(t, ErrNotRegistered, err)
+
+	uuid, _ := util.NewUUID()
+	b.Register(uuid, nil)
+	before := time.Now().Add(-time.Second)
+	w, _ := b.NewWriter(uuid)
+	w.Write([]byte("hello"))
+
+	// RedisBroker records write times to the second.
+	time.Sleep(1100 * time.Millisecond)
+	since := time.Now()
+	w.Write([]byte(" world"))
+
+	for _, test := range []struct {
+		t      time.Time
+		offset int64
+	}{
+		{before, 0},
+		{since, 5},
+		{time.Now().Add(time.Minute), 11},
+	} {
+		offset, err := b.TimeOffset(uuid, test.t)
+		assert.Nil(t, err)
+		assert.Equal(t, test.offset, offset)
+	}
+}
+
+func TestTimeOffset(t *testing.T) {
+	testTimeOffset(t, testBroker)
+}
+
+func testWriteTime(t *testing.T, b Broker) {
+	uuid, _ := util.NewUUID()
+	b.Register(uuid, nil)
+	before := time.Now().Add(-time.Second)
+	w, _ := b.NewWriter(uuid)
+	w.Write([]byte("hello"))
+	w.Close()
+
+	r, _ := b.NewReader(uuid)
+	defer r.Close()
+	ioutil.ReadAll(r)
+
+	timer := r.(interface {
+		WriteTime(offset int64) time.Time
+	})
+	assert.True(t, timer.WriteTime(4).After(before))
+	assert.False(t, timer.WriteTime(4).After(time.Now()))
+}
+
+func TestWriteTime(t *testing.T) {
+	testWriteTime(t, testBroker)
+}
+
+func TestDeleteEndsReaders(t *testing.T) {
+	uuid := setup()
+	r, _ := testBroker.NewReader(uuid)
+	defer r.Close()
+
+	done := make(chan error)
+	go func() {
+		_, err := ioutil.ReadAll(r)
+		done <- err
+	}()
+
+	assert.Nil(t, testBroker.Delete(uuid))
+	assert.Nil(t, <-done)
+}
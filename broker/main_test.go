@@ -0,0 +1,32 @@
+package broker
+
+import (
+	"os"
+	"testing"
+)
+
+// testBroker runs the suite against redis when REDIS_URL
+// is set, and against the in-memory broker otherwise.
+var testBroker Broker
+
+// streamBroker runs the streams layout suite, against
+// the same redis. It's nil when REDIS_URL isn't set.
+var streamBroker *RedisStreamBroker
+
+func TestMain(m *testing.M) {
+	if url := os.Getenv("REDIS_URL"); url != "" {
+		b, err := NewRedisBroker(RedisOptions{URL: url})
+		if err != nil {
+			panic(err)
+		}
+		testBroker = b
+
+		if streamBroker, err = NewRedisStreamBroker(RedisOptions{URL: url}); err != nil {
+			panic(err)
+		}
+	} else {
+		testBroker = NewMemoryBroker()
+	}
+
+	os.Exit(m.Run())
+}
@@ -0,0 +1,445 @@
+package broker
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	memoryKeyExpire     = time.Minute
+	memoryChannelExpire = memoryKeyExpire * 60
+)
+
+type memoryStream struct {
+	data      []byte
+	trim      int64 // offset of data[0], once rolling dropped the oldest content
+	truncated bool
+	done      bool
+	opts      StreamOptions
+	nonce     string
+
+	created     time.Time
+	written     time.Time
+	marks       []writeMark // in write order
+	subscribers int64
+
+	expires time.Time
+	notify  chan struct{} // closed and replaced on every change
+}
+
+// write appends p, applying the overflow policy. It returns how
+// many bytes of p got accepted.
+func (s *memoryStream) write(p []byte) (int, error) {
+	if !s.opts.limited() {
+		s.data = append(s.data, p...)
+		return len(p), nil
+	}
+
+	max := s.opts.MaxSize
+	room := max - int64(len(s.data))
+	switch s.opts.Overflow {
+	case OverflowRolling:
+		s.data = append(s.data, p...)
+		if size := int64(len(s.data)); size > max {
+			drop := size - rollingKeep(max)
+			s.data = append([]byte(nil), s.data[drop:]...)
+			s.trim += drop
+		}
+	case OverflowTruncate:
+		if s.truncated {
+			break
+		}
+		if int64(len(p)) > room {
+			s.data = append(append(s.data, p[:room]...), TruncatedMarker...)
+			s.truncated = true
+		} else {
+			s.data = append(s.data, p...)
+		}
+	default:
+		if int64(len(p)) > room {
+			s.data = append(s.data, p[:room]...)
+			return int(room), ErrTooLarge
+		}
+		s.data = append(s.data, p...)
+	}
+	return len(p), nil
+}
+
+// mark records a write of the content past offset. Marks of content
+// rolling dropped are pruned, keeping the last one to date what's left.
+func (s *memoryStream) mark(offset int64, at time.Time) {
+	s.marks = append(s.marks, writeMark{offset, at})
+
+	i := 0
+	for i+1 < len(s.marks) && s.marks[i+1].offset <= s.trim {
+		i++
+	}
+	if i > 0 {
+		s.marks = append([]writeMark(nil), s.marks[i:]...)
+	}
+	if s.marks[0].offset < s.trim {
+		s.marks[0].offset = s.trim
+	}
+}
+
+func (s *memoryStream) broadcast() {
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// MemoryBroker is a broker storing streams in the process memory.
+// It's meant for single node setups and tests.
+type MemoryBroker struct {
+	mutex   sync.Mutex
+	streams map[string]*memoryStream
+}
+
+// NewMemoryBroker creates a new in-memory broker instance
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{streams: make(map[string]*memoryStream)}
+}
+
+// lookup returns the stream registered with the given key,
+// pruning it if it already expired. The caller must hold the mutex.
+func (b *MemoryBroker) lookup(key string) *memoryStream {
+	s, ok := b.streams[key]
+	if !ok {
+		return nil
+	}
+
+	if time.Now().After(s.expires) {
+		delete(b.streams, key)
+		s.broadcast()
+		return nil
+	}
+	return s
+}
+
+// Register registers the new channel
+func (b *MemoryBroker) Register(key string, opts *StreamOptions) error {
+	return b.register(key, opts, false)
+}
+
+// Reset registers the channel, wiping it if it exists
+func (b *MemoryBroker) Reset(key string, opts *StreamOptions) error {
+	return b.register(key, opts, true)
+}
+
+func (b *MemoryBroker) register(key string, opts *StreamOptions, reset bool) error {
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if s := b.lookup(key); s != nil {
+		if !reset {
+			return ErrAlreadyRegistered
+		}
+		s.broadcast()
+	}
+
+	s := &memoryStream{
+		created: time.Now(),
+		expires: time.Now().Add(memoryChannelExpire),
+		notify:  make(chan struct{}),
+		nonce:   nonce,
+	}
+	if opts != nil {
+		s.opts = *opts
+	}
+	b.streams[key] = s
+	return nil
+}
+
+// IsRegistered checks whether a channel name is registered
+func (b *MemoryBroker) IsRegistered(key string) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.lookup(key) != nil, nil
+}
+
+// NewWriter creates a new in-memory channel writer
+func (b *MemoryBroker) NewWriter(key string) (io.WriteCloser, error) {
+	if r, _ := b.IsRegistered(key); !r {
+		return nil, ErrNotRegistered
+	}
+	return &memoryWriter{broker: b, key: key}, nil
+}
+
+// NewReader creates a new in-memory channel reader
+func (b *MemoryBroker) NewReader(key string) (io.ReadCloser, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	s := b.lookup(key)
+	if s == nil {
+		return nil, ErrNotRegistered
+	}
+	s.subscribers++
+	return &memoryReader{broker: b, key: key, stream: s, closed: make(chan struct{})}, nil
+}
+
+// Get returns the full content of a channel
+func (b *MemoryBroker) Get(key string) ([]byte, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	s := b.lookup(key)
+	if s == nil {
+		return nil, ErrNotRegistered
+	}
+	return append([]byte(nil), s.data...), nil
+}
+
+// Len returns the length of the data published to the channel
+func (b *MemoryBroker) Len(key string) (int64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	s := b.lookup(key)
+	if s == nil {
+		return 0, nil
+	}
+	return s.trim + int64(len(s.data)), nil
+}
+
+// IsDone returns whether the channel has been closed
+func (b *MemoryBroker) IsDone(key string) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	s := b.lookup(key)
+	return s != nil && s.done, nil
+}
+
+// RenewExpiry renews the channel expiration
+func (b *MemoryBroker) RenewExpiry(key string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if s := b.lookup(key); s != nil {
+		s.expires = time.Now().Add(memoryChannelExpire)
+	}
+	return nil
+}
+
+// Meta returns the metadata of a channel
+func (b *MemoryBroker) Meta(key string) (*StreamMeta, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	s := b.lookup(key)
+	if s == nil {
+		return nil, ErrNotRegistered
+	}
+	return &StreamMeta{
+		StreamOptions: s.opts,
+		Created:       s.created,
+		LastWrite:     s.written,
+		Length:        s.trim + int64(len(s.data)),
+		Done:          s.done,
+		TTL:           s.expires.Sub(time.Now()),
+		Subscribers:   s.subscribers,
+		Nonce:         s.nonce,
+
+		LocalSubscribers: s.subscribers,
+	}, nil
+}
+
+// TailOffset returns the offset the last lines of a channel start at
+func (b *MemoryBroker) TailOffset(key string, lines int) (int64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	s := b.lookup(key)
+	if s == nil {
+		return 0, ErrNotRegistered
+	}
+
+	data := s.data
+	return FindTail(lines, s.trim+int64(len(data)), func() ([]byte, int64, error) {
+		chunk := data
+		data = nil
+		return chunk, s.trim, nil
+	})
+}
+
+// TimeOffset returns the offset of the content written since t
+func (b *MemoryBroker) TimeOffset(key string, t time.Time) (int64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	s := b.lookup(key)
+	if s == nil {
+		return 0, ErrNotRegistered
+	}
+
+	i := sort.Search(len(s.marks), func(i int) bool { return !s.marks[i].at.Before(t) })
+	if i == len(s.marks) {
+		return s.trim + int64(len(s.data)), nil
+	}
+	return s.marks[i].offset, nil
+}
+
+// Delete removes a channel
+func (b *MemoryBroker) Delete(key string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if s, ok := b.streams[key]; ok {
+		delete(b.streams, key)
+		s.broadcast()
+	}
+	return nil
+}
+
+// List returns the keys of the channels sorted, starting past the cursor
+func (b *MemoryBroker) List(cursor string, count int) ([]string, string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var keys []string
+	for key := range b.streams {
+		if key > cursor && b.lookup(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	if count <= 0 || len(keys) <= count {
+		return keys, "", nil
+	}
+	keys = keys[:count]
+	return keys, keys[count-1], nil
+}
+
+type memoryWriter struct {
+	broker *MemoryBroker
+	key    string
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	w.broker.mutex.Lock()
+	defer w.broker.mutex.Unlock()
+
+	s := w.broker.lookup(w.key)
+	if s == nil {
+		return 0, ErrNotRegistered
+	}
+
+	offset := s.trim + int64(len(s.data))
+	n, err := s.write(p)
+	s.written = time.Now()
+	if s.trim+int64(len(s.data)) > offset {
+		s.mark(offset, s.written)
+	}
+	s.done = false
+	s.expires = time.Now().Add(memoryChannelExpire)
+	s.broadcast()
+	return n, err
+}
+
+func (w *memoryWriter) Close() error {
+	w.broker.mutex.Lock()
+	defer w.broker.mutex.Unlock()
+
+	s := w.broker.lookup(w.key)
+	if s == nil {
+		return ErrNotRegistered
+	}
+
+	s.done = true
+	s.expires = time.Now().Add(memoryKeyExpire)
+	s.broadcast()
+	return nil
+}
+
+type memoryReader struct {
+	broker    *MemoryBroker
+	key       string
+	stream    *memoryStream // the stream subscribed to, even if replaced since
+	offset    int64
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (r *memoryReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	default:
+		return 0, errWhence
+	case io.SeekStart:
+		r.offset = offset
+	case io.SeekCurrent:
+		r.offset += offset
+	}
+	if offset < 0 {
+		return 0, errOffset
+	}
+
+	return r.offset, nil
+}
+
+func (r *memoryReader) Read(p []byte) (int, error) {
+	for {
+		r.broker.mutex.Lock()
+		s := r.broker.lookup(r.key)
+		if s == nil {
+			r.broker.mutex.Unlock()
+			return 0, io.EOF
+		}
+
+		if r.offset < s.trim {
+			// Rolled out of the stream already.
+			r.offset = s.trim
+		}
+		if i := r.offset - s.trim; i < int64(len(s.data)) {
+			n := copy(p, s.data[i:])
+			r.offset += int64(n)
+			r.broker.mutex.Unlock()
+			return n, nil
+		}
+
+		if s.done {
+			r.broker.mutex.Unlock()
+			return 0, io.EOF
+		}
+
+		notify := s.notify
+		r.broker.mutex.Unlock()
+
+		select {
+		case <-notify:
+		case <-r.closed:
+			return 0, io.EOF
+		}
+	}
+}
+
+// WriteTime returns when the content at offset got written
+func (r *memoryReader) WriteTime(offset int64) time.Time {
+	r.broker.mutex.Lock()
+	defer r.broker.mutex.Unlock()
+
+	s := r.broker.lookup(r.key)
+	if s == nil {
+		return time.Time{}
+	}
+	return writeTime(s.marks, offset)
+}
+
+func (r *memoryReader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+
+		r.broker.mutex.Lock()
+		r.stream.subscribers--
+		r.broker.mutex.Unlock()
+	})
+	return nil
+}
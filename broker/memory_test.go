@@ -0,0 +1,79 @@
+package broker
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryReadAfterClose(t *testing.T) {
+	b := NewMemoryBroker()
+	uuid, _ := util.NewUUID()
+	b.Register(uuid, nil)
+
+	w, _ := b.NewWriter(uuid)
+	w.Write([]byte("hello"))
+	w.Close()
+
+	r, err := b.NewReader(uuid)
+	assert.Nil(t, err)
+	defer r.Close()
+
+	buf, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestMemoryCloseUnblocksReader(t *testing.T) {
+	b := NewMemoryBroker()
+	uuid, _ := util.NewUUID()
+	b.Register(uuid, nil)
+
+	r, _ := b.NewReader(uuid)
+
+	done := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 10))
+		done <- err
+	}()
+
+	r.Close()
+
+	select {
+	case err := <-done:
+		assert.Equal(t, io.EOF, err)
+	case <-time.After(time.Second):
+		t.Fatal("reader wasn't unblocked by Close")
+	}
+}
+
+func TestMemoryExpiry(t *testing.T) {
+	b := NewMemoryBroker()
+	uuid, _ := util.NewUUID()
+	b.Register(uuid, nil)
+
+	b.streams[uuid].expires = time.Now().Add(-time.Second)
+
+	r, err := b.IsRegistered(uuid)
+	assert.Nil(t, err)
+	assert.False(t, r)
+
+	_, err = b.NewWriter(uuid)
+	assert.Equal(t, ErrNotRegistered, err)
+}
+
+func TestMemoryRenewExpiry(t *testing.T) {
+	b := NewMemoryBroker()
+	uuid, _ := util.NewUUID()
+	b.Register(uuid, nil)
+
+	expires := time.Now().Add(time.Second)
+	b.streams[uuid].expires = expires
+	b.RenewExpiry(uuid)
+
+	assert.True(t, b.streams[uuid].expires.After(expires))
+}
@@ -1,10 +1,16 @@
 package broker
 
 import (
-	"flag"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"log"
+	"net"
 	"net/url"
-	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -12,25 +18,85 @@ import (
 	"github.com/heroku/busl/util"
 )
 
+// RedisOptions holds the redis broker configuration
+type RedisOptions struct {
+	// URL of the redis server, e.g. redis://:password@host:6379/0.
+	// The rediss:// scheme connects using TLS.
+	URL string
+
+	// SentinelMaster is the name of the master to discover through
+	// the sentinels listening at SentinelAddrs. The host of the URL
+	// is ignored then, while its credentials and database still apply.
+	SentinelMaster string
+	SentinelAddrs  []string
+
+	// Cluster routes commands to the nodes of a redis cluster, the
+	// URL pointing at any of them. The keys of a stream are hash
+	// tagged so that they all belong to the same slot.
+	Cluster bool
+
+	MaxIdle     int           // maximum number of idle connections in the pool
+	MaxActive   int           // maximum number of connections, zero for no limit
+	Wait        bool          // whether to wait for a connection once MaxActive is reached
+	IdleTimeout time.Duration // close connections idle for longer than this
+
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// SubscriptionConns is the number of pub/sub connections
+	// shared by all the subscribers of the process.
+	SubscriptionConns int
+
+	// TailCacheSize is the number of bytes kept in memory at the
+	// head of every stream having local subscribers. A negative
+	// size disables the cache.
+	TailCacheSize int
+
+	// TLSConfig is used for rediss:// URLs.
+	TLSConfig *tls.Config
+
+	KeyExpire     time.Duration // how long a stream is kept once done
+	ChannelExpire time.Duration // how long an idle stream is kept
+}
+
+// Default redis broker options
+const (
+	DefaultRedisMaxIdle       = 3
+	DefaultSubscriptionConns  = 1
+	DefaultTailCacheSize      = 64 * 1024
+	DefaultRedisIdleTimeout   = 4 * time.Minute
+	DefaultRedisKeyExpire     = time.Minute
+	DefaultRedisChannelExpire = DefaultRedisKeyExpire * 60
+)
+
 var (
-	redisURL           = flag.String("redisUrl", os.Getenv("REDIS_URL"), "URL of the redis server")
-	redisServer        *url.URL
-	redisPool          *pool
-	redisKeyExpire     = 60 // redis uses seconds for EXPIRE
-	redisChannelExpire = redisKeyExpire * 60
+	errRedisScheme  = errors.New("Redis URL scheme must be redis or rediss")
+	errRedisCluster = errors.New("Redis cluster and sentinel can't be used together")
 )
 
 type pool struct {
 	*redis.Pool
-	c int64
+	cluster *cluster // nil unless in cluster mode
+	c       int64
 }
 
 func (p *pool) Get() Conn {
 	n := atomic.AddInt64(&p.c, 1)
 	util.SampleWithData("redis.connections", n, "at=acquire")
+	if p.cluster != nil {
+		return Conn{p.cluster.conn(), p}
+	}
 	return Conn{p.Pool.Get(), p}
 }
 
+func (p *pool) Close() error {
+	if p.cluster != nil {
+		p.cluster.close()
+	}
+	return p.Pool.Close()
+}
+
 type Conn struct {
 	redis.Conn
 	p *pool
@@ -42,111 +108,723 @@ func (c Conn) Close() error {
 	return c.Conn.Close()
 }
 
-func init() {
-	flag.Parse()
-	redisServer, _ = url.Parse(*redisURL)
-	redisPool = newPool(redisServer)
+// dialer opens new connections to the redis server
+type dialer struct {
+	server *url.URL
+	opts   *RedisOptions
+}
 
-	conn := redisPool.Get()
-	defer conn.Close()
+func newDialer(opts *RedisOptions) (*dialer, error) {
+	rawURL := opts.URL
+	if rawURL == "" && opts.SentinelMaster != "" {
+		rawURL = "redis://"
+	}
+	server, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if server.Scheme != "redis" && server.Scheme != "rediss" {
+		return nil, errRedisScheme
+	}
+	if opts.Cluster && opts.SentinelMaster != "" {
+		return nil, errRedisCluster
+	}
+	return &dialer{server: server, opts: opts}, nil
 }
 
-func newPool(server *url.URL) *pool {
-	cleanServerURL := *server
-	cleanServerURL.User = nil
-	log.Printf("connecting to redis: %s", cleanServerURL.String())
-	p := &redis.Pool{
-		MaxIdle:     3,
-		IdleTimeout: 4 * time.Minute,
-		Dial: func() (c redis.Conn, err error) {
-			c, err = redis.Dial("tcp", server.Host)
-			if err != nil {
-				return
-			}
+// dial connects to the server using the given read timeout. Pub/sub
+// connections block on reads for as long as nothing is published,
+// and thus use no read timeout at all.
+func (d *dialer) dial(readTimeout time.Duration) (redis.Conn, error) {
+	if d.opts.SentinelMaster != "" {
+		return d.dialMaster(readTimeout)
+	}
+	return d.dialAddr(d.address(), readTimeout)
+}
 
-			if server.User == nil {
-				return
-			}
+// address returns the host:port of the server
+func (d *dialer) address() string {
+	if d.server.Port() == "" {
+		return net.JoinHostPort(d.server.Hostname(), "6379")
+	}
+	return d.server.Host
+}
 
-			pw, pwset := server.User.Password()
-			if !pwset {
-				return
-			}
+// netDial opens a plain or TLS connection, depending on the URL scheme
+func (d *dialer) netDial(address string) (net.Conn, error) {
+	netDialer := &net.Dialer{Timeout: d.opts.DialTimeout}
+	if d.server.Scheme == "rediss" {
+		config := d.tlsConfig()
+		if d.opts.SentinelMaster != "" || d.opts.Cluster {
+			// The URL host only names one of the servers.
+			config.ServerName, _, _ = net.SplitHostPort(address)
+		}
+		return tls.DialWithDialer(netDialer, "tcp", address, config)
+	}
+	return netDialer.Dial("tcp", address)
+}
+
+// dialAddr connects to the server at the given address,
+// authenticating and selecting the database of the URL.
+func (d *dialer) dialAddr(address string, readTimeout time.Duration) (redis.Conn, error) {
+	netConn, err := d.netDial(address)
+	if err != nil {
+		return nil, err
+	}
 
-			if _, err = c.Do("AUTH", pw); err != nil {
+	c := redis.NewConn(netConn, readTimeout, d.opts.WriteTimeout)
+
+	if d.server.User != nil {
+		if pw, ok := d.server.User.Password(); ok {
+			if _, err := c.Do("AUTH", pw); err != nil {
 				c.Close()
-				return
+				return nil, err
 			}
-			return
-		},
+		}
+	}
+
+	if db := strings.TrimPrefix(d.server.Path, "/"); db != "" {
+		if _, err := strconv.Atoi(db); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("Invalid redis database %q", db)
+		}
+		if _, err := c.Do("SELECT", db); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (d *dialer) tlsConfig() *tls.Config {
+	config := &tls.Config{}
+	if d.opts.TLSConfig != nil {
+		config = d.opts.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = d.server.Hostname()
+	}
+	return config
+}
+
+// String returns the server URL without credentials
+func (d *dialer) String() string {
+	if d.opts.SentinelMaster != "" {
+		return fmt.Sprintf("redis-sentinel://%s/%s", strings.Join(d.opts.SentinelAddrs, ","), d.opts.SentinelMaster)
+	}
+
+	cleanServerURL := *d.server
+	cleanServerURL.User = nil
+	return cleanServerURL.String()
+}
+
+func newPool(d *dialer) *pool {
+	log.Printf("connecting to redis: %s", d)
+	p := &pool{Pool: newRedisPool(d.opts, func() (redis.Conn, error) {
+		return d.dial(d.opts.ReadTimeout)
+	})}
+
+	if d.opts.SentinelMaster != "" {
+		// Connections to a demoted master would keep failing
+		// until they get closed.
+		p.TestOnBorrow = func(c redis.Conn, t time.Time) error {
+			return checkMaster(c)
+		}
+	}
+	if d.opts.Cluster {
+		p.cluster = newCluster(d)
+	}
+	return p
+}
+
+func newRedisPool(opts *RedisOptions, dial func() (redis.Conn, error)) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     opts.MaxIdle,
+		MaxActive:   opts.MaxActive,
+		Wait:        opts.Wait,
+		IdleTimeout: opts.IdleTimeout,
+		Dial:        dial,
 		TestOnBorrow: func(c redis.Conn, t time.Time) error {
 			_, err := c.Do("PING")
 			return err
 		},
 	}
-
-	return &pool{p, 0}
 }
 
 type channel string
 
-func (c channel) id() string {
-	return string(c) + ":id"
+// channel returns the channel of a stream, hash tagging
+// its name in cluster mode.
+func (b *RedisBroker) channel(key string) channel {
+	if b.pool.cluster != nil {
+		return channel("{" + key + "}")
+	}
+	return channel(key)
 }
 
-func (c channel) wildcardID() string {
-	return string(c) + ":*"
+func (c channel) id() string {
+	return string(c) + ":id"
 }
 
 func (c channel) doneID() string {
 	return string(c) + ":done"
 }
 
+func (c channel) metaID() string {
+	return string(c) + ":meta"
+}
+
+func (c channel) logID() string {
+	return string(c) + ":log"
+}
+
+func (c channel) timesID() string {
+	return string(c) + ":times"
+}
+
 func (c channel) killID() string {
 	return string(c) + ":kill"
 }
 
-// RedisRegistrar is a channel storing data on redis
-type RedisRegistrar struct{}
+// RedisBroker is a broker storing streams on redis
+type RedisBroker struct {
+	pool   *pool
+	dialer *dialer
+	hubs   []*hub
+
+	tailStats tailStats
+	done      chan struct{}
+
+	localMutex sync.Mutex
+	locals     map[channel]int64 // readers in this process
+
+	keyExpire     int // redis uses seconds for EXPIRE
+	channelExpire int
+}
+
+// NewRedisBroker creates a new redis broker instance. Zero
+// options are replaced by their defaults.
+func NewRedisBroker(opts RedisOptions) (*RedisBroker, error) {
+	return newRedisBroker(opts, func(c channel, b *RedisBroker, size int) tail {
+		return newTailCache(c, b, size)
+	})
+}
+
+// newRedisBroker creates a broker whose subscriptions cache
+// the head of the streams with the tails built by newTail.
+func newRedisBroker(opts RedisOptions, newTail func(channel, *RedisBroker, int) tail) (*RedisBroker, error) {
+	if opts.MaxIdle == 0 {
+		opts.MaxIdle = DefaultRedisMaxIdle
+	}
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = DefaultRedisIdleTimeout
+	}
+	if opts.KeyExpire == 0 {
+		opts.KeyExpire = DefaultRedisKeyExpire
+	}
+	if opts.ChannelExpire == 0 {
+		opts.ChannelExpire = DefaultRedisChannelExpire
+	}
+	if opts.SubscriptionConns == 0 {
+		opts.SubscriptionConns = DefaultSubscriptionConns
+	}
+	if opts.TailCacheSize == 0 {
+		opts.TailCacheSize = DefaultTailCacheSize
+	}
+
+	d, err := newDialer(&opts)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &RedisBroker{
+		pool:          newPool(d),
+		dialer:        d,
+		keyExpire:     int(opts.KeyExpire / time.Second),
+		channelExpire: int(opts.ChannelExpire / time.Second),
+		done:          make(chan struct{}),
+		locals:        make(map[channel]int64),
+	}
+
+	var subTail func(channel) tail
+	if opts.TailCacheSize > 0 {
+		subTail = func(c channel) tail { return newTail(c, b, opts.TailCacheSize) }
+		go b.tailStats.reportEvery(tailStatsInterval, b.done)
+	}
+
+	// Subscriptions sit idle until something is published,
+	// and thus use no read timeout at all.
+	dial := func() (redis.Conn, error) { return d.dial(0) }
+	if b.pool.cluster != nil {
+		// Messages are broadcast to every node of a cluster.
+		dial = func() (redis.Conn, error) { return b.pool.cluster.dialAny(0) }
+	}
+	for i := 0; i < opts.SubscriptionConns; i++ {
+		b.hubs = append(b.hubs, newHub(dial, subTail))
+	}
+	return b, nil
+}
+
+// hub returns the subscription hub handling the given stream
+func (b *RedisBroker) hub(key string) *hub {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return b.hubs[h.Sum32()%uint32(len(b.hubs))]
+}
 
-// NewRedisRegistrar creates a new registrar instance
-func NewRedisRegistrar() *RedisRegistrar {
-	registrar := &RedisRegistrar{}
+// scan calls fn for every key matching the pattern. In
+// cluster mode, every master node gets scanned.
+func (b *RedisBroker) scan(pattern string, fn func(key string) error) error {
+	if b.pool.cluster != nil {
+		return b.pool.cluster.scan(pattern, fn)
+	}
 
-	return registrar
+	conn := b.pool.Get()
+	defer conn.Close()
+	return scanConn(conn, pattern, fn)
 }
 
+func scanConn(conn redis.Conn, pattern string, fn func(key string) error) error {
+	cursor := ""
+	for {
+		keys, next, err := scanPage(conn, pattern, cursor, 100)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+
+		if cursor = next; cursor == "" {
+			return nil
+		}
+	}
+}
+
+// scanPage runs a single SCAN from the cursor, empty at first.
+// The cursor returned is empty once the scan is complete.
+func scanPage(conn redis.Conn, pattern, cursor string, count int) ([]string, string, error) {
+	if cursor == "" {
+		cursor = "0"
+	} else if _, err := strconv.ParseUint(cursor, 10, 64); err != nil {
+		return nil, "", ErrInvalidCursor
+	}
+
+	reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", count))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(reply) != 2 {
+		return nil, "", fmt.Errorf("Unexpected SCAN reply: %v", reply)
+	}
+
+	next, err := redis.String(reply[0], nil)
+	if err != nil {
+		return nil, "", err
+	}
+	keys, err := redis.Strings(reply[1], nil)
+	if next == "0" {
+		next = ""
+	}
+	return keys, next, err
+}
+
+// list pages through the channels having
+// a key matching the pattern, e.g. *:id.
+func (b *RedisBroker) list(pattern, cursor string, count int) ([]string, string, error) {
+	var (
+		keys []string
+		next string
+		err  error
+	)
+	if b.pool.cluster != nil {
+		keys, next, err = b.pool.cluster.scanPage(pattern, cursor, count)
+	} else {
+		conn := b.pool.Get()
+		keys, next, err = scanPage(conn, pattern, cursor, count)
+		conn.Close()
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	for i, key := range keys {
+		keys[i] = b.streamKey(key)
+	}
+	return keys, next, nil
+}
+
+// streamKey returns the key of the stream owning the given redis key
+func (b *RedisBroker) streamKey(redisKey string) string {
+	key := redisKey
+	if i := strings.LastIndex(key, ":"); i >= 0 {
+		key = key[:i]
+	}
+	if b.pool.cluster != nil {
+		key = strings.TrimSuffix(strings.TrimPrefix(key, "{"), "}")
+	}
+	return key
+}
+
+// Close releases the connections held by the broker
+func (b *RedisBroker) Close() error {
+	close(b.done)
+	for _, h := range b.hubs {
+		h.close()
+	}
+	return b.pool.Close()
+}
+
+// setMetaLua resets the metadata of a stream, held by the last key,
+// to the field-value pairs passed from ARGV[3] on. ARGV[1] is the
+// expiry of the stream.
+const setMetaLua = `
+redis.call('DEL', KEYS[#KEYS])
+redis.call('HMSET', KEYS[#KEYS], unpack(ARGV, 3))
+redis.call('EXPIRE', KEYS[#KEYS], ARGV[1])
+`
+
+// registerScript creates a stream, unless it exists and ARGV[2] isn't
+// set. It returns whether the stream got created. Whatever is left of
+// a previous stream, such as its done flag, gets wiped.
+var registerScript = redis.NewScript(5, `
+if ARGV[2] ~= '1' and redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('SETEX', KEYS[1], ARGV[1], '')
+redis.call('DEL', KEYS[2], KEYS[3], KEYS[4])
+`+setMetaLua+`
+return 1
+`)
+
 // Register registers the new channel
-func (rr *RedisRegistrar) Register(channelName string) (err error) {
-	conn := redisPool.Get()
+func (b *RedisBroker) Register(channelName string, opts *StreamOptions) error {
+	return b.register(channelName, opts, false)
+}
+
+// Reset registers the channel, wiping it if it exists
+func (b *RedisBroker) Reset(channelName string, opts *StreamOptions) error {
+	return b.register(channelName, opts, true)
+}
+
+func (b *RedisBroker) register(channelName string, opts *StreamOptions, reset bool) error {
+	conn := b.pool.Get()
 	defer conn.Close()
 
-	channel := channel(channelName)
-	_, err = conn.Do("SETEX", channel.id(), redisChannelExpire, make([]byte, 0))
+	meta, err := metaArgs(opts)
+	if err != nil {
+		return err
+	}
+
+	channel := b.channel(channelName)
+	args := redis.Args{channel.id(), channel.timesID(), channel.doneID(), channel.logID(), channel.metaID(), b.channelExpire, reset}.Add(meta...)
+	created, err := redis.Bool(registerScript.Do(conn, args...))
+	if err != nil {
+		util.CountWithData("RedisBroker.Register.error", 1, "error=%s", err)
+		return err
+	}
+	if !created {
+		return ErrAlreadyRegistered
+	}
+	return nil
+}
+
+// metaArgs returns the field-value pairs of the metadata of a new channel
+func metaArgs(opts *StreamOptions) (redis.Args, error) {
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	args := redis.Args{"created", unixMilli(time.Now()), "nonce", nonce}
+	if opts != nil {
+		if opts.ContentType != "" {
+			args = args.Add("content_type", opts.ContentType)
+		}
+		if opts.RequestID != "" {
+			args = args.Add("request_id", opts.RequestID)
+		}
+	}
+	if opts.limited() {
+		args = args.Add("max_size", opts.MaxSize, "overflow", string(opts.Overflow))
+	}
+	return args, nil
+}
+
+// parseMeta returns the metadata stored by metaArgs and the scripts
+// writing to a channel. The length, done flag and TTL are left out.
+func parseMeta(fields map[string]string) *StreamMeta {
+	meta := &StreamMeta{
+		StreamOptions: StreamOptions{
+			Overflow:    Overflow(fields["overflow"]),
+			ContentType: fields["content_type"],
+			RequestID:   fields["request_id"],
+		},
+	}
+	meta.Nonce = fields["nonce"]
+	meta.MaxSize, _ = strconv.ParseInt(fields["max_size"], 10, 64)
+	meta.Subscribers, _ = strconv.ParseInt(fields["subscribers"], 10, 64)
+	if ms, err := strconv.ParseInt(fields["created"], 10, 64); err == nil {
+		meta.Created = fromUnixMilli(ms)
+	}
+	if ms, err := strconv.ParseInt(fields["written"], 10, 64); err == nil {
+		meta.LastWrite = fromUnixMilli(ms)
+	}
+	return meta
+}
+
+// readMeta parses the metadata fields of a channel along with the
+// replies to EXISTS on its done key and PTTL on its content key.
+func readMeta(fields map[string]string, done, pttl interface{}) (*StreamMeta, error) {
+	ttl, err := redis.Int64(pttl, nil)
 	if err != nil {
-		util.CountWithData("RedisRegistrar.Register.error", 1, "error=%s", err)
+		return nil, err
+	}
+	if ttl == -2 {
+		return nil, ErrNotRegistered
+	}
+
+	meta := parseMeta(fields)
+	if meta.Done, err = redis.Bool(done, nil); err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		meta.TTL = time.Duration(ttl) * time.Millisecond
 	}
-	return
+	return meta, nil
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromUnixMilli(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
 }
 
 // IsRegistered checks whether a channel name is registered
-func (rr *RedisRegistrar) IsRegistered(channelName string) (registered bool, err error) {
-	conn := redisPool.Get()
+func (b *RedisBroker) IsRegistered(channelName string) (registered bool, err error) {
+	conn := b.pool.Get()
 	defer conn.Close()
 
-	channel := channel(channelName)
+	channel := b.channel(channelName)
 	exists, err := redis.Bool(conn.Do("EXISTS", channel.id()))
 	if err != nil {
-		util.CountWithData("RedisRegistrar.IsRegistered.error", 1, "error=%s", err)
+		util.CountWithData("RedisBroker.IsRegistered.error", 1, "error=%s", err)
 	}
 	return exists, err
 }
 
 // Get returns a key value
-func Get(key string) ([]byte, error) {
-	conn := redisPool.Get()
+func (b *RedisBroker) Get(key string) ([]byte, error) {
+	conn := b.pool.Get()
 	defer conn.Close()
 
-	channel := channel(key)
+	channel := b.channel(key)
 	return redis.Bytes(conn.Do("GET", channel.id()))
 }
+
+// Len returns the length of the data published to the channel
+func (b *RedisBroker) Len(key string) (int64, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	channel := b.channel(key)
+	conn.Send("MULTI")
+	conn.Send("HGET", channel.metaID(), "trim")
+	conn.Send("STRLEN", channel.id())
+	list, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, err
+	}
+
+	trim, err := redis.Int64(list[0], nil)
+	if err != nil && err != redis.ErrNil {
+		return 0, err
+	}
+	size, err := redis.Int64(list[1], nil)
+	return trim + size, err
+}
+
+// Meta returns the metadata of a channel
+func (b *RedisBroker) Meta(key string) (*StreamMeta, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	channel := b.channel(key)
+	conn.Send("MULTI")
+	conn.Send("HGETALL", channel.metaID())
+	conn.Send("STRLEN", channel.id())
+	conn.Send("EXISTS", channel.doneID())
+	conn.Send("PTTL", channel.id())
+	list, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := redis.StringMap(list[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := readMeta(fields, list[2], list[3])
+	if err != nil {
+		return nil, err
+	}
+	size, err := redis.Int64(list[1], nil)
+	if err != nil {
+		return nil, err
+	}
+	trim, _ := strconv.ParseInt(fields["trim"], 10, 64)
+	meta.Length = trim + size
+	meta.LocalSubscribers = b.localSubscribers(channel)
+	return meta, nil
+}
+
+// TailOffset returns the offset the last lines of a channel start at
+func (b *RedisBroker) TailOffset(key string, lines int) (int64, error) {
+	registered, err := b.IsRegistered(key)
+	if err != nil {
+		return 0, err
+	}
+	if !registered {
+		return 0, ErrNotRegistered
+	}
+
+	length, err := b.Len(key)
+	if err != nil {
+		return 0, err
+	}
+
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	channel := b.channel(key)
+	end := length
+	return FindTail(lines, length, func() ([]byte, int64, error) {
+		if end <= 0 {
+			return nil, 0, nil
+		}
+		offset := end - TailChunkSize
+		if offset < 0 {
+			offset = 0
+		}
+		data, start, _, _, err := readRange(conn, channel, offset, int(end-offset), b.channelExpire)
+		if err != nil || start >= end {
+			// Rolled out of the stream meanwhile.
+			return nil, 0, err
+		}
+		if int64(len(data)) > end-start {
+			data = data[:end-start]
+		}
+		end = start
+		return data, start, nil
+	})
+}
+
+// TimeOffset returns the offset of the content written since t. Write
+// times are recorded to the second, so content written up to a second
+// before t may be included.
+func (b *RedisBroker) TimeOffset(key string, t time.Time) (int64, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	channel := b.channel(key)
+	conn.Send("MULTI")
+	conn.Send("EXISTS", channel.id())
+	conn.Send("ZRANGEBYSCORE", channel.timesID(), t.Unix(), "+inf", "LIMIT", 0, 1)
+	conn.Send("HGET", channel.metaID(), "trim")
+	conn.Send("STRLEN", channel.id())
+	list, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, err
+	}
+
+	if exists, err := redis.Bool(list[0], nil); err != nil || !exists {
+		if err == nil {
+			err = ErrNotRegistered
+		}
+		return 0, err
+	}
+	offsets, err := redis.Values(list[1], nil)
+	if err != nil {
+		return 0, err
+	}
+	if len(offsets) > 0 {
+		return redis.Int64(offsets[0], nil)
+	}
+
+	trim, err := redis.Int64(list[2], nil)
+	if err != nil && err != redis.ErrNil {
+		return 0, err
+	}
+	size, err := redis.Int64(list[3], nil)
+	return trim + size, err
+}
+
+// List returns the keys of the channels
+func (b *RedisBroker) List(cursor string, count int) ([]string, string, error) {
+	return b.list("*:id", cursor, count)
+}
+
+// Delete removes a channel
+func (b *RedisBroker) Delete(key string) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	channel := b.channel(key)
+	conn.Send("MULTI")
+	conn.Send("DEL", channel.id(), channel.logID(), channel.doneID(), channel.metaID(), channel.timesID())
+	conn.Send("PUBLISH", channel.killID(), 1)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// subscribed adds delta to the subscriber count of a channel
+func (b *RedisBroker) subscribed(c channel, delta int) {
+	b.localMutex.Lock()
+	if b.locals[c] += int64(delta); b.locals[c] <= 0 {
+		delete(b.locals, c)
+	}
+	b.localMutex.Unlock()
+
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	if _, err := subscribeScript.Do(conn, c.metaID(), delta); err != nil {
+		util.CountWithData("RedisBroker.subscribed.error", 1, "error=%s", err)
+	}
+}
+
+// localSubscribers returns the number of readers of a channel in this process
+func (b *RedisBroker) localSubscribers(c channel) int64 {
+	b.localMutex.Lock()
+	defer b.localMutex.Unlock()
+	return b.locals[c]
+}
+
+// IsDone returns whether the channel has been closed
+func (b *RedisBroker) IsDone(key string) (bool, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	channel := b.channel(key)
+	return redis.Bool(conn.Do("EXISTS", channel.doneID()))
+}
+
+// RenewExpiry renews the channel expiration
+func (b *RedisBroker) RenewExpiry(key string) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	channel := b.channel(key)
+	conn.Send("MULTI")
+	conn.Send("EXPIRE", channel.id(), b.channelExpire)
+	conn.Send("EXPIRE", channel.metaID(), b.channelExpire)
+	conn.Send("EXPIRE", channel.timesID(), b.channelExpire)
+	_, err := conn.Do("EXEC")
+	return err
+}
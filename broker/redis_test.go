@@ -7,16 +7,15 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func newRegUUID() (*RedisRegistrar, string) {
-	reg := NewRedisRegistrar()
+func newRegUUID() (Registrar, string) {
 	uuid, _ := util.NewUUID()
 
-	return reg, uuid
+	return testBroker, uuid
 }
 
 func TestRegisteredIsRegistered(t *testing.T) {
 	reg, uuid := newRegUUID()
-	reg.Register(uuid)
+	reg.Register(uuid, nil)
 
 	r, err := reg.IsRegistered(uuid)
 	assert.Nil(t, err)
@@ -33,19 +32,41 @@ func TestUnregisteredIsNotRegistered(t *testing.T) {
 func TestUnregisteredErrNotRegistered(t *testing.T) {
 	_, uuid := newRegUUID()
 
-	_, err := NewReader(uuid)
+	_, err := testBroker.NewReader(uuid)
 	assert.Equal(t, err, ErrNotRegistered)
 
-	_, err = NewWriter(uuid)
+	_, err = testBroker.NewWriter(uuid)
 	assert.Equal(t, err, ErrNotRegistered)
 }
 
 func TestRegisteredNoError(t *testing.T) {
 	reg, uuid := newRegUUID()
-	reg.Register(uuid)
-	_, err := NewReader(uuid)
+	reg.Register(uuid, nil)
+	_, err := testBroker.NewReader(uuid)
 	assert.Nil(t, err)
 
-	_, err = NewWriter(uuid)
+	_, err = testBroker.NewWriter(uuid)
 	assert.Nil(t, err)
 }
+
+func TestNewRedisBrokerInvalidScheme(t *testing.T) {
+	_, err := NewRedisBroker(RedisOptions{URL: "http://localhost:6379"})
+	assert.Equal(t, errRedisScheme, err)
+}
+
+func TestNewRedisBrokerDefaults(t *testing.T) {
+	b, err := NewRedisBroker(RedisOptions{URL: "redis://:secret@localhost:6379"})
+	assert.Nil(t, err)
+	defer b.Close()
+
+	assert.Equal(t, DefaultRedisMaxIdle, b.pool.MaxIdle)
+	assert.Equal(t, 60, b.keyExpire)
+	assert.Equal(t, 3600, b.channelExpire)
+	assert.Equal(t, "redis://localhost:6379", b.dialer.String())
+}
+
+func TestRedisTLSConfig(t *testing.T) {
+	d, err := newDialer(&RedisOptions{URL: "rediss://redis.example.com:6380"})
+	assert.Nil(t, err)
+	assert.Equal(t, "redis.example.com", d.tlsConfig().ServerName)
+}
@@ -0,0 +1,105 @@
+package broker
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// startRedis runs a redis-server process, skipping the test when
+// redis-server isn't installed. The config, if any, is written to a
+// file passed first on the command line. It returns the address the
+// server listens on, and a func stopping it that the caller defers.
+func startRedis(t *testing.T, config string, args ...string) (string, func()) {
+	path, err := exec.LookPath("redis-server")
+	if err != nil {
+		t.Skip("redis-server is required")
+	}
+
+	dir, err := ioutil.TempDir("", "busl-redis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := func() { os.RemoveAll(dir) }
+	started := false
+	defer func() {
+		if !started {
+			stop()
+		}
+	}()
+
+	address := freeAddr(t)
+	_, port, _ := net.SplitHostPort(address)
+
+	var cmdArgs []string
+	if config != "" {
+		file := filepath.Join(dir, "redis.conf")
+		if err := ioutil.WriteFile(file, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		cmdArgs = append(cmdArgs, file)
+	}
+	cmdArgs = append(cmdArgs, "--port", port, "--bind", "127.0.0.1", "--dir", dir, "--save", "", "--appendonly", "no")
+
+	cmd := exec.Command(path, append(cmdArgs, args...)...)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	stop = func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		os.RemoveAll(dir)
+	}
+
+	waitFor(t, func() bool {
+		c, err := redis.Dial("tcp", address)
+		if err != nil {
+			return false
+		}
+		defer c.Close()
+		_, err = c.Do("PING")
+		return err == nil
+	})
+	started = true
+	return address, stop
+}
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// waitFor polls until cond is true, failing the test after 10 seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func redisDo(t *testing.T, address string, cmd string, args ...interface{}) interface{} {
+	c, err := redis.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	reply, err := c.Do(cmd, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
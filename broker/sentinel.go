@@ -0,0 +1,121 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/util"
+)
+
+var (
+	errNoSentinel = errors.New("No sentinel could tell the redis master address")
+	errNotMaster  = errors.New("Redis server isn't a master")
+)
+
+// dialMaster connects to the master currently elected by the sentinels.
+func (d *dialer) dialMaster(readTimeout time.Duration) (redis.Conn, error) {
+	address, err := d.masterAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := d.dialAddr(address, readTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sentinels may not have caught up with a failover yet.
+	if err := checkMaster(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &masterConn{Conn: c}, nil
+}
+
+// masterAddr asks the sentinels for the master address,
+// trying each of them in turn.
+func (d *dialer) masterAddr() (string, error) {
+	err := errNoSentinel
+	for _, sentinel := range d.opts.SentinelAddrs {
+		var address string
+		if address, err = d.askSentinel(sentinel); err == nil {
+			return address, nil
+		}
+		util.CountWithData("RedisBroker.sentinel.error", 1, "sentinel=%s err=%s", sentinel, err)
+	}
+	return "", err
+}
+
+func (d *dialer) askSentinel(sentinel string) (string, error) {
+	netConn, err := d.netDial(sentinel)
+	if err != nil {
+		return "", err
+	}
+
+	c := redis.NewConn(netConn, d.opts.DialTimeout, d.opts.DialTimeout)
+	defer c.Close()
+
+	reply, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", d.opts.SentinelMaster))
+	if err == redis.ErrNil {
+		return "", fmt.Errorf("Unknown redis master %q", d.opts.SentinelMaster)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(reply) != 2 {
+		return "", fmt.Errorf("Unexpected sentinel reply: %v", reply)
+	}
+	return net.JoinHostPort(reply[0], reply[1]), nil
+}
+
+// checkMaster returns an error unless c is connected to a master.
+func checkMaster(c redis.Conn) error {
+	reply, err := redis.Values(c.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(reply) == 0 {
+		return errNotMaster
+	}
+	if role, _ := redis.String(reply[0], nil); role != "master" {
+		return errNotMaster
+	}
+	return nil
+}
+
+// masterConn is a connection to a sentinel monitored master. Once a
+// failover demoted the master, it reports an error so that the pool
+// drops it instead of reusing it.
+type masterConn struct {
+	redis.Conn
+	demoted bool
+}
+
+func (c *masterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(cmd, args...)
+	c.check(err)
+	return reply, err
+}
+
+func (c *masterConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+	c.check(err)
+	return reply, err
+}
+
+func (c *masterConn) check(err error) {
+	if e, ok := err.(redis.Error); ok && strings.HasPrefix(string(e), "READONLY") {
+		c.demoted = true
+	}
+}
+
+func (c *masterConn) Err() error {
+	if c.demoted {
+		return errNotMaster
+	}
+	return c.Conn.Err()
+}
@@ -0,0 +1,78 @@
+package broker
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+type readOnlyConn struct{ fakeNode }
+
+func (c *readOnlyConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return nil, redis.Error("READONLY You can't write against a read only replica.")
+}
+
+func TestMasterConnDemoted(t *testing.T) {
+	c := &masterConn{Conn: &readOnlyConn{}}
+	assert.Nil(t, c.Err())
+
+	_, err := c.Do("SET", "foo", "bar")
+	assert.NotNil(t, err)
+	assert.Equal(t, errNotMaster, c.Err())
+}
+
+func TestSentinelString(t *testing.T) {
+	d, err := newDialer(&RedisOptions{
+		URL:            "redis://:secret@/1",
+		SentinelMaster: "busl",
+		SentinelAddrs:  []string{"10.0.0.1:26379", "10.0.0.2:26379"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "redis-sentinel://10.0.0.1:26379,10.0.0.2:26379/busl", d.String())
+
+	_, err = newDialer(&RedisOptions{URL: "redis://localhost", SentinelMaster: "busl", Cluster: true})
+	assert.Equal(t, errRedisCluster, err)
+}
+
+func TestSentinelFailover(t *testing.T) {
+	master, stopMaster := startRedis(t, "")
+	defer stopMaster()
+	host, port, _ := net.SplitHostPort(master)
+	replica, stopReplica := startRedis(t, "", "--replicaof", host, port)
+	defer stopReplica()
+	sentinel, stopSentinel := startRedis(t, fmt.Sprintf(
+		"sentinel monitor busl %s %s 1\nsentinel down-after-milliseconds busl 500\nsentinel failover-timeout busl 1000\n",
+		host, port), "--sentinel")
+	defer stopSentinel()
+
+	b, err := NewRedisBroker(RedisOptions{SentinelMaster: "busl", SentinelAddrs: []string{sentinel}})
+	assert.Nil(t, err)
+	defer b.Close()
+
+	uuid, _ := util.NewUUID()
+	assert.Nil(t, b.Register(uuid, nil))
+	w, _ := b.NewWriter(uuid)
+	_, err = w.Write([]byte("hello"))
+	assert.Nil(t, err)
+
+	redisDo(t, master, "WAIT", 1, 5000)
+	redisDo(t, sentinel, "SENTINEL", "FAILOVER", "busl")
+	waitFor(t, func() bool {
+		address, _ := b.dialer.masterAddr()
+		return address == replica
+	})
+
+	// Writes may fail until the old master connections get dropped.
+	waitFor(t, func() bool {
+		_, err := w.Write([]byte(" world"))
+		return err == nil
+	})
+
+	buf, err := b.Get(uuid)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", string(buf))
+}
@@ -0,0 +1,783 @@
+package broker
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/util"
+)
+
+const (
+	streamBatchSize    = 256
+	streamBlockTimeout = 30 * time.Second
+)
+
+// Every entry of a stream's log holds the byte offset it starts at,
+// and the written data. The entry IDs generated by redis carry the
+// write timestamps. Closing the stream appends an entry flagged with
+// eof. Every append is published to the stream's channel, like the
+// writes of the string layout, which wakes readers up. Rolling streams
+// drop their oldest entries, so the first entry may not start at
+// offset zero.
+var (
+	appendScript = redis.NewScript(4, `
+local function field(entry, name)
+	local fields = entry[2]
+	for i = 1, #fields, 2 do
+		if fields[i] == name then
+			return fields[i + 1]
+		end
+	end
+end
+
+local off = 0
+local last = redis.call('XREVRANGE', KEYS[1], '+', '-', 'COUNT', 1)
+if #last > 0 then
+	off = tonumber(field(last[1], 'off')) + string.len(field(last[1], 'data'))
+end
+
+if ARGV[2] == '1' then
+	redis.call('XADD', KEYS[1], '*', 'off', off, 'data', '', 'eof', '1')
+	redis.call('EXPIRE', KEYS[1], ARGV[3])
+	redis.call('EXPIRE', KEYS[3], ARGV[3])
+	redis.call('SETEX', KEYS[2], ARGV[4], '1')
+	redis.call('PUBLISH', KEYS[4], 1)
+	return 0
+end
+
+local data = ARGV[1]
+local accepted = string.len(data)
+local meta = redis.call('HMGET', KEYS[3], 'max_size', 'overflow', 'truncated')
+local max, overflow = tonumber(meta[1]), meta[2]
+if max and overflow == 'truncate' then
+	if meta[3] then
+		return accepted
+	end
+	if off + string.len(data) > max then
+		data = string.sub(data, 1, max - off) .. ARGV[5]
+		redis.call('HSET', KEYS[3], 'truncated', 1)
+	end
+elseif max and overflow ~= 'rolling' and off + string.len(data) > max then
+	accepted = math.max(max - off, 0)
+	data = string.sub(data, 1, accepted)
+end
+
+redis.call('XADD', KEYS[1], '*', 'off', off, 'data', data)
+redis.call('HSET', KEYS[3], 'written', ARGV[6])
+if max and overflow == 'rolling' then
+	local size = off + string.len(data)
+	while true do
+		local first = redis.call('XRANGE', KEYS[1], '-', '+', 'COUNT', 2)
+		if #first < 2 or size - tonumber(field(first[1], 'off')) <= max then
+			break
+		end
+		redis.call('XDEL', KEYS[1], first[1][1])
+	end
+end
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+redis.call('EXPIRE', KEYS[3], ARGV[3])
+redis.call('DEL', KEYS[2])
+redis.call('PUBLISH', KEYS[4], 1)
+return accepted
+`)
+
+	registerStreamScript = redis.NewScript(4, `
+if ARGV[2] ~= '1' and redis.call('EXISTS', KEYS[1], KEYS[2]) > 0 then
+	return 0
+end
+redis.call('DEL', KEYS[1], KEYS[2], KEYS[3])
+redis.call('XADD', KEYS[2], '*', 'off', 0, 'data', '')
+redis.call('EXPIRE', KEYS[2], ARGV[1])
+`+setMetaLua+`
+return 1
+`)
+
+	migrateScript = redis.NewScript(4, `
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	return 0
+end
+local t = redis.call('TYPE', KEYS[1])
+if (t.ok or t) ~= 'string' then
+	return 0
+end
+
+local data = redis.call('GET', KEYS[1])
+local ttl = redis.call('TTL', KEYS[1])
+local trim = tonumber(redis.call('HGET', KEYS[4], 'trim')) or 0
+redis.call('XADD', KEYS[2], '*', 'off', trim, 'data', '')
+if string.len(data) > 0 then
+	redis.call('XADD', KEYS[2], '*', 'off', trim, 'data', data)
+end
+if redis.call('EXISTS', KEYS[3]) == 1 then
+	redis.call('XADD', KEYS[2], '*', 'off', trim + string.len(data), 'data', '', 'eof', '1')
+end
+if ttl > 0 then
+	redis.call('EXPIRE', KEYS[2], ttl)
+end
+redis.call('HDEL', KEYS[4], 'trim')
+redis.call('DEL', KEYS[1])
+return 1
+`)
+)
+
+// RedisStreamBroker is a redis broker storing every write as an entry
+// of a redis stream (XADD), rather than appending them all to a single
+// string. Readers subscribe to the same pub/sub hubs, and share a
+// cache of the latest entries rather than of the latest bytes.
+// Requires redis 5.0 or later.
+//
+// Readers don't block on XREAD: each of them would hold a pooled
+// connection for as long as it waits, where the hubs multiplex every
+// subscriber over a few connections. Once notified, they fetch the new
+// entries with XRANGE, or from the shared cache.
+//
+// Streams created by RedisBroker are migrated on first access.
+type RedisStreamBroker struct {
+	*RedisBroker
+}
+
+// NewRedisStreamBroker creates a new redis streams broker instance
+func NewRedisStreamBroker(opts RedisOptions) (*RedisStreamBroker, error) {
+	b, err := newRedisBroker(opts, func(c channel, b *RedisBroker, size int) tail {
+		return newStreamTail(c, b, size)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &RedisStreamBroker{b}, nil
+}
+
+type streamEntry struct {
+	id     string
+	offset int64
+	data   []byte
+	eof    bool
+}
+
+// time returns the write time of the entry, carried by its ID
+func (e streamEntry) time() time.Time {
+	ms, _ := strconv.ParseInt(strings.SplitN(e.id, "-", 2)[0], 10, 64)
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+func (e streamEntry) end() int64 {
+	return e.offset + int64(len(e.data))
+}
+
+func parseEntries(reply interface{}, err error) ([]streamEntry, error) {
+	values, err := redis.Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]streamEntry, 0, len(values))
+	for _, v := range values {
+		entry, err := redis.Values(v, nil)
+		if err != nil || len(entry) != 2 {
+			return nil, fmt.Errorf("Unexpected stream entry: %v", v)
+		}
+
+		e := streamEntry{}
+		if e.id, err = redis.String(entry[0], nil); err != nil {
+			return nil, err
+		}
+
+		fields, err := redis.Values(entry[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i+1 < len(fields); i += 2 {
+			name, _ := redis.String(fields[i], nil)
+			switch name {
+			case "off":
+				e.offset, err = redis.Int64(fields[i+1], nil)
+			case "data":
+				e.data, err = redis.Bytes(fields[i+1], nil)
+			case "eof":
+				e.eof = true
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// compareIDs compares two entry IDs the way redis orders them,
+// returning -1, 0 or 1.
+func compareIDs(a, b string) int {
+	am, as := splitID(a)
+	bm, bs := splitID(b)
+	switch {
+	case am < bm || am == bm && as < bs:
+		return -1
+	case am == bm && as == bs:
+		return 0
+	}
+	return 1
+}
+
+func splitID(id string) (ms, seq uint64) {
+	parts := strings.SplitN(id, "-", 2)
+	ms, _ = strconv.ParseUint(parts[0], 10, 64)
+	if len(parts) == 2 {
+		seq, _ = strconv.ParseUint(parts[1], 10, 64)
+	}
+	return ms, seq
+}
+
+// nextID returns the smallest entry ID following id, for
+// iterating over XRANGE with exclusive starts.
+func nextID(id string) string {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return id
+	}
+	seq, _ := strconv.ParseUint(parts[1], 10, 64)
+	return parts[0] + "-" + strconv.FormatUint(seq+1, 10)
+}
+
+// prevID returns the largest entry ID preceding id, for
+// iterating over XREVRANGE with exclusive ends.
+func prevID(id string) string {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return id
+	}
+	ms, _ := strconv.ParseUint(parts[0], 10, 64)
+	seq, _ := strconv.ParseUint(parts[1], 10, 64)
+	if seq > 0 {
+		return parts[0] + "-" + strconv.FormatUint(seq-1, 10)
+	}
+	if ms == 0 {
+		return "0-0"
+	}
+	return strconv.FormatUint(ms-1, 10) + "-" + strconv.FormatUint(^uint64(0), 10)
+}
+
+// Register registers the new channel. Streams
+// stored by RedisBroker count as registered.
+func (b *RedisStreamBroker) Register(channelName string, opts *StreamOptions) error {
+	return b.register(channelName, opts, false)
+}
+
+// Reset registers the channel, wiping it if it exists
+func (b *RedisStreamBroker) Reset(channelName string, opts *StreamOptions) error {
+	return b.register(channelName, opts, true)
+}
+
+func (b *RedisStreamBroker) register(channelName string, opts *StreamOptions, reset bool) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	meta, err := metaArgs(opts)
+	if err != nil {
+		return err
+	}
+
+	channel := b.channel(channelName)
+	args := redis.Args{channel.id(), channel.logID(), channel.doneID(), channel.metaID(), b.channelExpire, reset}.Add(meta...)
+	created, err := redis.Bool(registerStreamScript.Do(conn, args...))
+	if err != nil {
+		util.CountWithData("RedisStreamBroker.Register.error", 1, "error=%s", err)
+		return err
+	}
+	if !created {
+		return ErrAlreadyRegistered
+	}
+	return nil
+}
+
+// IsRegistered checks whether a channel name is registered
+func (b *RedisStreamBroker) IsRegistered(channelName string) (bool, error) {
+	if err := b.Migrate(channelName); err != nil {
+		util.CountWithData("RedisStreamBroker.IsRegistered.error", 1, "error=%s", err)
+		return false, err
+	}
+
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	channel := b.channel(channelName)
+	exists, err := redis.Bool(conn.Do("EXISTS", channel.logID()))
+	if err != nil {
+		util.CountWithData("RedisStreamBroker.IsRegistered.error", 1, "error=%s", err)
+	}
+	return exists, err
+}
+
+// Migrate converts a stream stored by RedisBroker, as a single string,
+// to a redis stream. Streams already migrated are left untouched.
+func (b *RedisStreamBroker) Migrate(channelName string) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	channel := b.channel(channelName)
+	migrated, err := redis.Bool(migrateScript.Do(conn, channel.id(), channel.logID(), channel.doneID(), channel.metaID()))
+	if migrated {
+		util.Count("RedisStreamBroker.migrate")
+	}
+	return err
+}
+
+// MigrateAll converts every stream stored by RedisBroker,
+// returning the number of migrated streams.
+func (b *RedisStreamBroker) MigrateAll() (int, error) {
+	count := 0
+	err := b.scan("*:id", func(key string) error {
+		conn := b.pool.Get()
+		defer conn.Close()
+
+		channel := channel(strings.TrimSuffix(key, ":id"))
+		migrated, err := redis.Bool(migrateScript.Do(conn, channel.id(), channel.logID(), channel.doneID(), channel.metaID()))
+		if migrated {
+			count++
+		}
+		return err
+	})
+	return count, err
+}
+
+// NewWriter creates a new redis stream writer
+func (b *RedisStreamBroker) NewWriter(key string) (io.WriteCloser, error) {
+	r, err := b.IsRegistered(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if !r {
+		return nil, ErrNotRegistered
+	}
+
+	return &streamWriter{channel: b.channel(key), broker: b}, nil
+}
+
+// NewReader creates a new redis stream reader
+func (b *RedisStreamBroker) NewReader(key string) (io.ReadCloser, error) {
+	r, err := b.IsRegistered(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if !r {
+		return nil, ErrNotRegistered
+	}
+
+	channel := b.channel(key)
+	rd := &streamReader{
+		key:      key,
+		channel:  channel,
+		broker:   b,
+		listener: b.hub(key).subscribe(channel),
+		closed:   make(chan struct{}),
+	}
+	b.subscribed(channel, 1)
+	return rd, nil
+}
+
+// Get returns the full content of a channel
+func (b *RedisStreamBroker) Get(key string) ([]byte, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	entries, err := parseEntries(conn.Do("XRANGE", b.channel(key).logID(), "-", "+"))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf []byte
+	for _, e := range entries {
+		if e.offset == entries[0].offset+int64(len(buf)) {
+			buf = append(buf, e.data...)
+		}
+	}
+	return buf, nil
+}
+
+// Len returns the length of the data published to the channel
+func (b *RedisStreamBroker) Len(key string) (int64, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	entries, err := parseEntries(conn.Do("XREVRANGE", b.channel(key).logID(), "+", "-", "COUNT", 1))
+	if err != nil || len(entries) == 0 {
+		return 0, err
+	}
+	return entries[0].end(), nil
+}
+
+// Meta returns the metadata of a channel
+func (b *RedisStreamBroker) Meta(key string) (*StreamMeta, error) {
+	if err := b.Migrate(key); err != nil {
+		return nil, err
+	}
+
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	channel := b.channel(key)
+	conn.Send("MULTI")
+	conn.Send("HGETALL", channel.metaID())
+	conn.Send("XREVRANGE", channel.logID(), "+", "-", "COUNT", 1)
+	conn.Send("EXISTS", channel.doneID())
+	conn.Send("PTTL", channel.logID())
+	list, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := redis.StringMap(list[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := readMeta(fields, list[2], list[3])
+	if err != nil {
+		return nil, err
+	}
+	entries, err := parseEntries(list[1], nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		meta.Length = entries[0].end()
+	}
+	meta.LocalSubscribers = b.localSubscribers(channel)
+	return meta, nil
+}
+
+// TailOffset returns the offset the last lines of a channel start at
+func (b *RedisStreamBroker) TailOffset(key string, lines int) (int64, error) {
+	if err := b.Migrate(key); err != nil {
+		return 0, err
+	}
+
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	logID := b.channel(key).logID()
+	entries, err := parseEntries(conn.Do("XREVRANGE", logID, "+", "-", "COUNT", streamBatchSize))
+	if err != nil {
+		return 0, err
+	}
+	if len(entries) == 0 {
+		return 0, ErrNotRegistered
+	}
+
+	length := entries[0].end()
+	last := ""
+	return FindTail(lines, length, func() ([]byte, int64, error) {
+		for {
+			if len(entries) == 0 {
+				if last == "" || last == "0-0" {
+					return nil, 0, nil
+				}
+				// Fetch the batch preceding the last entry seen.
+				if entries, err = parseEntries(conn.Do("XREVRANGE", logID, prevID(last), "-", "COUNT", streamBatchSize)); err != nil {
+					return nil, 0, err
+				}
+				last = ""
+				if len(entries) == 0 {
+					return nil, 0, nil
+				}
+			}
+
+			e := entries[0]
+			entries = entries[1:]
+			if len(entries) == 0 {
+				last = e.id
+			}
+			if len(e.data) > 0 && !e.eof {
+				return e.data, e.offset, nil
+			}
+		}
+	})
+}
+
+// TimeOffset returns the offset of the content written since t,
+// as carried by the IDs of the log entries.
+func (b *RedisStreamBroker) TimeOffset(key string, t time.Time) (int64, error) {
+	if err := b.Migrate(key); err != nil {
+		return 0, err
+	}
+
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	logID := b.channel(key).logID()
+	entries, err := parseEntries(conn.Do("XRANGE", logID, unixMilli(t), "+", "COUNT", 1))
+	if err != nil {
+		return 0, err
+	}
+	if len(entries) > 0 {
+		return entries[0].offset, nil
+	}
+
+	entries, err = parseEntries(conn.Do("XREVRANGE", logID, "+", "-", "COUNT", 1))
+	if err != nil {
+		return 0, err
+	}
+	if len(entries) == 0 {
+		return 0, ErrNotRegistered
+	}
+	return entries[0].end(), nil
+}
+
+// List returns the keys of the channels. Streams stored by RedisBroker
+// are left out until migrated.
+func (b *RedisStreamBroker) List(cursor string, count int) ([]string, string, error) {
+	return b.list("*:log", cursor, count)
+}
+
+// RenewExpiry renews the channel expiration
+func (b *RedisStreamBroker) RenewExpiry(key string) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	channel := b.channel(key)
+	conn.Send("MULTI")
+	conn.Send("EXPIRE", channel.logID(), b.channelExpire)
+	conn.Send("EXPIRE", channel.metaID(), b.channelExpire)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+type streamWriter struct {
+	channel channel
+	broker  *RedisStreamBroker
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	conn := w.broker.pool.Get()
+	defer conn.Close()
+
+	n, err := redis.Int(appendScript.Do(conn, w.channel.logID(), w.channel.doneID(), w.channel.metaID(), w.channel.id(),
+		p, 0, w.broker.channelExpire, w.broker.channelExpire, TruncatedMarker, unixMilli(time.Now())))
+	if err != nil {
+		return 0, err
+	}
+	if n < len(p) {
+		return n, ErrTooLarge
+	}
+	return n, nil
+}
+
+func (w *streamWriter) Close() error {
+	conn := w.broker.pool.Get()
+	defer conn.Close()
+
+	_, err := appendScript.Do(conn, w.channel.logID(), w.channel.doneID(), w.channel.metaID(), w.channel.id(),
+		"", 1, w.broker.keyExpire, w.broker.channelExpire, TruncatedMarker, unixMilli(time.Now()))
+	return err
+}
+
+type streamReader struct {
+	key     string
+	channel channel
+	broker  *RedisStreamBroker
+	offset  int64
+	lastID  string // ID of the last consumed entry, empty until located
+	pending []byte // content read from redis but not yet returned
+	marks   []writeMark
+	eof     bool
+	behind  bool // whether the last fetch left entries to fetch
+
+	listener  *listener
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (r *streamReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	default:
+		return 0, errWhence
+	case 0:
+		r.offset = offset
+	case 1:
+		r.offset += offset
+	}
+	if offset < 0 {
+		return 0, errOffset
+	}
+
+	r.lastID = ""
+	r.pending = nil
+	r.marks = nil
+	r.eof = false
+	return r.offset, nil
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for {
+		if len(r.pending) > 0 {
+			// Only the times of what's returned next may be asked.
+			r.marks = pruneMarks(r.marks, r.offset)
+			n := copy(p, r.pending)
+			r.pending = r.pending[n:]
+			r.offset += int64(n)
+			return n, nil
+		}
+
+		if r.eof || r.isClosed() {
+			return 0, io.EOF
+		}
+
+		var err error
+		if r.lastID == "" {
+			err = r.locate()
+		} else {
+			err = r.wait()
+		}
+
+		if err != nil {
+			if r.isClosed() {
+				return 0, io.EOF
+			}
+			util.CountWithData("RedisStreamBroker.reader.error", 1, "err=%s", err)
+			return 0, err
+		}
+	}
+}
+
+// locate replays the log up to the current offset,
+// buffering the content found past it.
+func (r *streamReader) locate() error {
+	conn := r.broker.pool.Get()
+	defer conn.Close()
+
+	start := "-"
+	for {
+		entries, err := parseEntries(conn.Do("XRANGE", r.channel.logID(), start, "+", "COUNT", streamBatchSize))
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			if r.lastID == "" {
+				r.lastID = "0-0"
+			}
+			return nil
+		}
+
+		if err := r.consume(entries); err != nil {
+			return err
+		}
+		if len(r.pending) > 0 || r.eof {
+			return nil
+		}
+		start = nextID(r.lastID)
+	}
+}
+
+// wait blocks until something gets published to the stream, then
+// buffers the entries appended past the last one consumed.
+func (r *streamReader) wait() error {
+	if !r.behind {
+		select {
+		case <-r.listener.C:
+		case <-r.closed:
+			return nil
+		case <-time.After(streamBlockTimeout):
+			// Make sure the stream didn't expire meanwhile.
+			return r.checkRegistered()
+		}
+	}
+
+	entries, err := r.next()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		// Woken up by a deletion, or by the hub reconnecting.
+		return r.checkRegistered()
+	}
+	return r.consume(entries)
+}
+
+// next returns the entries appended past the last one consumed, from
+// the tail cache when it holds them, and from redis otherwise.
+func (r *streamReader) next() ([]streamEntry, error) {
+	if tail, ok := r.listener.sub.tail.(*streamTail); ok {
+		entries, ok, err := tail.entriesAfter(r.lastID)
+		if ok || err != nil {
+			r.behind = false
+			return entries, err
+		}
+	}
+
+	conn := r.broker.pool.Get()
+	defer conn.Close()
+
+	entries, err := parseEntries(conn.Do("XRANGE", r.channel.logID(), nextID(r.lastID), "+", "COUNT", streamBatchSize))
+	r.behind = len(entries) == streamBatchSize
+	return entries, err
+}
+
+// checkRegistered ends the reads once the stream expired or got deleted.
+func (r *streamReader) checkRegistered() error {
+	registered, err := r.broker.IsRegistered(r.key)
+	if err == nil && !registered {
+		r.eof = true
+	}
+	return err
+}
+
+// consume buffers the content of the entries found past the offset.
+func (r *streamReader) consume(entries []streamEntry) error {
+	for _, e := range entries {
+		r.lastID = e.id
+
+		if e.eof {
+			// Publishers may reopen a closed stream by writing again,
+			// so only stop if the stream is still done.
+			done, err := r.broker.IsDone(r.key)
+			if err != nil {
+				return err
+			}
+			r.eof = done
+			continue
+		}
+
+		pos := r.offset + int64(len(r.pending))
+		if e.end() <= pos {
+			continue
+		}
+		if e.offset > pos && len(r.pending) == 0 {
+			// The content before this entry isn't available anymore.
+			r.offset, pos = e.offset, e.offset
+		}
+		r.pending = append(r.pending, e.data[pos-e.offset:]...)
+		r.marks = append(r.marks, writeMark{pos, e.time()})
+	}
+	return nil
+}
+
+// WriteTime returns when the content at offset got written,
+// as carried by the ID of the entry holding it.
+func (r *streamReader) WriteTime(offset int64) time.Time {
+	r.marks = pruneMarks(r.marks, offset)
+	return writeTime(r.marks, offset)
+}
+
+func (r *streamReader) isClosed() bool {
+	select {
+	case <-r.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *streamReader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		r.broker.hub(r.key).unsubscribe(r.listener)
+		r.broker.subscribed(r.channel, -1)
+	})
+	return nil
+}
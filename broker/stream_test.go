@@ -0,0 +1,285 @@
+package broker
+
+import (
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func testStreamBroker(t *testing.T) *RedisStreamBroker {
+	if streamBroker == nil {
+		t.Skip("REDIS_URL is required")
+	}
+	return streamBroker
+}
+
+func newStream(t *testing.T) (*RedisStreamBroker, string) {
+	b := testStreamBroker(t)
+	uuid, _ := util.NewUUID()
+	assert.Nil(t, b.Register(uuid, nil))
+	return b, uuid
+}
+
+func TestStreamReadWrite(t *testing.T) {
+	b, uuid := newStream(t)
+
+	r, err := b.NewReader(uuid)
+	assert.Nil(t, err)
+	defer r.Close()
+
+	done := make(chan string)
+	go func() {
+		buf, _ := ioutil.ReadAll(r)
+		done <- string(buf)
+	}()
+
+	w, err := b.NewWriter(uuid)
+	assert.Nil(t, err)
+	w.Write([]byte("busl"))
+	w.Write([]byte(" hello"))
+	w.Close()
+
+	assert.Equal(t, "busl hello", <-done)
+
+	l, _ := b.Len(uuid)
+	assert.Equal(t, int64(10), l)
+	buf, _ := b.Get(uuid)
+	assert.Equal(t, "busl hello", string(buf))
+	isDone, _ := b.IsDone(uuid)
+	assert.True(t, isDone)
+}
+
+func TestStreamSeek(t *testing.T) {
+	b, uuid := newStream(t)
+
+	w, _ := b.NewWriter(uuid)
+	w.Write([]byte("busl"))
+	w.Write([]byte(" hello"))
+	w.Write([]byte(" world"))
+	w.Close()
+
+	r, _ := b.NewReader(uuid)
+	defer r.Close()
+	r.(io.Seeker).Seek(6, 0)
+
+	buf, _ := ioutil.ReadAll(r)
+	assert.Equal(t, "ello world", string(buf))
+}
+
+func TestStreamSmallReads(t *testing.T) {
+	b, uuid := newStream(t)
+
+	w, _ := b.NewWriter(uuid)
+	w.Write([]byte("hello world"))
+	w.Close()
+
+	r, _ := b.NewReader(uuid)
+	defer r.Close()
+
+	p := make([]byte, 4)
+	n, _ := r.Read(p)
+	assert.Equal(t, "hell", string(p[:n]))
+	n, _ = r.Read(p)
+	assert.Equal(t, "o wo", string(p[:n]))
+}
+
+func TestStreamReopen(t *testing.T) {
+	b, uuid := newStream(t)
+
+	w, _ := b.NewWriter(uuid)
+	w.Write([]byte("hello"))
+	w.Close()
+	w.Write([]byte(" world"))
+
+	isDone, _ := b.IsDone(uuid)
+	assert.False(t, isDone)
+
+	r, _ := b.NewReader(uuid)
+	defer r.Close()
+
+	p := make([]byte, 16)
+	n, err := r.Read(p)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", string(p[:n]))
+}
+
+func TestStreamCloseUnblocksReader(t *testing.T) {
+	b, uuid := newStream(t)
+
+	r, _ := b.NewReader(uuid)
+	done := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 4))
+		done <- err
+	}()
+
+	r.Close()
+	assert.Equal(t, io.EOF, <-done)
+}
+
+func TestStreamReadersShareSubscription(t *testing.T) {
+	b, uuid := newStream(t)
+	h := b.hub(uuid)
+
+	w, _ := b.NewWriter(uuid)
+	w.Write([]byte("busl"))
+
+	done := make(chan string)
+	for i := 0; i < 5; i++ {
+		r, _ := b.NewReader(uuid)
+		go func() {
+			buf, _ := ioutil.ReadAll(r)
+			r.Close()
+			done <- string(buf)
+		}()
+	}
+
+	h.mutex.Lock()
+	assert.Equal(t, 5, len(h.subs[channel(uuid).id()].listeners))
+	h.mutex.Unlock()
+
+	w.Write([]byte(" hello"))
+	w.Close()
+
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, "busl hello", <-done)
+	}
+	assert.True(t, atomic.LoadInt64(&b.tailStats.hits) > 0)
+
+	h.mutex.Lock()
+	assert.Nil(t, h.subs[channel(uuid).id()])
+	h.mutex.Unlock()
+}
+
+func TestStreamDeleteEndsReaders(t *testing.T) {
+	b, uuid := newStream(t)
+
+	r, _ := b.NewReader(uuid)
+	defer r.Close()
+	w, _ := b.NewWriter(uuid)
+	w.Write([]byte("busl"))
+
+	done := make(chan string)
+	go func() {
+		buf, _ := ioutil.ReadAll(r)
+		done <- string(buf)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, b.Delete(uuid))
+	select {
+	case buf := <-done:
+		assert.Equal(t, "busl", buf)
+	case <-time.After(5 * time.Second):
+		t.Fatal("reader never ended")
+	}
+}
+
+func TestStreamTailKeepsLatestEntries(t *testing.T) {
+	b, uuid := newStream(t)
+
+	w, _ := b.NewWriter(uuid)
+	for _, s := range []string{"busl", " hello", " world"} {
+		w.Write([]byte(s))
+	}
+
+	tail := newStreamTail(b.channel(uuid), b.RedisBroker, 12)
+	entries, ok, err := tail.entriesAfter("0-0")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Len(t, tail.entries, 2)
+	assert.Equal(t, 12, tail.held)
+
+	entries, ok, err = tail.entriesAfter(tail.after)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, " hello", string(entries[0].data))
+		assert.Equal(t, " world", string(entries[1].data))
+	}
+
+	w.Close()
+	tail.invalidate()
+	entries, ok, _ = tail.entriesAfter(tail.last)
+	assert.True(t, ok)
+	if assert.Len(t, entries, 1) {
+		assert.True(t, entries[0].eof)
+	}
+}
+
+func TestStreamMigrate(t *testing.T) {
+	b := testStreamBroker(t)
+	uuid := setup()
+
+	w, _ := b.RedisBroker.NewWriter(uuid)
+	w.Write([]byte("busl hello"))
+	w.Close()
+
+	registered, err := b.IsRegistered(uuid)
+	assert.Nil(t, err)
+	assert.True(t, registered)
+
+	buf, _ := b.Get(uuid)
+	assert.Equal(t, "busl hello", string(buf))
+
+	r, _ := b.NewReader(uuid)
+	defer r.Close()
+	buf, _ = ioutil.ReadAll(r)
+	assert.Equal(t, "busl hello", string(buf))
+
+	exists, _ := b.RedisBroker.IsRegistered(uuid)
+	assert.False(t, exists)
+}
+
+func TestStreamMigrateAll(t *testing.T) {
+	b := testStreamBroker(t)
+	uuid := setup()
+
+	w, _ := b.RedisBroker.NewWriter(uuid)
+	w.Write([]byte("hello"))
+
+	n, err := b.MigrateAll()
+	assert.Nil(t, err)
+	assert.True(t, n > 0)
+
+	l, _ := b.Len(uuid)
+	assert.Equal(t, int64(5), l)
+	isDone, _ := b.IsDone(uuid)
+	assert.False(t, isDone)
+}
+
+func TestStreamOverflow(t *testing.T) {
+	b := testStreamBroker(t)
+	testOverflowReject(t, b)
+	testOverflowTruncate(t, b)
+	testOverflowRolling(t, b)
+}
+
+func TestStreamMeta(t *testing.T) {
+	testMeta(t, testStreamBroker(t))
+}
+
+func TestStreamRegisterExisting(t *testing.T) {
+	testRegisterExisting(t, testStreamBroker(t))
+}
+
+func TestStreamListDelete(t *testing.T) {
+	testListDelete(t, testStreamBroker(t))
+}
+
+func TestStreamTailOffset(t *testing.T) {
+	testTailOffset(t, testStreamBroker(t))
+}
+
+func TestStreamTimeOffset(t *testing.T) {
+	testTimeOffset(t, testStreamBroker(t))
+}
+
+func TestStreamWriteTime(t *testing.T) {
+	testWriteTime(t, testStreamBroker(t))
+}
@@ -0,0 +1,119 @@
+package broker
+
+import (
+	"sort"
+	"sync"
+)
+
+// streamTail holds the most recent entries of a redis stream, shared by
+// all the local readers of that stream. It's the streams layout
+// counterpart of tailCache: readers caught up near the head get the
+// entries following the last one they consumed from memory, and a
+// single fetch per publish refreshes the cache for all of them.
+type streamTail struct {
+	channel channel
+	broker  *RedisBroker
+	size    int // bytes of content kept, on top of the newest entry
+
+	mutex   sync.Mutex
+	entries []streamEntry
+	after   string // ID of the entry preceding the cached ones
+	last    string // ID of the newest entry seen
+	end     int64  // offset right after the newest entry seen
+	held    int    // bytes of content held by the entries
+	loaded  bool
+	stale   bool // whether something got published since the last refresh
+}
+
+func newStreamTail(c channel, b *RedisBroker, size int) *streamTail {
+	return &streamTail{channel: c, broker: b, size: size, stale: true}
+}
+
+// invalidate marks the cache as needing a refresh on the next read.
+func (t *streamTail) invalidate() {
+	t.mutex.Lock()
+	t.stale = true
+	t.mutex.Unlock()
+}
+
+// entriesAfter returns the cached entries following the one with the
+// given ID. It returns false if the entries following it aren't all
+// cached anymore, in which case the caller has to fetch them from redis.
+func (t *streamTail) entriesAfter(id string) ([]streamEntry, bool, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.stale {
+		if err := t.refresh(); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if compareIDs(id, t.after) < 0 {
+		t.broker.tailStats.miss()
+		return nil, false, nil
+	}
+	t.broker.tailStats.hit()
+
+	i := sort.Search(len(t.entries), func(i int) bool {
+		return compareIDs(t.entries[i].id, id) > 0
+	})
+	// Refreshes append past the length returned, never within it.
+	return t.entries[i:len(t.entries):len(t.entries)], true, nil
+}
+
+// refresh fetches the entries appended since the last refresh. When
+// lagging by more than a batch, or when the stream got recreated, it
+// reloads the last batch instead. The caller must hold the mutex.
+func (t *streamTail) refresh() error {
+	conn := t.broker.pool.Get()
+	defer conn.Close()
+
+	if t.loaded {
+		entries, err := parseEntries(conn.Do("XRANGE", t.channel.logID(), nextID(t.last), "+", "COUNT", streamBatchSize))
+		if err != nil {
+			return err
+		}
+		if len(entries) < streamBatchSize && (len(entries) == 0 || entries[0].offset >= t.end) {
+			t.append(entries)
+			t.stale = false
+			return nil
+		}
+	}
+
+	entries, err := parseEntries(conn.Do("XREVRANGE", t.channel.logID(), "+", "-", "COUNT", streamBatchSize))
+	if err != nil {
+		return err
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+
+	t.entries, t.held = nil, 0
+	t.after, t.last, t.end = "0-0", "0-0", 0
+	if len(entries) == streamBatchSize {
+		t.after = prevID(entries[0].id)
+	}
+	t.append(entries)
+	t.loaded = true
+	t.stale = false
+	return nil
+}
+
+// append adds the entries to the cache, dropping the oldest ones once
+// it holds more than size bytes. The caller must hold the mutex.
+func (t *streamTail) append(entries []streamEntry) {
+	for _, e := range entries {
+		t.entries = append(t.entries, e)
+		t.held += len(e.data)
+		t.last, t.end = e.id, e.end()
+	}
+
+	drop := 0
+	for drop < len(t.entries)-1 && t.held > t.size {
+		t.held -= len(t.entries[drop].data)
+		t.after = t.entries[drop].id
+		drop++
+	}
+	t.entries = t.entries[drop:]
+}
@@ -0,0 +1,168 @@
+package broker
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/heroku/busl/util"
+)
+
+const tailStatsInterval = 10 * time.Second
+
+// tailCache holds the most recently published content of a stream in
+// a ring buffer shared by all the local readers of that stream. Readers
+// caught up near the head are served from memory, and a single fetch
+// per publish refreshes the cache for all of them.
+type tailCache struct {
+	channel channel
+	broker  *RedisBroker
+
+	mutex  sync.Mutex
+	ring   []byte
+	start  int64 // offset of the oldest cached byte
+	end    int64 // offset right after the newest cached byte
+	done   bool
+	loaded bool
+	stale  bool // whether something got published since the last refresh
+}
+
+func newTailCache(c channel, b *RedisBroker, size int) *tailCache {
+	return &tailCache{channel: c, broker: b, ring: make([]byte, size), stale: true}
+}
+
+// invalidate marks the cache as needing a refresh on the next read.
+func (c *tailCache) invalidate() {
+	c.mutex.Lock()
+	c.stale = true
+	c.mutex.Unlock()
+}
+
+// readAt copies the content found at offset into p. It returns false if
+// offset isn't cached anymore, in which case the caller has to fetch
+// it from redis. more reports whether there's cached content past
+// what was copied, and err is io.EOF once the stream is done and
+// fully read.
+func (c *tailCache) readAt(p []byte, offset int64) (n int, more bool, ok bool, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.stale {
+		if err = c.refresh(); err != nil {
+			return 0, false, false, err
+		}
+	}
+
+	if offset < c.start || offset > c.end {
+		c.broker.tailStats.miss()
+		return 0, false, false, nil
+	}
+	c.broker.tailStats.hit()
+
+	for n < len(p) && offset+int64(n) < c.end {
+		i := int((offset + int64(n)) % int64(len(c.ring)))
+		j := len(c.ring)
+		if rest := int(c.end - offset - int64(n)); i+rest < j {
+			j = i + rest
+		}
+		n += copy(p[n:], c.ring[i:j])
+	}
+
+	if more = offset+int64(n) < c.end; !more && c.done {
+		err = io.EOF
+	}
+	return n, more, true, err
+}
+
+// refresh fetches whatever got published since the last refresh, up
+// to the last len(ring) bytes of the stream, which is all the first
+// refresh loads. The caller must hold the mutex.
+func (c *tailCache) refresh() error {
+	conn := c.broker.pool.Get()
+	defer conn.Close()
+
+	start := c.end
+	if !c.loaded {
+		start = -int64(len(c.ring))
+	}
+
+	data, from, size, done, err := readRange(conn, c.channel, start, -len(c.ring), c.broker.channelExpire)
+	if err != nil {
+		return err
+	}
+
+	if !c.loaded || from != c.end {
+		// Either the first load, the stream got recreated under our
+		// feet, or rolled past what we hold: start over from what we
+		// just fetched.
+		if c.loaded && size < c.end {
+			c.loaded = false
+			return c.refresh()
+		}
+		c.start = from
+		c.end = c.start
+		c.loaded = true
+	}
+
+	c.append(data)
+	c.done = done
+	c.stale = false
+	return nil
+}
+
+// append writes p at the end of the ring, dropping the oldest
+// bytes once it's full. The caller must hold the mutex.
+func (c *tailCache) append(p []byte) {
+	size := int64(len(c.ring))
+	if int64(len(p)) > size {
+		c.end += int64(len(p)) - size
+		p = p[int64(len(p))-size:]
+	}
+
+	for len(p) > 0 {
+		i := int(c.end % size)
+		n := copy(c.ring[i:], p)
+		p = p[n:]
+		c.end += int64(n)
+	}
+
+	if c.end-c.start > size {
+		c.start = c.end - size
+	}
+}
+
+// tailStats aggregates the cache hits and misses, since reporting
+// each of them would mean a log line per read.
+type tailStats struct {
+	hits   int64
+	misses int64
+}
+
+func (s *tailStats) hit()  { atomic.AddInt64(&s.hits, 1) }
+func (s *tailStats) miss() { atomic.AddInt64(&s.misses, 1) }
+
+func (s *tailStats) report() {
+	if n := atomic.SwapInt64(&s.hits, 0); n > 0 {
+		util.CountMany("RedisBroker.tailCache.hit", n)
+	}
+	if n := atomic.SwapInt64(&s.misses, 0); n > 0 {
+		util.CountMany("RedisBroker.tailCache.miss", n)
+	}
+}
+
+// reportEvery reports the stats at every interval until done is closed.
+func (s *tailStats) reportEvery(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.report()
+		case <-done:
+			s.report()
+			return
+		}
+	}
+}
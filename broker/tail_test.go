@@ -0,0 +1,118 @@
+package broker
+
+import (
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newLoadedTailCache(size int) *tailCache {
+	c := newTailCache(channel("tail"), &RedisBroker{}, size)
+	c.loaded = true
+	c.stale = false
+	return c
+}
+
+func TestTailCacheWraps(t *testing.T) {
+	c := newLoadedTailCache(8)
+	c.append([]byte("hello"))
+	c.append([]byte("world"))
+
+	assert.Equal(t, int64(2), c.start)
+	assert.Equal(t, int64(10), c.end)
+
+	p := make([]byte, 16)
+	n, more, ok, err := c.readAt(p, 2)
+	assert.True(t, ok)
+	assert.False(t, more)
+	assert.Nil(t, err)
+	assert.Equal(t, "lloworld", string(p[:n]))
+
+	n, more, ok, _ = c.readAt(p[:3], 5)
+	assert.True(t, ok)
+	assert.True(t, more)
+	assert.Equal(t, "wor", string(p[:n]))
+}
+
+func TestTailCacheMiss(t *testing.T) {
+	c := newLoadedTailCache(4)
+	c.append([]byte("hello world"))
+
+	_, _, ok, _ := c.readAt(make([]byte, 4), 3)
+	assert.False(t, ok)
+	_, _, ok, _ = c.readAt(make([]byte, 4), 12)
+	assert.False(t, ok)
+
+	assert.Equal(t, int64(2), c.broker.tailStats.misses)
+}
+
+func TestTailCacheDone(t *testing.T) {
+	c := newLoadedTailCache(16)
+	c.append([]byte("hello"))
+	c.done = true
+
+	p := make([]byte, 16)
+	n, _, ok, err := c.readAt(p, 0)
+	assert.True(t, ok)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "hello", string(p[:n]))
+}
+
+func TestTailCacheSharedByReaders(t *testing.T) {
+	b := testRedisBroker(t)
+	uuid := setup()
+
+	w, _ := b.NewWriter(uuid)
+	w.Write([]byte("busl"))
+
+	done := make(chan string)
+	for i := 0; i < 5; i++ {
+		r, _ := b.NewReader(uuid)
+		go func() {
+			defer r.Close()
+			buf, _ := ioutil.ReadAll(r)
+			done <- string(buf)
+		}()
+	}
+
+	w.Write([]byte(" hello"))
+	w.Close()
+
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, "busl hello", <-done)
+	}
+	assert.True(t, atomic.LoadInt64(&b.tailStats.hits) > 0)
+}
+
+func TestTailCacheRefreshSkipsGaps(t *testing.T) {
+	b := testRedisBroker(t)
+	uuid := setup()
+
+	w, _ := b.NewWriter(uuid)
+	w.Write([]byte("hello"))
+
+	c := newTailCache(b.channel(uuid), b, 4)
+	assert.Nil(t, c.refresh())
+	assert.Equal(t, int64(1), c.start)
+	assert.Equal(t, int64(5), c.end)
+
+	w.Write([]byte(" world"))
+	c.stale = true
+	assert.Nil(t, c.refresh())
+	assert.Equal(t, int64(7), c.start)
+	assert.Equal(t, int64(11), c.end)
+
+	p := make([]byte, 8)
+	n, _, ok, _ := c.readAt(p, 7)
+	assert.True(t, ok)
+	assert.Equal(t, "orld", string(p[:n]))
+
+	w.Write([]byte("!"))
+	c.stale = true
+	n, _, ok, _ = c.readAt(p, 8)
+	assert.True(t, ok)
+	assert.Equal(t, "rld!", string(p[:n]))
+}
@@ -0,0 +1,113 @@
+package broker
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/heroku/busl/tracing"
+)
+
+// traced records a span for every call to the broker
+type traced struct {
+	Broker
+	ctx context.Context
+}
+
+// Traced returns b, recording its calls as children of the span of
+// ctx. Brokers are returned as is when the span isn't sampled. The
+// readers and writers returned aren't traced, as they live as long
+// as the streams.
+func Traced(ctx context.Context, b Broker) Broker {
+	if !tracing.SpanContextFrom(ctx).Sampled {
+		return b
+	}
+	return &traced{Broker: b, ctx: ctx}
+}
+
+func (t *traced) start(op, key string) *tracing.Span {
+	_, span := tracing.Start(t.ctx, "broker."+op, tracing.KindInternal)
+	if key != "" {
+		span.SetAttribute("busl.stream", key)
+	}
+	return span
+}
+
+// endSpan ends the span, failed unless err is nil or tells about the
+// state of the stream.
+func endSpan(span *tracing.Span, err error) {
+	if err != ErrNotRegistered && err != ErrAlreadyRegistered {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+func (t *traced) Register(key string, opts *StreamOptions) (err error) {
+	defer func(span *tracing.Span) { endSpan(span, err) }(t.start("Register", key))
+	return t.Broker.Register(key, opts)
+}
+
+func (t *traced) Reset(key string, opts *StreamOptions) (err error) {
+	defer func(span *tracing.Span) { endSpan(span, err) }(t.start("Reset", key))
+	return t.Broker.Reset(key, opts)
+}
+
+func (t *traced) IsRegistered(key string) (ok bool, err error) {
+	defer func(span *tracing.Span) { endSpan(span, err) }(t.start("IsRegistered", key))
+	return t.Broker.IsRegistered(key)
+}
+
+func (t *traced) NewWriter(key string) (w io.WriteCloser, err error) {
+	defer func(span *tracing.Span) { endSpan(span, err) }(t.start("NewWriter", key))
+	return t.Broker.NewWriter(key)
+}
+
+func (t *traced) NewReader(key string) (rd io.ReadCloser, err error) {
+	defer func(span *tracing.Span) { endSpan(span, err) }(t.start("NewReader", key))
+	return t.Broker.NewReader(key)
+}
+
+func (t *traced) Get(key string) (buf []byte, err error) {
+	defer func(span *tracing.Span) { endSpan(span, err) }(t.start("Get", key))
+	return t.Broker.Get(key)
+}
+
+func (t *traced) Len(key string) (n int64, err error) {
+	defer func(span *tracing.Span) { endSpan(span, err) }(t.start("Len", key))
+	return t.Broker.Len(key)
+}
+
+func (t *traced) IsDone(key string) (done bool, err error) {
+	defer func(span *tracing.Span) { endSpan(span, err) }(t.start("IsDone", key))
+	return t.Broker.IsDone(key)
+}
+
+func (t *traced) RenewExpiry(key string) (err error) {
+	defer func(span *tracing.Span) { endSpan(span, err) }(t.start("RenewExpiry", key))
+	return t.Broker.RenewExpiry(key)
+}
+
+func (t *traced) Meta(key string) (meta *StreamMeta, err error) {
+	defer func(span *tracing.Span) { endSpan(span, err) }(t.start("Meta", key))
+	return t.Broker.Meta(key)
+}
+
+func (t *traced) Delete(key string) (err error) {
+	defer func(span *tracing.Span) { endSpan(span, err) }(t.start("Delete", key))
+	return t.Broker.Delete(key)
+}
+
+func (t *traced) List(cursor string, count int) (keys []string, next string, err error) {
+	defer func(span *tracing.Span) { endSpan(span, err) }(t.start("List", ""))
+	return t.Broker.List(cursor, count)
+}
+
+func (t *traced) TailOffset(key string, lines int) (o int64, err error) {
+	defer func(span *tracing.Span) { endSpan(span, err) }(t.start("TailOffset", key))
+	return t.Broker.TailOffset(key, lines)
+}
+
+func (t *traced) TimeOffset(key string, at time.Time) (o int64, err error) {
+	defer func(span *tracing.Span) { endSpan(span, err) }(t.start("TimeOffset", key))
+	return t.Broker.TimeOffset(key, at)
+}
@@ -0,0 +1,71 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/heroku/busl/tracing"
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+type exportedSpan struct {
+	Name         string
+	TraceID      string
+	ParentSpanID string
+	Status       *struct{ Message string }
+}
+
+func TestTraced(t *testing.T) {
+	var buf bytes.Buffer
+	tracing.SetExporter("test", &tracing.ConsoleExporter{W: &buf})
+	ctx, span := tracing.Start(context.Background(), "request", tracing.KindServer)
+
+	mb := NewMemoryBroker()
+	b := Traced(ctx, mb)
+	uuid, _ := util.NewUUID()
+	assert.Nil(t, b.Register(uuid, nil))
+	assert.Equal(t, ErrAlreadyRegistered, b.Register(uuid, nil))
+	_, err := b.Meta("missing")
+	assert.Equal(t, ErrNotRegistered, err)
+
+	w, err := b.NewWriter(uuid)
+	assert.Nil(t, err)
+	w.Write([]byte("hello"))
+	w.Close()
+
+	rd, err := b.NewReader(uuid)
+	assert.Nil(t, err)
+	_, ok := rd.(io.Seeker)
+	assert.True(t, ok, "readers aren't wrapped")
+	rd.Close()
+
+	span.End()
+	tracing.Shutdown()
+
+	var names []string
+	dec := json.NewDecoder(&buf)
+	for {
+		var s exportedSpan
+		if dec.Decode(&s) != nil {
+			break
+		}
+		names = append(names, s.Name)
+		assert.Equal(t, span.Context().Traceparent()[3:35], s.TraceID)
+		if s.Name != "request" {
+			assert.Equal(t, span.Context().Traceparent()[36:52], s.ParentSpanID)
+		}
+		assert.Nil(t, s.Status, "%s isn't failed", s.Name)
+	}
+	assert.Equal(t, []string{"broker.Register", "broker.Register", "broker.Meta", "broker.NewWriter", "broker.NewReader", "request"}, names)
+}
+
+func TestTracedUnsampled(t *testing.T) {
+	mb := NewMemoryBroker()
+	ctx, _ := tracing.Start(context.Background(), "request", tracing.KindServer)
+	assert.Equal(t, Broker(mb), Traced(ctx, mb))
+	assert.Equal(t, Broker(mb), Traced(context.Background(), mb))
+}
@@ -1,7 +1,9 @@
 package busltee
 
 import (
+	"context"
 	"crypto/tls"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
@@ -12,6 +14,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/heroku/busl/tracing"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -27,6 +30,7 @@ type Config struct {
 	Args          []string
 	LogFile       string
 	RequestID     string
+	Traceparent   string // of the trace the POST continues, if set
 	Verbose       bool
 }
 
@@ -102,6 +106,13 @@ func streamNoRetry(url string, stdin io.Reader, conf *Config) error {
 		return errMissingURL
 	}
 
+	ctx := context.Background()
+	if sc, ok := tracing.ParseTraceparent(conf.Traceparent); ok {
+		ctx = tracing.WithRemote(ctx, sc)
+	}
+	ctx, span := tracing.Start(ctx, "busltee POST", tracing.KindClient)
+	defer span.End()
+
 	client := &http.Client{Transport: newTransport(conf)}
 
 	// In the event that the `busl` connection doesn't work,
@@ -110,18 +121,24 @@ func streamNoRetry(url string, stdin io.Reader, conf *Config) error {
 	// it from being closed prematurely (and thus allowing writes
 	// on the other end of the pipe to work).
 	req, err := http.NewRequest("POST", url, ioutil.NopCloser(stdin))
-	if conf.RequestID != "" {
-		req.Header.Set("Request-Id", conf.RequestID)
-	}
-
 	if err != nil {
+		span.RecordError(err)
 		return err
 	}
+	if conf.RequestID != "" {
+		req.Header.Set("Request-Id", conf.RequestID)
+	}
+	tracing.Inject(ctx, req.Header)
 
 	res, err := client.Do(req)
 	if res != nil {
 		defer res.Body.Close()
+		span.SetAttribute("http.status_code", res.StatusCode)
+		if res.StatusCode >= 500 {
+			span.RecordError(fmt.Errorf("HTTP %d", res.StatusCode))
+		}
 	}
+	span.RecordError(err)
 	return err
 }
 
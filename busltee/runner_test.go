@@ -181,3 +181,26 @@ func fauxBusl() (*httptest.Server, chan []byte) {
 	server := httptest.NewServer(mux)
 	return server, post
 }
+
+func TestStreamTraceparent(t *testing.T) {
+	traceparent := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent <- r.Header.Get("Traceparent")
+	}))
+	defer server.Close()
+
+	parent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	if err := streamNoRetry(server.URL, strings.NewReader(""), &Config{Traceparent: parent}); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-traceparent; got[:36] != parent[:36] || got == parent {
+		t.Fatalf("Expected the trace of %s to continue, got %s", parent, got)
+	}
+
+	if err := streamNoRetry(server.URL, strings.NewReader(""), &Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-traceparent; len(got) != len(parent) {
+		t.Fatalf("Expected a new trace, got %q", got)
+	}
+}
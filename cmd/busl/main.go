@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -13,7 +15,11 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/heroku/busl/auth"
+	"github.com/heroku/busl/broker"
 	"github.com/heroku/busl/server"
+	"github.com/heroku/busl/tracing"
+	"github.com/heroku/busl/util"
 	"github.com/heroku/rollbar"
 )
 
@@ -23,6 +29,21 @@ type cmdConfig struct {
 	RollbarEnvironment string
 	RollbarToken       string
 
+	Broker             string
+	Redis              broker.RedisOptions
+	RedisTLSSkipVerify bool
+	RedisSentinelAddrs string
+	RedisLayout        string
+	RedisMigrate       bool
+	StreamOverflow     string
+
+	TokenSecret       string
+	Auth              auth.Options
+	CORSOrigins       string
+	CORSExposeHeaders string
+	Metrics           string
+	PublicMetrics     bool
+
 	HTTPPort         string
 	HTTPReadTimeout  time.Duration
 	HTTPWriteTimeout time.Duration
@@ -35,6 +56,17 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := tracing.FromEnv("busl"); err != nil {
+		log.Printf("%s: unable to setup tracing: %v\n", os.Args[0], err)
+		os.Exit(1)
+	}
+
+	httpConf.Broker, err = newBroker(cmdConf)
+	if err != nil {
+		log.Printf("%s: unable to setup the broker: %v\n", os.Args[0], err)
+		os.Exit(1)
+	}
+
 	if cmdConf.RollbarToken != "" {
 		rollbar.SetToken(cmdConf.RollbarToken)
 		rollbar.SetEnvironment(cmdConf.RollbarEnvironment)
@@ -51,6 +83,7 @@ func main() {
 	s.ReadTimeout = cmdConf.HTTPReadTimeout
 	s.WriteTimeout = cmdConf.HTTPWriteTimeout
 	s.Start(cmdConf.HTTPPort, awaitSignals(syscall.SIGURG))
+	tracing.Shutdown()
 }
 
 func parseFlags() (*cmdConfig, *server.Config, error) {
@@ -64,16 +97,174 @@ func parseFlags() (*cmdConfig, *server.Config, error) {
 	flag.DurationVar(&cmdConf.HTTPReadTimeout, "httpReadTimeout", time.Hour, "Timeout for HTTP request reading")
 	flag.DurationVar(&cmdConf.HTTPWriteTimeout, "httpWriteTimeout", time.Hour, "Timeout for HTTP request writing")
 
-	httpConf.Credentials = os.Getenv("CREDS")
+	cmdConf.Auth.Basic = os.Getenv("CREDS")
+	cmdConf.Auth.Bearer = os.Getenv("AUTH_TOKENS")
+	flag.StringVar(&cmdConf.Auth.JWKSFile, "authJWKS", os.Getenv("AUTH_JWKS_FILE"), "JWKS file of the keys signing JWT bearer tokens")
+	flag.StringVar(&cmdConf.Auth.JWTIssuer, "authJWTIssuer", os.Getenv("AUTH_JWT_ISSUER"), "Issuer required in JWTs, if set")
+	flag.StringVar(&cmdConf.Auth.JWTAudience, "authJWTAudience", os.Getenv("AUTH_JWT_AUDIENCE"), "Audience required in JWTs, if set")
 	httpConf.EnforceHTTPS = os.Getenv("ENFORCE_HTTPS") == "1"
+	flag.StringVar(&cmdConf.CORSOrigins, "corsOrigins", os.Getenv("CORS_ORIGINS"), "Comma separated origins allowed to read streams from browsers, such as https://*.example.com")
+	flag.BoolVar(&httpConf.CORSCredentials, "corsCredentials", os.Getenv("CORS_CREDENTIALS") == "1", "Allow the CORS origins to send credentials")
+	flag.StringVar(&cmdConf.CORSExposeHeaders, "corsExposeHeaders", os.Getenv("CORS_EXPOSE_HEADERS"), "Comma separated headers exposed to the CORS origins, the stream headers by default")
+	cmdConf.TokenSecret = os.Getenv("STREAM_TOKEN_SECRET")
+	flag.DurationVar(&httpConf.TokenTTL, "streamTokenTTL", 0, "Validity of the stream tokens, 0 for no expiry")
+	flag.BoolVar(&httpConf.InsecureStreamKeys, "insecureStreamKeys", os.Getenv("INSECURE_STREAM_KEYS") == "1", "Let requests without a stream token through, stream keys being unguessable")
 	flag.DurationVar(&httpConf.HeartbeatDuration, "subscribeHeartbeatDuration", time.Second*10, "Heartbeat interval for HTTP stream subscriptions.")
+	flag.DurationVar(&httpConf.LineFlushDuration, "subscribeLineFlushDuration", time.Second, "How long partial lines are held back for line-buffered SSE subscriptions.")
+	flag.DurationVar(&httpConf.SSERetryDuration, "subscribeSSERetry", 0, "Reconnection time sent to SSE subscribers, 0 to leave it to the clients.")
 	httpConf.StorageBaseURL = getStorageBaseURL
+	flag.Int64Var(&httpConf.StreamMaxSize, "streamMaxSize", 0, "Default maximum size of a stream in bytes, 0 for no limit")
+	flag.StringVar(&cmdConf.StreamOverflow, "streamOverflow", string(broker.OverflowReject), "Default policy past the maximum size of a stream: reject, truncate or rolling")
+
+	flag.StringVar(&cmdConf.Metrics, "metrics", getenvDefault("METRICS", "l2met"), "Comma separated metrics sinks: l2met logs, and prometheus on /metrics")
+	httpConf.MetricsToken = os.Getenv("METRICS_TOKEN")
+	flag.BoolVar(&cmdConf.PublicMetrics, "publicMetrics", os.Getenv("PUBLIC_METRICS") == "1", "Serve /metrics without $METRICS_TOKEN")
+
+	cmdConf.Broker = os.Getenv("BROKER")
+	flag.StringVar(&cmdConf.Redis.URL, "redisUrl", os.Getenv("REDIS_URL"), "URL of the redis server")
+	flag.IntVar(&cmdConf.Redis.MaxIdle, "redisMaxIdle", broker.DefaultRedisMaxIdle, "Maximum number of idle redis connections")
+	flag.IntVar(&cmdConf.Redis.MaxActive, "redisMaxActive", 0, "Maximum number of redis connections, 0 for no limit")
+	flag.BoolVar(&cmdConf.Redis.Wait, "redisWait", false, "Wait for a redis connection once redisMaxActive is reached")
+	flag.DurationVar(&cmdConf.Redis.IdleTimeout, "redisIdleTimeout", broker.DefaultRedisIdleTimeout, "Close redis connections idle for longer than this")
+	flag.DurationVar(&cmdConf.Redis.DialTimeout, "redisDialTimeout", 5*time.Second, "Timeout for connecting to redis")
+	flag.DurationVar(&cmdConf.Redis.ReadTimeout, "redisReadTimeout", 0, "Timeout for reading redis replies")
+	flag.DurationVar(&cmdConf.Redis.WriteTimeout, "redisWriteTimeout", 0, "Timeout for writing redis commands")
+	flag.IntVar(&cmdConf.Redis.SubscriptionConns, "redisSubscriptionConns", broker.DefaultSubscriptionConns, "Number of redis pub/sub connections shared by all subscribers")
+	flag.IntVar(&cmdConf.Redis.TailCacheSize, "redisTailCacheSize", broker.DefaultTailCacheSize, "Bytes cached in memory at the head of each subscribed stream, negative to disable")
+	flag.StringVar(&cmdConf.Redis.SentinelMaster, "redisSentinelMaster", os.Getenv("REDIS_SENTINEL_MASTER"), "Name of the redis master to discover through sentinel")
+	flag.StringVar(&cmdConf.RedisSentinelAddrs, "redisSentinelAddrs", os.Getenv("REDIS_SENTINEL_ADDRS"), "Comma separated host:port addresses of the redis sentinels")
+	flag.BoolVar(&cmdConf.Redis.Cluster, "redisCluster", os.Getenv("REDIS_CLUSTER") == "1", "Shard streams over a redis cluster, redisUrl being any of its nodes")
+	flag.BoolVar(&cmdConf.RedisTLSSkipVerify, "redisTLSSkipVerify", os.Getenv("REDIS_TLS_SKIP_VERIFY") == "1", "Skip the certificate verification of rediss:// servers")
+	flag.DurationVar(&cmdConf.Redis.KeyExpire, "redisKeyExpire", broker.DefaultRedisKeyExpire, "How long streams are kept once done")
+	flag.DurationVar(&cmdConf.Redis.ChannelExpire, "redisChannelExpire", broker.DefaultRedisChannelExpire, "How long idle streams are kept")
+	flag.StringVar(&cmdConf.RedisLayout, "redisLayout", getenvDefault("REDIS_LAYOUT", "string"), "How streams are stored on redis: string or stream (requires redis 5.0)")
+	flag.BoolVar(&cmdConf.RedisMigrate, "redisMigrateStreams", false, "Migrate every string stream to the stream layout on boot")
 
 	flag.Parse()
 
+	overflow, err := broker.ParseOverflow(cmdConf.StreamOverflow)
+	if err != nil {
+		log.Printf("%s: %v\n", os.Args[0], err)
+		return nil, nil, err
+	}
+	httpConf.StreamOverflow = overflow
+	httpConf.CORSOrigins = splitList(cmdConf.CORSOrigins)
+	httpConf.CORSExposeHeaders = splitList(cmdConf.CORSExposeHeaders)
+	if httpConf.CORSCredentials && hasWildcard(httpConf.CORSOrigins) {
+		err = errors.New("-corsCredentials can't be used with the * origin")
+		log.Printf("%s: %v\n", os.Args[0], err)
+		return nil, nil, err
+	}
+
+	httpConf.Metrics, err = setupMetrics(splitList(cmdConf.Metrics))
+	if err != nil {
+		log.Printf("%s: %v\n", os.Args[0], err)
+		return nil, nil, err
+	}
+	if httpConf.Metrics != nil && httpConf.MetricsToken == "" && !cmdConf.PublicMetrics {
+		err = errors.New("$METRICS_TOKEN must be set for prometheus, unless running with -publicMetrics")
+		log.Printf("%s: %v\n", os.Args[0], err)
+		return nil, nil, err
+	}
+
+	if cmdConf.TokenSecret == "" && !httpConf.InsecureStreamKeys {
+		err = errors.New("$STREAM_TOKEN_SECRET must be set, unless running with -insecureStreamKeys")
+		log.Printf("%s: %v\n", os.Args[0], err)
+		return nil, nil, err
+	}
+	httpConf.TokenSecret = []byte(cmdConf.TokenSecret)
+
+	httpConf.Authenticator, err = auth.New(cmdConf.Auth)
+	if err != nil {
+		log.Printf("%s: unable to setup authentication: %v\n", os.Args[0], err)
+		return nil, nil, err
+	}
+
 	return cmdConf, httpConf, nil
 }
 
+// newBroker returns the configured broker backend,
+// defaulting to redis.
+func newBroker(cmdConf *cmdConfig) (broker.Broker, error) {
+	if cmdConf.Broker == "memory" {
+		log.Println("broker.memory single node mode")
+		return broker.NewMemoryBroker(), nil
+	}
+
+	if cmdConf.RedisTLSSkipVerify {
+		cmdConf.Redis.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if cmdConf.RedisSentinelAddrs != "" {
+		cmdConf.Redis.SentinelAddrs = strings.Split(cmdConf.RedisSentinelAddrs, ",")
+	}
+
+	switch cmdConf.RedisLayout {
+	case "string":
+		return broker.NewRedisBroker(cmdConf.Redis)
+	case "stream":
+		b, err := broker.NewRedisStreamBroker(cmdConf.Redis)
+		if err != nil {
+			return nil, err
+		}
+		if cmdConf.RedisMigrate {
+			n, err := b.MigrateAll()
+			log.Printf("broker.migrate count=%d err=%v\n", n, err)
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unknown redis layout %q", cmdConf.RedisLayout)
+	}
+}
+
+// setupMetrics reports the metrics to the given sinks, returning
+// the handler serving them for prometheus.
+func setupMetrics(names []string) (http.Handler, error) {
+	var sinks []util.Sink
+	var handler http.Handler
+	for _, name := range names {
+		switch name {
+		case "l2met":
+			sinks = append(sinks, util.LogSink{})
+		case "prometheus":
+			p := util.NewPrometheus()
+			sinks = append(sinks, p)
+			handler = p
+		default:
+			return nil, fmt.Errorf("unknown metrics sink %q", name)
+		}
+	}
+	util.SetSinks(sinks...)
+	return handler, nil
+}
+
+// hasWildcard returns whether the CORS origins allow any origin.
+func hasWildcard(origins []string) bool {
+	for _, origin := range origins {
+		if origin == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma separated list, nil if empty.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func getenvDefault(key, value string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return value
+}
+
 func getStorageBaseURL(r *http.Request) string {
 	prefix := strings.ToUpper(nonWordCharacters.ReplaceAllString(r.Host, "_"))
 	if v := os.Getenv(fmt.Sprintf("%v_STORAGE_BASE_URL", prefix)); v != "" {
@@ -5,6 +5,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/heroku/busl/util"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -19,3 +20,30 @@ func TestGetStorageBaseURL(t *testing.T) {
 	assert.Equal(t, "default",
 		getStorageBaseURL(&http.Request{}))
 }
+
+func TestSplitList(t *testing.T) {
+	assert.Nil(t, splitList(""))
+	assert.Nil(t, splitList(" , "))
+	assert.Equal(t, []string{"https://a.com", "https://*.b.com"}, splitList("https://a.com, https://*.b.com,"))
+}
+
+func TestHasWildcard(t *testing.T) {
+	assert.False(t, hasWildcard(nil))
+	assert.False(t, hasWildcard([]string{"https://*.example.com"}))
+	assert.True(t, hasWildcard([]string{"https://a.com", "*"}))
+}
+
+func TestSetupMetrics(t *testing.T) {
+	defer util.SetSinks(util.LogSink{})
+
+	handler, err := setupMetrics([]string{"l2met"})
+	assert.Nil(t, err)
+	assert.Nil(t, handler)
+
+	handler, err = setupMetrics([]string{"l2met", "prometheus"})
+	assert.Nil(t, err)
+	assert.NotNil(t, handler)
+
+	_, err = setupMetrics([]string{"statsd"})
+	assert.NotNil(t, err)
+}
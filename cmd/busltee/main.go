@@ -6,6 +6,7 @@ import (
 	"os"
 
 	"github.com/heroku/busl/busltee"
+	"github.com/heroku/busl/tracing"
 	"github.com/heroku/rollbar"
 	flag "github.com/ogier/pflag"
 )
@@ -32,7 +33,13 @@ func main() {
 	busltee.ConfigureLogs(publisherConf.LogFile, cmdConf.LogFields)
 	defer busltee.CloseLogs()
 
-	if exitCode := busltee.Run(publisherConf.URL, publisherConf.Args, publisherConf); exitCode != 0 {
+	if err := tracing.FromEnv("busltee"); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: unable to setup tracing: %v\n", os.Args[0], err)
+	}
+
+	exitCode := busltee.Run(publisherConf.URL, publisherConf.Args, publisherConf)
+	tracing.Shutdown()
+	if exitCode != 0 {
 		os.Exit(exitCode)
 	}
 }
@@ -48,6 +55,7 @@ func parseFlags() (*cmdConfig, *busltee.Config, error) {
 
 	cmdConf.RollbarEnvironment = os.Getenv("ROLLBAR_ENVIRONMENT")
 	cmdConf.RollbarToken = os.Getenv("ROLLBAR_TOKEN")
+	publisherConf.Traceparent = os.Getenv("TRACEPARENT")
 
 	// Connection related flags
 	flag.BoolVarP(&publisherConf.Insecure, "insecure", "k", false, "allows insecure SSL connections")
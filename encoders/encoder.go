@@ -1,9 +1,45 @@
 package encoders
 
-import "io"
+import (
+	"errors"
+	"io"
+	"time"
+)
 
 type Encoder interface {
 	io.Reader
 	io.Closer
 	io.Seeker
 }
+
+// WriteTimer is implemented by the readers knowing when the content
+// they return got written. WriteTime returns the write time of the
+// content at offset, which must have been read already, or the zero
+// time if unknown.
+type WriteTimer interface {
+	WriteTime(offset int64) time.Time
+}
+
+// offsetReader stores the original reader of an encoder, along with
+// the offset the encoder is at in the stream.
+type offsetReader struct {
+	io.ReadCloser
+	offset int64
+}
+
+func (r *offsetReader) Seek(offset int64, whence int) (n int64, err error) {
+	if seeker, ok := r.ReadCloser.(io.ReadSeeker); ok {
+		r.offset, err = seeker.Seek(offset, whence)
+	} else {
+		// The underlying reader doesn't support seeking, but
+		// we should still update the offset so the encoded
+		// content will properly reflect the adjusted offset.
+
+		if whence != io.SeekStart {
+			return 0, errors.New("Only SeekStart is supported")
+		}
+		r.offset += offset
+	}
+
+	return r.offset, err
+}
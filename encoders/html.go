@@ -0,0 +1,325 @@
+package encoders
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	esc = 0x1b
+
+	// maxEscapeLength bounds the escape sequences held back
+	// across chunks, so that stray escapes can't stall the output.
+	maxEscapeLength = 256
+)
+
+var ansiColors = []string{"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"}
+
+// ansiStyle is the state set by SGR sequences. Colors are either
+// the name of one of the 16 standard colors, or #rrggbb.
+type ansiStyle struct {
+	bold, dim, italic, underline, strike bool
+	fg, bg                               string
+}
+
+// tag returns the span opening tag rendering the style,
+// or an empty string for the default style.
+func (s *ansiStyle) tag() string {
+	var classes, styles []string
+	for _, attr := range []struct {
+		set  bool
+		name string
+	}{{s.bold, "bold"}, {s.dim, "dim"}, {s.italic, "italic"}, {s.underline, "underline"}, {s.strike, "strike"}} {
+		if attr.set {
+			classes = append(classes, "ansi-"+attr.name)
+		}
+	}
+
+	for _, color := range []struct{ value, class, property string }{{s.fg, "ansi-", "color"}, {s.bg, "ansi-bg-", "background-color"}} {
+		if strings.HasPrefix(color.value, "#") {
+			styles = append(styles, color.property+":"+color.value)
+		} else if color.value != "" {
+			classes = append(classes, color.class+color.value)
+		}
+	}
+
+	if len(classes) == 0 && len(styles) == 0 {
+		return ""
+	}
+	tag := "<span"
+	if len(classes) > 0 {
+		tag += ` class="` + strings.Join(classes, " ") + `"`
+	}
+	if len(styles) > 0 {
+		tag += ` style="` + strings.Join(styles, ";") + `"`
+	}
+	return tag + ">"
+}
+
+// apply updates the style with the parameters of an SGR sequence
+func (s *ansiStyle) apply(params string) {
+	codes := strings.Split(params, ";")
+	for i := 0; i < len(codes); i++ {
+		code, _ := strconv.Atoi(codes[i])
+		switch {
+		case code == 0:
+			*s = ansiStyle{}
+		case code == 1:
+			s.bold = true
+		case code == 2:
+			s.dim = true
+		case code == 3:
+			s.italic = true
+		case code == 4:
+			s.underline = true
+		case code == 9:
+			s.strike = true
+		case code == 22:
+			s.bold, s.dim = false, false
+		case code == 23:
+			s.italic = false
+		case code == 24:
+			s.underline = false
+		case code == 29:
+			s.strike = false
+		case code >= 30 && code <= 37:
+			s.fg = ansiColors[code-30]
+		case code >= 90 && code <= 97:
+			s.fg = "bright-" + ansiColors[code-90]
+		case code == 39:
+			s.fg = ""
+		case code >= 40 && code <= 47:
+			s.bg = ansiColors[code-40]
+		case code >= 100 && code <= 107:
+			s.bg = "bright-" + ansiColors[code-100]
+		case code == 49:
+			s.bg = ""
+		case code == 38 || code == 48:
+			color, n := extendedColor(codes[i+1:])
+			i += n
+			if code == 38 {
+				s.fg = color
+			} else {
+				s.bg = color
+			}
+		}
+	}
+}
+
+// extendedColor reads a 256 color (5;n) or a true color (2;r;g;b),
+// returning the color and the number of parameters it took.
+func extendedColor(params []string) (string, int) {
+	n := make([]int, len(params))
+	for i, p := range params {
+		n[i], _ = strconv.Atoi(p)
+	}
+
+	switch {
+	case len(n) >= 2 && n[0] == 5:
+		return paletteColor(n[1]), 2
+	case len(n) >= 4 && n[0] == 2:
+		return fmt.Sprintf("#%02x%02x%02x", n[1]&0xff, n[2]&0xff, n[3]&0xff), 4
+	}
+	return "", len(n)
+}
+
+// paletteColor returns the color of the 256 color palette at index i
+func paletteColor(i int) string {
+	switch {
+	case i < 0 || i > 255:
+		return ""
+	case i < 8:
+		return ansiColors[i]
+	case i < 16:
+		return "bright-" + ansiColors[i-8]
+	case i < 232:
+		i -= 16
+		level := func(v int) int {
+			if v == 0 {
+				return 0
+			}
+			return 55 + v*40
+		}
+		return fmt.Sprintf("#%02x%02x%02x", level(i/36), level(i/6%6), level(i%6))
+	default:
+		v := 8 + (i-232)*10
+		return fmt.Sprintf("#%02x%02x%02x", v, v, v)
+	}
+}
+
+// parseEscape reads the escape sequence p starts with, returning its
+// length, and for CSI sequences, their parameters and final byte. ok
+// is false if the sequence is incomplete.
+func parseEscape(p []byte) (n int, params string, final byte, ok bool) {
+	if len(p) < 2 {
+		return 0, "", 0, false
+	}
+
+	switch p[1] {
+	case '[':
+		for i := 2; i < len(p); i++ {
+			switch c := p[i]; {
+			case c >= 0x20 && c <= 0x3f:
+				// Parameter and intermediate bytes.
+			case c >= 0x40 && c <= 0x7e:
+				return i + 1, string(p[2:i]), c, true
+			default:
+				// Malformed: drop what was read so far.
+				return i, "", 0, true
+			}
+		}
+		return 0, "", 0, false
+
+	case ']':
+		// Operating system commands, e.g. hyperlinks,
+		// ended by BEL or ST.
+		for i := 2; i < len(p); i++ {
+			if p[i] == 0x07 {
+				return i + 1, "", 0, true
+			}
+			if p[i] == esc && i+1 < len(p) && p[i+1] == '\\' {
+				return i + 2, "", 0, true
+			}
+		}
+		return 0, "", 0, false
+
+	default:
+		return 2, "", 0, true
+	}
+}
+
+// ansiHTML converts text with ANSI escape sequences to HTML. SGR
+// sequences are rendered as spans, and the other sequences dropped.
+// The style carries over from a chunk to the next, but every chunk
+// converts to a fragment closing the spans it opens.
+type ansiHTML struct {
+	style   ansiStyle
+	pending []byte // incomplete escape sequence
+}
+
+func (c *ansiHTML) convert(p []byte) []byte {
+	data := append(c.pending, p...)
+	c.pending = nil
+
+	var buf bytes.Buffer
+	open := false
+	text := func(t []byte) {
+		if len(t) == 0 {
+			return
+		}
+		if tag := c.style.tag(); !open && tag != "" {
+			buf.WriteString(tag)
+			open = true
+		}
+		buf.WriteString(html.EscapeString(string(t)))
+	}
+
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, esc)
+		if i < 0 {
+			text(data)
+			break
+		}
+		text(data[:i])
+
+		n, params, final, ok := parseEscape(data[i:])
+		if !ok {
+			if len(data)-i <= maxEscapeLength {
+				c.pending = append([]byte(nil), data[i:]...)
+				break
+			}
+			n = 1
+		}
+		if final == 'm' {
+			if open {
+				buf.WriteString("</span>")
+				open = false
+			}
+			c.style.apply(params)
+		}
+		data = data[i+n:]
+	}
+
+	if open {
+		buf.WriteString("</span>")
+	}
+	return buf.Bytes()
+}
+
+type htmlEncoder struct {
+	offsetReader // stores the original reader
+	converter    ansiHTML
+	buf          []byte // reused across reads
+	out          []byte // converted, not returned yet
+	err          error
+}
+
+// NewHTMLEncoder creates an HTML encoder, escaping the text and
+// rendering its ANSI colors and attributes as spans with ansi-*
+// classes. Every read returns an HTML fragment closing its spans,
+// provided p is large enough.
+func NewHTMLEncoder(r io.ReadCloser) Encoder {
+	return &htmlEncoder{offsetReader: offsetReader{ReadCloser: r}}
+}
+
+func (r *htmlEncoder) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		if r.buf == nil {
+			r.buf = make([]byte, 32*1024)
+		}
+		n, err := r.ReadCloser.Read(r.buf)
+		r.offset += int64(n)
+		r.out = r.converter.convert(r.buf[:n])
+		r.err = err
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+type sseHTMLEncoder struct {
+	offsetReader // offset is that of the next byte read
+	converter    ansiHTML
+	buf          []byte // reused across reads
+	out          []byte // events not returned yet
+	err          error
+}
+
+// NewSSEHTMLEncoder creates a server-sent event encoder whose events
+// carry HTML fragments, as converted by the HTML encoder. The event
+// IDs remain the offsets in the original stream.
+func NewSSEHTMLEncoder(r io.ReadCloser) Encoder {
+	return &sseHTMLEncoder{offsetReader: offsetReader{ReadCloser: r}}
+}
+
+func (r *sseHTMLEncoder) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		if r.buf == nil {
+			r.buf = make([]byte, 32*1024)
+		}
+		n, err := r.ReadCloser.Read(r.buf)
+		r.offset += int64(n)
+		if fragment := r.converter.convert(r.buf[:n]); len(fragment) > 0 {
+			// Escape sequences held back are sent with the next event.
+			r.out = event(r.offset-int64(len(r.converter.pending)), fragment)
+		}
+		r.err = err
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
@@ -0,0 +1,60 @@
+package encoders
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testHTMLData = []struct {
+		input  string
+		output string
+	}{
+		{"hello", "hello"},
+		{"<b>\"&'</b>", "&lt;b&gt;&#34;&amp;&#39;&lt;/b&gt;"},
+		{"\x1b[31mred\x1b[0m plain", `<span class="ansi-red">red</span> plain`},
+		{"\x1b[1;4;92;44mhi\x1b[24mthere\x1b[m", `<span class="ansi-bold ansi-underline ansi-bright-green ansi-bg-blue">hi</span>` +
+			`<span class="ansi-bold ansi-bright-green ansi-bg-blue">there</span>`},
+		{"\x1b[38;5;196m256\x1b[48;2;1;2;3mrgb\x1b[39;49m", `<span style="color:#ff0000">256</span>` +
+			`<span style="color:#ff0000;background-color:#010203">rgb</span>`},
+		{"\x1b[2Kerase\x1b]8;;http://x\x07link\x1b]8;;\x1b\\", "eraselink"},
+		{"\x1b[3", ""},
+	}
+)
+
+func TestHTML(t *testing.T) {
+	for _, data := range testHTMLData {
+		r := &readSeekerCloser{strings.NewReader(data.input)}
+		assert.Equal(t, data.output, readstring(NewHTMLEncoder(r)))
+	}
+}
+
+func TestANSIHTMLChunks(t *testing.T) {
+	var c ansiHTML
+
+	// Styles carry over, but every chunk closes its spans.
+	assert.Equal(t, `<span class="ansi-red">re</span>`, string(c.convert([]byte("\x1b[31mre"))))
+	assert.Equal(t, `<span class="ansi-red">d</span>`, string(c.convert([]byte("d\x1b["))))
+	assert.Equal(t, "\x1b[", string(c.pending))
+	assert.Equal(t, "", string(c.convert([]byte("0"))))
+	assert.Equal(t, " plain", string(c.convert([]byte("m plain"))))
+	assert.Equal(t, 0, len(c.pending))
+}
+
+func TestSSEHTML(t *testing.T) {
+	r := &readSeekerCloser{strings.NewReader("<a>\n\x1b[32mok\x1b[0m")}
+	enc := NewSSEHTMLEncoder(r)
+	enc.Seek(0, io.SeekStart)
+	assert.Equal(t, "id: 15\ndata: &lt;a&gt;\ndata: <span class=\"ansi-green\">ok</span>\n\n", readstring(enc))
+}
+
+func TestSSEHTMLPendingEscape(t *testing.T) {
+	// The held back escape isn't included in the event ID.
+	r := &limitedReadCloser{io.LimitReader(strings.NewReader("ok\x1b[3"), 6).(*io.LimitedReader)}
+	enc := NewSSEHTMLEncoder(r)
+	enc.Seek(10, io.SeekStart)
+	assert.Equal(t, "id: 12\ndata: ok\n\n", readstring(enc))
+}
@@ -0,0 +1,112 @@
+package encoders
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// NDJSONLine is a line of a stream, as encoded by the NDJSON encoder.
+// The text of lines that aren't valid UTF-8 is base64 encoded instead.
+type NDJSONLine struct {
+	Offset int64      `json:"offset"`
+	Next   int64      `json:"next"` // to resume from
+	Line   int64      `json:"line"`
+	Time   *time.Time `json:"time,omitempty"`
+	Text   *string    `json:"text,omitempty"`
+	Base64 []byte     `json:"base64,omitempty"`
+}
+
+type ndjsonEncoder struct {
+	offsetReader       // offset is that of the next byte read
+	line         int64 // number of the next line
+	pending      []byte
+	buf          []byte // reused across reads
+	out          []byte // encoded lines not returned yet
+	err          error
+}
+
+// NewNDJSONEncoder creates a newline delimited JSON encoder, emitting
+// an NDJSONLine per line of the stream, numbered from firstLine. Lines
+// are held back until complete, or the stream is done. Lines longer
+// than maxLinePending are sent in pieces sharing the same number.
+func NewNDJSONEncoder(r io.ReadCloser, firstLine int64) Encoder {
+	return &ndjsonEncoder{offsetReader: offsetReader{ReadCloser: r}, line: firstLine}
+}
+
+func (r *ndjsonEncoder) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		if r.buf == nil {
+			r.buf = make([]byte, 32*1024)
+		}
+		n, err := r.ReadCloser.Read(r.buf)
+		r.pending = append(r.pending, r.buf[:n]...)
+		r.offset += int64(n)
+
+		for {
+			i := bytes.IndexByte(r.pending, '\n')
+			if i < 0 {
+				break
+			}
+			r.encode(r.pending[:i], 1)
+			r.pending = r.pending[i+1:]
+		}
+		if len(r.pending) > maxLinePending {
+			n := len(r.pending) - incompleteRune(r.pending)
+			r.encode(r.pending[:n], 0)
+			r.pending = r.pending[n:]
+		}
+
+		if err != nil {
+			if len(r.pending) > 0 {
+				r.encode(r.pending, 0)
+				r.pending = nil
+			}
+			r.err = err
+		}
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// encode appends the line, followed by eol newline bytes, to the
+// output. Only complete lines move on to the next line number.
+func (r *ndjsonEncoder) encode(line []byte, eol int) {
+	next := r.offset - int64(len(r.pending)) + int64(len(line)+eol)
+	l := NDJSONLine{
+		Offset: next - int64(len(line)+eol),
+		Next:   next,
+		Line:   r.line,
+	}
+	if eol > 0 {
+		r.line++
+	}
+
+	if timer, ok := r.ReadCloser.(WriteTimer); ok {
+		if t := timer.WriteTime(next - 1); !t.IsZero() {
+			t = t.UTC()
+			l.Time = &t
+		}
+	}
+
+	if utf8.Valid(line) {
+		text := string(line)
+		l.Text = &text
+	} else {
+		l.Base64 = append([]byte(nil), line...)
+	}
+
+	buf := bytes.NewBuffer(r.out)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(l)
+	r.out = buf.Bytes()
+}
@@ -0,0 +1,96 @@
+package encoders
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type ndjsonTable struct {
+	offset int64
+	input  string
+	output string
+}
+
+var (
+	testNDJSONData = []ndjsonTable{
+		{0, "hello", `{"offset":0,"next":5,"line":1,"text":"hello"}` + "\n"},
+		{0, "hello\n", `{"offset":0,"next":6,"line":1,"text":"hello"}` + "\n"},
+		{0, "hello\n\nworld", `{"offset":0,"next":6,"line":1,"text":"hello"}` + "\n" +
+			`{"offset":6,"next":7,"line":2,"text":""}` + "\n" +
+			`{"offset":7,"next":12,"line":3,"text":"world"}` + "\n"},
+		{6, "hello\nworld\n", `{"offset":6,"next":12,"line":1,"text":"world"}` + "\n"},
+		{0, "<b>\xff</b>\n", `{"offset":0,"next":9,"line":1,"base64":"PGI+/zwvYj4="}` + "\n"},
+		{0, "<b>\"é\"</b>\n", `{"offset":0,"next":12,"line":1,"text":"<b>\"é\"</b>"}` + "\n"},
+		{12, "hello\nworld\n", ""},
+	}
+)
+
+func TestNDJSON(t *testing.T) {
+	for _, data := range testNDJSONData {
+		r := &readSeekerCloser{strings.NewReader(data.input)}
+		enc := NewNDJSONEncoder(r, 1)
+		enc.Seek(data.offset, 0)
+		assert.Equal(t, data.output, readstring(enc))
+	}
+}
+
+func TestNDJSONNonSeekableReader(t *testing.T) {
+	r := &readSeekerCloser{strings.NewReader("hello\nworld")}
+	r.Seek(6, 0)
+
+	// Use LimitReader to hide the Seeker interface
+	lr := &limitedReadCloser{io.LimitReader(r, 11).(*io.LimitedReader)}
+
+	enc := NewNDJSONEncoder(lr, 2)
+	enc.Seek(6, io.SeekStart)
+	assert.Equal(t, `{"offset":6,"next":11,"line":2,"text":"world"}`+"\n", readstring(enc))
+}
+
+// timedReader writes every byte one second after the previous one
+type timedReader struct {
+	readSeekerCloser
+}
+
+func (r *timedReader) WriteTime(offset int64) time.Time {
+	return time.Unix(offset, 0)
+}
+
+func TestNDJSONWriteTime(t *testing.T) {
+	r := &timedReader{readSeekerCloser{strings.NewReader("hello\nworld")}}
+	enc := NewNDJSONEncoder(r, 1)
+	assert.Equal(t, `{"offset":0,"next":6,"line":1,"time":"1970-01-01T00:00:05Z","text":"hello"}`+"\n"+
+		`{"offset":6,"next":11,"line":2,"time":"1970-01-01T00:00:10Z","text":"world"}`+"\n", readstring(enc))
+}
+
+func TestNDJSONLongLine(t *testing.T) {
+	long := strings.Repeat("é", maxLinePending)
+	r := &readSeekerCloser{strings.NewReader(long + "\nworld")}
+	enc := NewNDJSONEncoder(r, 1)
+	dec := json.NewDecoder(enc)
+
+	var text string
+	var lines []NDJSONLine
+	for {
+		var l NDJSONLine
+		if dec.Decode(&l) != nil {
+			break
+		}
+		lines = append(lines, l)
+		if l.Line == 1 {
+			assert.NotNil(t, l.Text)
+			text += *l.Text
+		}
+	}
+
+	assert.True(t, len(lines) > 2)
+	assert.Equal(t, long, text)
+	last := lines[len(lines)-1]
+	assert.Equal(t, int64(2), last.Line)
+	assert.Equal(t, "world", *last.Text)
+	assert.Equal(t, int64(len(long)+1), last.Offset)
+}
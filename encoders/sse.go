@@ -2,6 +2,7 @@ package encoders
 
 import (
 	"bytes"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -13,30 +14,12 @@ const (
 )
 
 type sseEncoder struct {
-	io.ReadCloser       // stores the original reader
-	offset        int64 // offset for Seek purposes
+	offsetReader // stores the original reader
 }
 
 // NewSSEEncoder creates a new server-sent event encoder
 func NewSSEEncoder(r io.ReadCloser) Encoder {
-	return &sseEncoder{ReadCloser: r}
-}
-
-func (r *sseEncoder) Seek(offset int64, whence int) (n int64, err error) {
-	if seeker, ok := r.ReadCloser.(io.ReadSeeker); ok {
-		r.offset, err = seeker.Seek(offset, whence)
-	} else {
-		// The underlying reader doesn't support seeking, but
-		// we should still update the offset so the IDs will
-		// properly reflect the adjusted offset.
-
-		if whence != io.SeekStart {
-			return 0, errors.New("Only SeekStart is supported")
-		}
-		r.offset += offset
-	}
-
-	return r.offset, err
+	return &sseEncoder{offsetReader: offsetReader{ReadCloser: r}}
 }
 
 func (r *sseEncoder) Read(p []byte) (n int, err error) {
@@ -58,7 +41,17 @@ func (r *sseEncoder) Read(p []byte) (n int, err error) {
 }
 
 func format(pos int64, msg []byte) []byte {
-	buf := bytes.NewBufferString(fmt.Sprintf(id, pos+int64(len(msg))))
+	return event(pos+int64(len(msg)), msg)
+}
+
+// namedEvent formats msg as an event of the given type
+func namedEvent(name string, eventID int64, msg []byte) []byte {
+	return append([]byte("event: "+name+"\n"), event(eventID, msg)...)
+}
+
+// event formats msg as a message with the given ID
+func event(eventID int64, msg []byte) []byte {
+	buf := bytes.NewBufferString(fmt.Sprintf(id, eventID))
 
 	for _, line := range bytes.Split(msg, []byte{'\n'}) {
 		buf.WriteString(fmt.Sprintf(data, line))
@@ -67,3 +60,70 @@ func format(pos int64, msg []byte) []byte {
 
 	return buf.Bytes()
 }
+
+type sseBase64Encoder struct {
+	offsetReader        // stores the original reader
+	out          []byte // event not returned yet
+}
+
+// NewSSEBase64Encoder creates a server-sent event encoder for binary
+// streams, whose events carry base64 encoded data. The event IDs
+// remain the offsets in the original stream.
+func NewSSEBase64Encoder(r io.ReadCloser) Encoder {
+	return &sseBase64Encoder{offsetReader: offsetReader{ReadCloser: r}}
+}
+
+func (r *sseBase64Encoder) Read(p []byte) (int, error) {
+	if len(r.out) == 0 {
+		q := make([]byte, 32*1024)
+		n, err := r.ReadCloser.Read(q)
+		if n == 0 {
+			return 0, err
+		}
+
+		r.offset += int64(n)
+		r.out = event(r.offset, []byte(base64.StdEncoding.EncodeToString(q[:n])))
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+type sseEndEncoder struct {
+	Encoder
+	end   func() (int64, []byte, bool)
+	ended bool
+	out   []byte // end event not returned yet
+}
+
+// NewSSEEndEncoder wraps an SSE encoder to send an end event once it's
+// exhausted. end returns the ID and data of the event, or false if the
+// stream didn't complete, e.g. because it got deleted.
+func NewSSEEndEncoder(enc Encoder, end func() (int64, []byte, bool)) Encoder {
+	return &sseEndEncoder{Encoder: enc, end: end}
+}
+
+func (r *sseEndEncoder) Read(p []byte) (int, error) {
+	if !r.ended {
+		n, err := r.Encoder.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+
+		r.ended = true
+		if eventID, msg, ok := r.end(); ok {
+			r.out = namedEvent("end", eventID, msg)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+
+	if len(r.out) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
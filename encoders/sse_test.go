@@ -59,3 +59,24 @@ func readstring(r io.Reader) string {
 	buf, _ := ioutil.ReadAll(r)
 	return string(buf)
 }
+
+func TestSSEEnd(t *testing.T) {
+	r := &readSeekerCloser{strings.NewReader("hello")}
+	enc := NewSSEEndEncoder(NewSSEEncoder(r), func() (int64, []byte, bool) {
+		return 5, []byte(`{"length":5}`), true
+	})
+	assert.Equal(t, "id: 5\ndata: hello\n\nevent: end\nid: 5\ndata: {\"length\":5}\n\n", readstring(enc))
+
+	r = &readSeekerCloser{strings.NewReader("hello")}
+	enc = NewSSEEndEncoder(NewSSEEncoder(r), func() (int64, []byte, bool) {
+		return 0, nil, false
+	})
+	assert.Equal(t, "id: 5\ndata: hello\n\n", readstring(enc))
+}
+
+func TestSSEBase64(t *testing.T) {
+	r := &readSeekerCloser{strings.NewReader("\xffhello\nworld")}
+	enc := NewSSEBase64Encoder(r)
+	enc.Seek(1, io.SeekStart)
+	assert.Equal(t, "id: 12\ndata: aGVsbG8Kd29ybGQ=\n\n", readstring(enc))
+}
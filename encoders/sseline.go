@@ -0,0 +1,140 @@
+package encoders
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// maxLinePending bounds the partial line held back, which is sent
+// as soon as it grows larger.
+const maxLinePending = 32 * 1024
+
+type chunk struct {
+	p   []byte
+	err error
+}
+
+type sseLineEncoder struct {
+	offsetReader               // offset is that of pending
+	flushAfter   time.Duration // how long partial lines are held back
+	pending      []byte        // read, not sent yet
+	deadline     time.Time     // when pending gets flushed
+	out          []byte        // event not returned yet
+	err          error
+
+	chunks    chan chunk
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSSELineEncoder creates a server-sent event encoder sending whole
+// lines. Partial lines are held back until they complete, or until
+// flushAfter passes, and UTF-8 characters are never split across
+// events. The event IDs remain the offsets of the data sent.
+func NewSSELineEncoder(r io.ReadCloser, flushAfter time.Duration) Encoder {
+	return &sseLineEncoder{
+		offsetReader: offsetReader{ReadCloser: r},
+		flushAfter:   flushAfter,
+		closed:       make(chan struct{}),
+	}
+}
+
+func (r *sseLineEncoder) Close() error {
+	r.closeOnce.Do(func() { close(r.closed) })
+	return r.ReadCloser.Close()
+}
+
+// fill reads the original reader, so that Read can wait for either
+// more content or the flush deadline.
+func (r *sseLineEncoder) fill() {
+	for {
+		buf := make([]byte, 32*1024)
+		n, err := r.ReadCloser.Read(buf)
+		select {
+		case r.chunks <- chunk{buf[:n], err}:
+		case <-r.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (r *sseLineEncoder) Read(p []byte) (int, error) {
+	if r.chunks == nil {
+		r.chunks = make(chan chunk)
+		go r.fill()
+	}
+
+	for len(r.out) == 0 {
+		if r.err != nil {
+			r.flush(len(r.pending))
+			if len(r.out) == 0 {
+				return 0, r.err
+			}
+			break
+		}
+
+		// Incomplete characters wait for the next read only.
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if len(r.pending) > incompleteRune(r.pending) {
+			timer = time.NewTimer(r.deadline.Sub(time.Now()))
+			timeout = timer.C
+		}
+
+		select {
+		case c := <-r.chunks:
+			if len(r.pending) == 0 {
+				r.deadline = time.Now().Add(r.flushAfter)
+			}
+			r.pending = append(r.pending, c.p...)
+			r.err = c.err
+
+			if len(r.pending) > maxLinePending {
+				r.flush(len(r.pending) - incompleteRune(r.pending))
+			} else {
+				r.flush(bytes.LastIndexByte(r.pending, '\n') + 1)
+			}
+		case <-timeout:
+			r.flush(len(r.pending) - incompleteRune(r.pending))
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// flush sends the first n bytes pending as an event
+func (r *sseLineEncoder) flush(n int) {
+	if n <= 0 {
+		return
+	}
+
+	r.offset += int64(n)
+	r.out = event(r.offset, r.pending[:n])
+	r.pending = append([]byte(nil), r.pending[n:]...)
+	r.deadline = time.Now().Add(r.flushAfter)
+}
+
+// incompleteRune returns the length of the incomplete UTF-8
+// character p ends with, if any.
+func incompleteRune(p []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(p); i++ {
+		if utf8.RuneStart(p[len(p)-i]) {
+			if utf8.FullRune(p[len(p)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
@@ -0,0 +1,57 @@
+package encoders
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// chunkedReader returns its chunks one read at a time, waiting
+// for the delay before each of them.
+type chunkedReader struct {
+	chunks []string
+	delay  time.Duration
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.delay)
+	n := copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+func (r *chunkedReader) Close() error {
+	return nil
+}
+
+func TestSSELine(t *testing.T) {
+	r := &chunkedReader{chunks: []string{"hel", "lo\nwor", "ld\n\xc3", "\xa9\n", "end"}}
+	enc := NewSSELineEncoder(r, time.Minute)
+	assert.Equal(t, "id: 6\ndata: hello\ndata: \n\n"+
+		"id: 12\ndata: world\ndata: \n\n"+
+		"id: 15\ndata: é\ndata: \n\n"+
+		"id: 18\ndata: end\n\n", readstring(enc))
+}
+
+func TestSSELineFlushDeadline(t *testing.T) {
+	r := &chunkedReader{chunks: []string{"hello \xc3", "\xa9"}, delay: 50 * time.Millisecond}
+	enc := NewSSELineEncoder(r, 10*time.Millisecond)
+	enc.Seek(4, io.SeekStart)
+
+	// The partial line gets flushed, but not the partial character.
+	assert.Equal(t, "id: 10\ndata: hello \n\nid: 12\ndata: é\n\n", readstring(enc))
+}
+
+func TestIncompleteRune(t *testing.T) {
+	assert.Equal(t, 0, incompleteRune([]byte("hello")))
+	assert.Equal(t, 0, incompleteRune([]byte("é")))
+	assert.Equal(t, 1, incompleteRune([]byte("a\xc3")))
+	assert.Equal(t, 2, incompleteRune([]byte("\xe2\x82")))
+	assert.Equal(t, 3, incompleteRune([]byte("\xf0\x9f\x98")))
+	assert.Equal(t, 0, incompleteRune([]byte("\xff")))
+}
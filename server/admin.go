@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/util"
+)
+
+const defaultListCount = 100
+
+// streamList is a page of streams, as returned by GET /admin/streams
+type streamList struct {
+	Streams []*streamMeta `json:"streams"`
+	Cursor  string        `json:"cursor"` // empty on the last page
+}
+
+// streamFilter selects the streams listed by the admin API
+type streamFilter struct {
+	done    *bool
+	minSize int64
+	maxSize int64         // zero for no limit
+	minAge  time.Duration // since creation
+	maxAge  time.Duration // zero for no limit
+}
+
+// parseStreamFilter reads the done, min_size, max_size,
+// min_age and max_age query parameters.
+func parseStreamFilter(query url.Values) (*streamFilter, error) {
+	f := &streamFilter{}
+
+	if val := query.Get("done"); val != "" {
+		done, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid done %q", val)
+		}
+		f.done = &done
+	}
+
+	for name, size := range map[string]*int64{"min_size": &f.minSize, "max_size": &f.maxSize} {
+		if val := query.Get(name); val != "" {
+			n, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("Invalid %s %q", name, val)
+			}
+			*size = n
+		}
+	}
+
+	for name, age := range map[string]*time.Duration{"min_age": &f.minAge, "max_age": &f.maxAge} {
+		if val := query.Get(name); val != "" {
+			d, err := time.ParseDuration(val)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("Invalid %s %q", name, val)
+			}
+			*age = d
+		}
+	}
+	return f, nil
+}
+
+func (f *streamFilter) match(meta *broker.StreamMeta) bool {
+	if f.done != nil && *f.done != meta.Done {
+		return false
+	}
+	if meta.Length < f.minSize || (f.maxSize > 0 && meta.Length > f.maxSize) {
+		return false
+	}
+
+	age := time.Since(meta.Created)
+	return age >= f.minAge && (f.maxAge == 0 || age <= f.maxAge)
+}
+
+func (s *Server) listStreams(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, err := parseStreamFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	count := defaultListCount
+	if val := query.Get("count"); val != "" {
+		if count, err = strconv.Atoi(val); err != nil || count <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid count %q", val), http.StatusBadRequest)
+			return
+		}
+	}
+
+	keys, next, err := s.broker(r).List(query.Get("cursor"), count)
+	if err == broker.ErrInvalidCursor {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	list := streamList{Streams: []*streamMeta{}, Cursor: next}
+	for _, key := range keys {
+		if p := principal(r); p != nil && !p.HasKey(key) {
+			continue
+		}
+
+		meta, err := s.broker(r).Meta(key)
+		if err == broker.ErrNotRegistered {
+			// Expired since listed.
+			continue
+		}
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+
+		if filter.match(meta) {
+			list.Streams = append(list.Streams, newStreamMeta(key, meta))
+		}
+	}
+	writeJSON(w, list)
+}
+
+func (s *Server) inspectStream(w http.ResponseWriter, r *http.Request) {
+	meta, err := s.streamMeta(r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	writeJSON(w, meta)
+}
+
+func (s *Server) deleteStream(w http.ResponseWriter, r *http.Request) {
+	if registered, err := s.broker(r).IsRegistered(key(r)); err != nil || !registered {
+		if err == nil {
+			err = broker.ErrNotRegistered
+		}
+		handleError(w, r, err)
+		return
+	}
+
+	if err := s.broker(r).Delete(key(r)); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	util.CountWithData("server.admin.delete", 1, "request_id=%q", r.Header.Get("Request-Id"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadStream stores the content of the stream onto the storage
+// backend, synchronously unlike when the publisher is done.
+func (s *Server) uploadStream(w http.ResponseWriter, r *http.Request) {
+	if registered, err := s.broker(r).IsRegistered(key(r)); err != nil || !registered {
+		if err == nil {
+			err = broker.ErrNotRegistered
+		}
+		handleError(w, r, err)
+		return
+	}
+
+	util.CountWithData("server.admin.upload", 1, "request_id=%q", r.Header.Get("Request-Id"))
+	if err := s.uploadOutput(requestContext(r), key(r), requestURI(r), s.StorageBaseURL(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
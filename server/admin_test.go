@@ -0,0 +1,239 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/heroku/busl/auth"
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// adminServer serves baseServer, configured with basic credentials
+// since the admin API is only served to authenticated clients. It
+// returns the URL of the server, carrying the credentials, and a
+// func stopping it.
+func adminServer() (string, func()) {
+	baseServer.Authenticator, _ = auth.New(auth.Options{Basic: "admin:secret"})
+	server := httptest.NewServer(baseServer.router())
+	return strings.Replace(server.URL, "http://", "http://admin:secret@", 1), func() {
+		server.Close()
+		baseServer.Authenticator = nil
+	}
+}
+
+func listStreams(t *testing.T, url string) map[string]*streamMeta {
+	streams := make(map[string]*streamMeta)
+	cursor := ""
+	for {
+		resp, err := http.Get(url + "&count=10&cursor=" + cursor)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var list streamList
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&list))
+		resp.Body.Close()
+		for _, meta := range list.Streams {
+			streams[meta.Key] = meta
+		}
+		if cursor = list.Cursor; cursor == "" {
+			return streams
+		}
+	}
+}
+
+func TestAdminListStreams(t *testing.T) {
+	url, stop := adminServer()
+	defer stop()
+
+	done, _ := util.NewUUID()
+	baseServer.Broker.Register(done, nil)
+	w, _ := baseServer.Broker.NewWriter(done)
+	w.Write([]byte("hello"))
+	w.Close()
+
+	running, _ := util.NewUUID()
+	baseServer.Broker.Register(running, nil)
+
+	streams := listStreams(t, url+"/admin/streams?")
+	assert.NotNil(t, streams[done])
+	assert.NotNil(t, streams[running])
+
+	streams = listStreams(t, url+"/admin/streams?done=true&min_size=5&max_age=1h")
+	assert.NotNil(t, streams[done])
+	assert.Nil(t, streams[running])
+	assert.Equal(t, int64(5), streams[done].Length)
+
+	streams = listStreams(t, url+"/admin/streams?min_age=1h")
+	assert.Nil(t, streams[done])
+}
+
+func TestAdminListInvalidFilter(t *testing.T) {
+	for _, query := range []string{"done=maybe", "min_size=-1", "max_age=1y", "count=0"} {
+		request, _ := http.NewRequest("GET", "/admin/streams?"+query, nil)
+		response := httptest.NewRecorder()
+		baseServer.listStreams(response, request)
+		assert.Equal(t, http.StatusBadRequest, response.Code)
+	}
+}
+
+func TestAdminInspectStream(t *testing.T) {
+	url, stop := adminServer()
+	defer stop()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid, nil)
+	r, _ := baseServer.Broker.NewReader(uuid)
+	defer r.Close()
+
+	resp, err := http.Get(url + "/admin/streams/" + uuid)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var meta streamMeta
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&meta))
+	assert.Equal(t, uuid, meta.Key)
+	assert.Equal(t, int64(1), meta.LocalSubscribers)
+}
+
+func TestAdminCloseAndDeleteStream(t *testing.T) {
+	url, stop := adminServer()
+	defer stop()
+
+	client := &http.Client{Transport: &http.Transport{}}
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid, nil)
+
+	request, _ := http.NewRequest("POST", url+"/admin/streams/"+uuid+"/close", nil)
+	resp, err := client.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	isDone, _ := baseServer.Broker.IsDone(uuid)
+	assert.True(t, isDone)
+
+	request, _ = http.NewRequest("DELETE", url+"/admin/streams/"+uuid, nil)
+	resp, err = client.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	registered, _ := baseServer.Broker.IsRegistered(uuid)
+	assert.False(t, registered)
+
+	resp, err = client.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestAdminUploadStream(t *testing.T) {
+	uuid, _ := util.NewUUID()
+
+	storage, _, put := fileServer(uuid)
+	defer storage.Close()
+
+	baseServer.StorageBaseURL = func(*http.Request) string { return storage.URL }
+	defer func() {
+		baseServer.StorageBaseURL = func(*http.Request) string { return "" }
+	}()
+
+	url, stop := adminServer()
+	defer stop()
+
+	baseServer.Broker.Register(uuid, nil)
+	w, _ := baseServer.Broker.NewWriter(uuid)
+	w.Write([]byte("hello world"))
+
+	resp, err := http.Post(url+"/admin/streams/"+uuid+"/upload", "", nil)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []byte("hello world"), <-put)
+}
+
+func TestAdminAuthentication(t *testing.T) {
+	baseServer.Authenticator, _ = auth.New(auth.Options{Basic: "u:pass"})
+	defer func() {
+		baseServer.Authenticator = nil
+	}()
+
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/admin/streams")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestAdminWithoutAuthenticator(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	assert.Nil(t, baseServer.Broker.Register(uuid, nil))
+
+	for _, route := range []struct{ method, path string }{
+		{"GET", "/admin/streams"},
+		{"GET", "/admin/streams/" + uuid},
+		{"POST", "/admin/streams/" + uuid + "/close"},
+		{"POST", "/admin/streams/" + uuid + "/upload"},
+		{"DELETE", "/admin/streams/" + uuid},
+	} {
+		request, _ := http.NewRequest(route.method, server.URL+route.path, nil)
+		resp, err := http.DefaultClient.Do(request)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, route.path)
+	}
+
+	registered, _ := baseServer.Broker.IsRegistered(uuid)
+	assert.True(t, registered)
+	done, _ := baseServer.Broker.IsDone(uuid)
+	assert.False(t, done)
+}
+
+type authenticatorFunc func(*http.Request) (*auth.Principal, error)
+
+func (f authenticatorFunc) Authenticate(r *http.Request) (*auth.Principal, error) {
+	return f(r)
+}
+
+func TestAdminScopedPrincipal(t *testing.T) {
+	baseServer.Authenticator = authenticatorFunc(func(*http.Request) (*auth.Principal, error) {
+		return &auth.Principal{Name: "team-a", Prefixes: []string{"team-a/"}, Operations: []string{auth.OpAdmin}}, nil
+	})
+	defer func() {
+		baseServer.Authenticator = nil
+	}()
+
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	allowed, denied := "team-a/"+uuid, "team-b/"+uuid
+	assert.Nil(t, baseServer.Broker.Register(allowed, nil))
+	assert.Nil(t, baseServer.Broker.Register(denied, nil))
+
+	streams := listStreams(t, server.URL+"/admin/streams?done=false")
+	assert.NotNil(t, streams[allowed])
+	assert.Nil(t, streams[denied])
+
+	for key, status := range map[string]int{allowed: http.StatusOK, denied: http.StatusForbidden} {
+		resp, err := http.Get(server.URL + "/admin/streams/" + key)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, status, resp.StatusCode, key)
+	}
+
+	// Not allowed to create streams.
+	request, _ := http.NewRequest("PUT", server.URL+"/streams/team-a/"+uuid+"/new", nil)
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/storage"
+)
+
+// compressor is a streaming compressor, which Flush makes output
+// everything written so far.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// contentEncoding compresses responses, and decodes blobs stored with
+// this encoding for clients not accepting it.
+type contentEncoding struct {
+	name          string
+	newCompressor func(io.Writer) compressor
+	newReader     func(io.Reader) (io.Reader, error)
+}
+
+// contentEncodings are the encodings negotiated with subscribers, by
+// order of preference.
+var contentEncodings = []*contentEncoding{
+	{
+		name: "br",
+		newCompressor: func(w io.Writer) compressor {
+			// Subscribers each get their own window, so it's kept small.
+			return brotli.NewWriterOptions(w, brotli.WriterOptions{Quality: 4, LGWin: 18})
+		},
+		newReader: func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+	},
+	{
+		name:          "gzip",
+		newCompressor: func(w io.Writer) compressor { return gzip.NewWriter(w) },
+		newReader:     func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	},
+}
+
+// acceptedEncodings returns the supported content encodings of the
+// Accept-Encoding header, by order of preference.
+func acceptedEncodings(r *http.Request) []*contentEncoding {
+	q := make(map[string]float64)
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				var err error
+				if quality, err = strconv.ParseFloat(param[2:], 64); err != nil {
+					quality = 0
+				}
+			}
+		}
+		q[name] = quality
+	}
+
+	// Encodings not listed get the quality of *, if any.
+	quality := func(e *contentEncoding) (float64, bool) {
+		if v, ok := q[e.name]; ok {
+			return v, true
+		}
+		v, ok := q["*"]
+		return v, ok
+	}
+
+	var accepted []*contentEncoding
+	for _, e := range contentEncodings {
+		if v, ok := quality(e); ok && v > 0 {
+			accepted = append(accepted, e)
+		}
+	}
+	sort.SliceStable(accepted, func(i, j int) bool {
+		qi, _ := quality(accepted[i])
+		qj, _ := quality(accepted[j])
+		return qi > qj
+	})
+	return accepted
+}
+
+// newCompressor negotiates the content encoding of the response, and
+// returns the compressor writing to w, or nil to leave it as is. Ranges
+// and responses encoded already are left as is.
+func newCompressor(w http.ResponseWriter, r *http.Request) compressor {
+	h := w.Header()
+	h.Add("Vary", "Accept-Encoding")
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return nil
+	}
+
+	accepted := acceptedEncodings(r)
+	if len(accepted) == 0 {
+		return nil
+	}
+	h.Set("Content-Encoding", accepted[0].name)
+	return accepted[0].newCompressor(w)
+}
+
+// newEncodedReader opens streams served from storage, as they're
+// stored: blobs compressed with an encoding the client accepts are
+// passed through, the Content-Encoding being set. Streams still in
+// the broker are opened from there.
+func (s *Server) newEncodedReader(w http.ResponseWriter, r *http.Request) (io.ReadCloser, error) {
+	rd, err := s.broker(r).NewReader(key(r))
+	if err != broker.ErrNotRegistered {
+		return rd, err
+	}
+
+	accepted := acceptedEncodings(r)
+	var names []string
+	for _, e := range accepted {
+		names = append(names, e.name)
+	}
+
+	rd, encoding, err := storage.GetEncodedContext(requestContext(r), requestURI(r), s.StorageBaseURL(r), strings.Join(names, ", "))
+	if err != nil || encoding == "" || encoding == "identity" {
+		return rd, err
+	}
+
+	for _, e := range accepted {
+		if e.name == encoding {
+			w.Header().Set("Content-Encoding", encoding)
+			return rd, nil
+		}
+	}
+
+	// Stored with an encoding the client doesn't accept.
+	for _, e := range contentEncodings {
+		if e.name == encoding {
+			decoded, err := e.newReader(rd)
+			if err != nil {
+				rd.Close()
+				return nil, err
+			}
+			return &readCloser{decoded, rd}, nil
+		}
+	}
+	return rd, nil
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptedEncodings(t *testing.T) {
+	data := []struct {
+		header   string
+		accepted []string
+	}{
+		{"", nil},
+		{"identity", nil},
+		{"gzip", []string{"gzip"}},
+		{"gzip, deflate, br", []string{"br", "gzip"}},
+		{"br;q=0.5, gzip", []string{"gzip", "br"}},
+		{"GZIP;q=1.0, br;q=0", []string{"gzip"}},
+		{"*", []string{"br", "gzip"}},
+		{"*;q=0.1, gzip", []string{"gzip", "br"}},
+	}
+
+	for _, d := range data {
+		r, _ := http.NewRequest("GET", "/streams/1", nil)
+		r.Header.Set("Accept-Encoding", d.header)
+
+		var accepted []string
+		for _, e := range acceptedEncodings(r) {
+			accepted = append(accepted, e.name)
+		}
+		assert.Equal(t, d.accepted, accepted, d.header)
+	}
+}
+
+func TestSubscribeGzip(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid, nil)
+	w, _ := baseServer.Broker.NewWriter(uuid)
+	w.Write([]byte("hello"))
+
+	request, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid, nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+
+	// What's written so far is flushed, while the stream runs.
+	gz, err := gzip.NewReader(resp.Body)
+	assert.Nil(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(gz, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	w.Write([]byte(" world"))
+	w.Close()
+	rest, err := ioutil.ReadAll(gz)
+	assert.Nil(t, err)
+	assert.Equal(t, " world", string(rest))
+}
+
+func TestSubscribeBrotli(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid, nil)
+	w, _ := baseServer.Broker.NewWriter(uuid)
+	w.Write([]byte("hello world"))
+	w.Close()
+
+	request, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid, nil)
+	request.Header.Set("Accept-Encoding", "gzip;q=0.5, br")
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "br", resp.Header.Get("Content-Encoding"))
+
+	body, err := ioutil.ReadAll(brotli.NewReader(resp.Body))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", string(body))
+}
+
+func TestSubscribeEncodedWithBackend(t *testing.T) {
+	uuid, _ := util.NewUUID()
+
+	var stored bytes.Buffer
+	gz := gzip.NewWriter(&stored)
+	gz.Write([]byte("hello world"))
+	gz.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+uuid, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(stored.Bytes())
+	})
+	storage := httptest.NewServer(mux)
+	defer storage.Close()
+
+	baseServer.StorageBaseURL = func(*http.Request) string { return storage.URL }
+	defer func() {
+		baseServer.StorageBaseURL = func(*http.Request) string { return "" }
+	}()
+
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	// Passed through as stored.
+	request, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid, nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, stored.Bytes(), body)
+
+	// Decoded for clients not accepting it, and compressed again.
+	request.Header.Set("Accept-Encoding", "br")
+	resp, err = http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "br", resp.Header.Get("Content-Encoding"))
+	body, _ = ioutil.ReadAll(brotli.NewReader(resp.Body))
+	assert.Equal(t, "hello world", string(body))
+}
+
+func TestSubscribeGzipHeartbeat(t *testing.T) {
+	s := NewServer(&Config{
+		HeartbeatDuration: 10 * time.Millisecond,
+		StorageBaseURL:    func(*http.Request) string { return "" },
+		Broker:            baseServer.Broker,
+	})
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	s.Broker.Register(uuid, nil)
+	w, _ := s.Broker.NewWriter(uuid)
+	defer w.Close()
+
+	request, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid, nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	// Acks get through the compressor while the stream is idle.
+	gz, err := gzip.NewReader(resp.Body)
+	assert.Nil(t, err)
+	buf := make([]byte, 1)
+	_, err = io.ReadFull(gz, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0}, buf)
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heroku/busl/util"
+)
+
+const (
+	corsAllowMethods = "GET, HEAD, POST, PUT, DELETE"
+	corsAllowHeaders = "Accept, Accept-Encoding, Authorization, Content-Type, Content-Length, " +
+		"If-None-Match, Last-Event-ID, Range, Request-ID, X-CSRF-Token"
+	corsMaxAge = 10 * time.Minute
+)
+
+// defaultExposeHeaders are exposed to cross-origin scripts unless
+// CORSExposeHeaders is set.
+var defaultExposeHeaders = []string{
+	"Cache-Control", "Content-Type", "Content-Range", "Expires", "Last-Modified",
+	"Stream-Source", "Stream-Created", "Stream-Length", "Stream-Done",
+	"Stream-Request-ID", "Stream-TTL", "Stream-Subscribers",
+}
+
+// allowedOrigin returns the Access-Control-Allow-Origin of the
+// origin, empty if the origin isn't in the CORSOrigins allowlist.
+// Entries are either exact origins, origins whose host starts with
+// "*." to match its subdomains, or "*" for any origin, which is
+// never allowed credentials.
+func (s *Server) allowedOrigin(origin string) string {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+
+	for _, allowed := range s.CORSOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if matchOrigin(allowed, u) {
+			return origin
+		}
+	}
+	return ""
+}
+
+func matchOrigin(allowed string, origin *url.URL) bool {
+	parts := strings.SplitN(allowed, "://", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], origin.Scheme) {
+		return false
+	}
+
+	host := strings.ToLower(origin.Host)
+	pattern := strings.ToLower(parts[1])
+	if strings.HasPrefix(pattern, "*.") {
+		return len(host) > len(pattern)-1 && strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+// corsHeaders sets the CORS headers of the response, if the origin
+// of the request is allowed.
+func (s *Server) corsHeaders(w http.ResponseWriter, r *http.Request) bool {
+	if len(s.CORSOrigins) == 0 {
+		return false
+	}
+	w.Header().Add("Vary", "Origin")
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	allowed := s.allowedOrigin(origin)
+	if allowed == "" {
+		util.CountWithData("server.cors.denied", 1, "origin=%q", origin)
+		return false
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", allowed)
+	if s.CORSCredentials && allowed != "*" {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	expose := s.CORSExposeHeaders
+	if expose == nil {
+		expose = defaultExposeHeaders
+	}
+	if len(expose) > 0 {
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(expose, ", "))
+	}
+	return true
+}
+
+// preflight answers CORS preflight requests.
+func (s *Server) preflight(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", "OPTIONS, "+corsAllowMethods)
+	if r.Header.Get("Access-Control-Request-Method") == "" {
+		// Not a preflight request.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if !s.corsHeaders(w, r) {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	w.Header().Del("Access-Control-Expose-Headers")
+	w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+	w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+	w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkWebSocketOrigin allows same-origin WebSocket connections, and
+// those allowed by the CORS policy. Clients other than browsers send
+// no origin.
+func (s *Server) checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return s.allowedOrigin(origin) != ""
+}
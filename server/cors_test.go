@@ -0,0 +1,156 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func newCORSServer(origins ...string) *Server {
+	return NewServer(&Config{
+		StorageBaseURL:  func(*http.Request) string { return "" },
+		Broker:          baseServer.Broker,
+		CORSOrigins:     origins,
+		CORSCredentials: true,
+	})
+}
+
+func TestAllowedOrigin(t *testing.T) {
+	s := newCORSServer("https://app.example.com", "https://*.example.org", "http://localhost:3000")
+
+	for origin, allowed := range map[string]string{
+		"https://app.example.com":      "https://app.example.com",
+		"https://APP.example.com":      "https://APP.example.com",
+		"https://a.b.example.org":      "https://a.b.example.org",
+		"http://localhost:3000":        "http://localhost:3000",
+		"http://app.example.com":       "",
+		"https://example.org":          "",
+		"https://evilexample.org":      "",
+		"https://app.example.com.evil": "",
+		"http://localhost:3001":        "",
+		"null":                         "",
+	} {
+		assert.Equal(t, allowed, s.allowedOrigin(origin), origin)
+	}
+
+	// Any origin, but without credentials.
+	s = newCORSServer("*")
+	assert.Equal(t, "*", s.allowedOrigin("https://any.com"))
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("HEAD", "/streams/1", nil)
+	r.Header.Set("Origin", "https://any.com")
+	assert.True(t, s.corsHeaders(w, r))
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "", w.Header().Get("Access-Control-Allow-Credentials"))
+}
+
+func TestCORSHeaders(t *testing.T) {
+	s := newCORSServer("https://*.example.com")
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	assert.Nil(t, s.Broker.Register(uuid, nil))
+
+	request, _ := http.NewRequest("HEAD", server.URL+"/streams/"+uuid, nil)
+	request.Header.Set("Origin", "https://app.example.com")
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", resp.Header.Get("Access-Control-Allow-Credentials"))
+	assert.Contains(t, resp.Header.Get("Access-Control-Expose-Headers"), "Stream-Length")
+	assert.Equal(t, "Origin", resp.Header.Get("Vary"))
+
+	request.Header.Set("Origin", "https://evil.com")
+	resp, err = http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "", resp.Header.Get("Access-Control-Allow-Credentials"))
+
+	s.CORSExposeHeaders = []string{"Stream-Done"}
+	request.Header.Set("Origin", "https://app.example.com")
+	resp, err = http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "Stream-Done", resp.Header.Get("Access-Control-Expose-Headers"))
+}
+
+func TestCORSDisabled(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	request, _ := http.NewRequest("PUT", server.URL+"/streams/"+uuid, nil)
+	request.Header.Set("Origin", "https://app.example.com")
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	for name := range resp.Header {
+		assert.False(t, strings.HasPrefix(name, "Access-Control-"), name)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	s := newCORSServer("https://app.example.com")
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	preflight := func(origin string) *http.Response {
+		request, _ := http.NewRequest("OPTIONS", server.URL+"/streams/1/2/3", nil)
+		request.Header.Set("Origin", origin)
+		request.Header.Set("Access-Control-Request-Method", "POST")
+		request.Header.Set("Access-Control-Request-Headers", "authorization")
+		resp, err := http.DefaultClient.Do(request)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := preflight("https://app.example.com")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, resp.Header.Get("Access-Control-Allow-Methods"), "POST")
+	assert.Contains(t, resp.Header.Get("Access-Control-Allow-Headers"), "Authorization")
+	assert.Equal(t, "600", resp.Header.Get("Access-Control-Max-Age"))
+
+	resp = preflight("https://evil.com")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, "", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "", resp.Header.Get("Access-Control-Allow-Methods"))
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	s := newCORSServer("https://app.example.com")
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	assert.Nil(t, s.Broker.Register(uuid, nil))
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/streams/" + uuid
+
+	for origin, status := range map[string]int{
+		"":                        http.StatusSwitchingProtocols,
+		server.URL:                http.StatusSwitchingProtocols,
+		"https://app.example.com": http.StatusSwitchingProtocols,
+		"https://evil.com":        http.StatusForbidden,
+	} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, resp, _ := websocket.DefaultDialer.Dial(url, header)
+		if conn != nil {
+			conn.Close()
+		}
+		assert.Equal(t, status, resp.StatusCode, origin)
+	}
+}
@@ -2,27 +2,84 @@ package server
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/storage"
 	"github.com/heroku/busl/util"
 )
 
 func (s *Server) createStream(w http.ResponseWriter, r *http.Request) {
-	registrar := broker.NewRedisRegistrar()
+	opts, err := s.streamOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.RequestID = w.Header().Get("Request-ID")
 
-	if err := registrar.Register(key(r)); err != nil {
+	// Creating a stream is idempotent: existing streams are left
+	// untouched, unless explicitly reset. Callers requiring a new
+	// stream send If-None-Match: *.
+	if r.URL.Query().Get("reset") == "true" {
+		// Resetting hands out new tokens, so it takes the
+		// admin token of the stream, if it exists.
+		if err := s.verifyReset(r); err != nil {
+			util.CountWithData("server.token.denied", 1, "scope=%s error=%q", scopeAdmin, err)
+			handleError(w, r, err)
+			return
+		}
+		err = s.broker(r).Reset(key(r), opts)
+	} else {
+		err = s.broker(r).Register(key(r), opts)
+	}
+
+	if err == broker.ErrAlreadyRegistered {
+		if r.Header.Get("If-None-Match") == "*" {
+			util.Count("put.create.conflict")
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		// The tokens are only handed out to the creator.
+		util.Count("put.create.exists")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if err != nil {
 		http.Error(w, "Unable to create stream. Please try again.", http.StatusServiceUnavailable)
 		util.CountWithData("put.create.fail", 1, "error=%s", err)
 		handleError(w, r, err)
 		return
 	}
 	util.Count("put.create.success")
+	s.writeCreated(w, r)
+}
+
+// writeCreated replies to stream creations, with the stream
+// tokens if the server signs them.
+func (s *Server) writeCreated(w http.ResponseWriter, r *http.Request) {
+	if len(s.TokenSecret) == 0 {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	meta, err := s.broker(r).Meta(key(r))
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
 	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s.newStreamTokens(key(r), meta.Nonce))
 }
 
 func (s *Server) health(w http.ResponseWriter, r *http.Request) {
@@ -30,16 +87,20 @@ func (s *Server) health(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) publish(w http.ResponseWriter, r *http.Request) {
-	writer, err := broker.NewWriter(key(r))
+	defer util.MeasureSince("server.pub.duration", time.Now())
+
+	writer, err := s.broker(r).NewWriter(key(r))
 	if err != nil {
 		handleError(w, r, err)
 		return
 	}
+	util.GaugeAdd("server.publishers", 1)
+	defer util.GaugeAdd("server.publishers", -1)
 
 	body := bufio.NewReader(r.Body)
 	defer r.Body.Close()
 
-	wl, err := broker.Len(writer)
+	wl, err := s.broker(r).Len(key(r))
 	if err != nil {
 		handleError(w, r, err)
 		return
@@ -60,6 +121,12 @@ func (s *Server) publish(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err == broker.ErrTooLarge {
+		util.CountWithData("server.pub.tooLarge", 1, "request_id=%q", r.Header.Get("Request-Id"))
+		handleError(w, r, err)
+		return
+	}
+
 	netErr, ok := err.(net.Error)
 	if ok && netErr.Timeout() {
 		util.CountWithData("server.pub.read.timeout", 1, "msg=%q request_id=%q", err, r.Header.Get("Request-Id"))
@@ -77,7 +144,7 @@ func (s *Server) publish(w http.ResponseWriter, r *http.Request) {
 	util.CountWithData("server.pub.read.end", 1, "request_id=%q", r.Header.Get("Request-Id"))
 	writer.Close()
 	// Asynchronously upload the output to our defined storage backend.
-	go storeOutput(key(r), requestURI(r), s.StorageBaseURL(r))
+	go s.storeOutput(requestContext(r), key(r), requestURI(r), s.StorageBaseURL(r))
 }
 
 func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) {
@@ -94,7 +161,20 @@ func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) {
 		handleError(w, r, err)
 		return
 	}
-	_, err = io.Copy(newWriteFlusher(w), rd)
+	util.GaugeAdd("server.subscribers", 1)
+	defer util.GaugeAdd("server.subscribers", -1)
+	defer util.MeasureSince("server.sub.duration", time.Now())
+
+	out := newWriteFlusher(w)
+	c := newCompressor(w, r)
+	if c != nil {
+		out = newCompressingWriteFlusher(w, c)
+	}
+	_, err = io.Copy(out, rd)
+	if c != nil && err == nil {
+		// Only complete streams get the end of the compressed stream.
+		err = c.Close()
+	}
 
 	netErr, ok := err.(net.Error)
 	if ok && netErr.Timeout() {
@@ -109,7 +189,7 @@ func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) closeStream(w http.ResponseWriter, r *http.Request) {
-	writer, err := broker.NewWriter(key(r))
+	writer, err := s.broker(r).NewWriter(key(r))
 	if err != nil {
 		handleError(w, r, err)
 		return
@@ -122,5 +202,115 @@ func (s *Server) closeStream(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// Asynchronously upload the output to our defined storage backend.
-	go storeOutput(key(r), requestURI(r), s.StorageBaseURL(r))
+	go s.storeOutput(requestContext(r), key(r), requestURI(r), s.StorageBaseURL(r))
+}
+
+// streamMeta describes a stream, as returned by GET /streams/{key}/meta
+type streamMeta struct {
+	Key         string     `json:"key"`
+	Source      string     `json:"source"` // broker, or storage once the stream expired
+	Created     *time.Time `json:"created_at,omitempty"`
+	LastWrite   *time.Time `json:"last_write_at,omitempty"`
+	Length      int64      `json:"length"`
+	Done        bool       `json:"done"`
+	ContentType string     `json:"content_type,omitempty"`
+	RequestID   string     `json:"request_id,omitempty"`
+	MaxSize     int64      `json:"max_size,omitempty"`
+	Overflow    string     `json:"overflow,omitempty"`
+	TTL         int64      `json:"ttl"` // in seconds
+	Subscribers int64      `json:"subscribers"`
+
+	LocalSubscribers int64 `json:"local_subscribers"` // on this instance
+}
+
+// timeOrNil returns nil for the zero time
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+// streamMeta returns the metadata of the stream, falling
+// back to the storage backend for expired streams.
+func (s *Server) streamMeta(r *http.Request) (*streamMeta, error) {
+	meta, err := s.broker(r).Meta(key(r))
+	if err == broker.ErrNotRegistered {
+		info, err := storage.StatContext(requestContext(r), requestURI(r), s.StorageBaseURL(r))
+		if err != nil {
+			return nil, err
+		}
+		return &streamMeta{
+			Key:         key(r),
+			Source:      "storage",
+			LastWrite:   timeOrNil(info.LastModified),
+			Length:      info.Length,
+			Done:        true,
+			ContentType: info.ContentType,
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newStreamMeta(key(r), meta), nil
+}
+
+func newStreamMeta(key string, meta *broker.StreamMeta) *streamMeta {
+	return &streamMeta{
+		Key:         key,
+		Source:      "broker",
+		Created:     timeOrNil(meta.Created),
+		LastWrite:   timeOrNil(meta.LastWrite),
+		Length:      meta.Length,
+		Done:        meta.Done,
+		ContentType: meta.ContentType,
+		RequestID:   meta.RequestID,
+		MaxSize:     meta.MaxSize,
+		Overflow:    string(meta.Overflow),
+		TTL:         int64(meta.TTL / time.Second),
+		Subscribers: meta.Subscribers,
+
+		LocalSubscribers: meta.LocalSubscribers,
+	}
+}
+
+func (s *Server) headStream(w http.ResponseWriter, r *http.Request) {
+	meta, err := s.streamMeta(r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("Stream-Source", meta.Source)
+	h.Set("Stream-Length", strconv.FormatInt(meta.Length, 10))
+	h.Set("Stream-Done", strconv.FormatBool(meta.Done))
+	h.Set("Stream-TTL", strconv.FormatInt(meta.TTL, 10))
+	h.Set("Stream-Subscribers", strconv.FormatInt(meta.Subscribers, 10))
+	if meta.Created != nil {
+		h.Set("Stream-Created", meta.Created.Format(http.TimeFormat))
+	}
+	if meta.LastWrite != nil {
+		h.Set("Last-Modified", meta.LastWrite.Format(http.TimeFormat))
+	}
+	if meta.ContentType != "" {
+		h.Set("Content-Type", meta.ContentType)
+	}
+	if meta.RequestID != "" {
+		h.Set("Stream-Request-ID", meta.RequestID)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) getStreamMeta(w http.ResponseWriter, r *http.Request) {
+	meta, err := s.streamMeta(r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	writeJSON(w, meta)
 }
@@ -12,6 +12,11 @@ import (
 
 var errNoContent = errors.New("No Content")
 
+// badRequestError reports invalid request parameters
+type badRequestError struct {
+	error
+}
+
 const asciiGone = `░░░░░░░░░░██░░░░░░░░░░██░░░░░░░░
 ░░░░░░░░██░░██░░░░░░██░░██░░░░░░
 ░░░░░░░░██░░░░██████░░░░██░░░░░░
@@ -30,15 +35,33 @@ const asciiGone = `░░░░░░░░░░██░░░░░░░░
 ░░░░██░░░░██░░██░░██░░██░░░░░░░░`
 
 func handleError(w http.ResponseWriter, r *http.Request, err error) {
+	if _, ok := err.(badRequestError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	switch err {
 	case broker.ErrNotRegistered, storage.ErrNoStorage, storage.ErrNotFound:
 		message := "Channel is not registered."
-		if r.Header.Get("Accept") == "text/ascii; version=feral" {
+		if acceptsFeral(r) {
 			message = asciiGone
 		}
 
 		http.Error(w, message, http.StatusNotFound)
 
+	case broker.ErrTooLarge:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+
+	case errTokenRequired:
+		w.Header().Set("WWW-Authenticate", `Bearer realm="busl"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+
+	case errTokenInvalid, errTokenExpired:
+		http.Error(w, err.Error(), http.StatusForbidden)
+
+	case errNotAcceptable:
+		http.Error(w, "Acceptable media types: "+acceptable(), http.StatusNotAcceptable)
+
 	case storage.ErrRange:
 		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
 
@@ -55,6 +78,16 @@ func handleError(w http.ResponseWriter, r *http.Request, err error) {
 	}
 }
 
+// acceptsFeral returns whether the client accepts feral ASCII art
+func acceptsFeral(r *http.Request) bool {
+	for _, m := range parseAccept(r.Header.Get("Accept")) {
+		if m.mediaType == "text/ascii" && m.params["version"] == "feral" && m.q > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func logError(req *http.Request, err error) {
 	rollbar.ErrorWithExtras(rollbar.ERR, err, map[string]interface{}{
 		"request_id": req.Header.Get("Request-Id"),
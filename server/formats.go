@@ -0,0 +1,221 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heroku/busl/encoders"
+)
+
+var errNotAcceptable = errors.New("Not Acceptable")
+
+// format delivers streams as the media types it's registered for
+type format struct {
+	name       string   // for the format query parameter
+	mediaTypes []string // the first one being sent as Content-Type
+	ranges     bool     // whether Range requests are served
+
+	// delivery sets up the encoder writing rd in this format, given the
+	// parameters of the media range accepted.
+	delivery func(s *Server, w http.ResponseWriter, r *http.Request, rd io.ReadCloser, params map[string]string) (*delivery, error)
+}
+
+// delivery is how a stream gets written to a subscriber
+type delivery struct {
+	encoder encoders.Encoder
+	header  string // written before the stream
+	ack     []byte // written while the stream is idle
+}
+
+// formats are the formats subscribers can negotiate, by order of
+// preference when the Accept header doesn't tell.
+var formats = []*format{
+	{name: "text", mediaTypes: []string{"text/plain", "text/ascii", "application/octet-stream"}, ranges: true, delivery: (*Server).textDelivery},
+	{name: "sse", mediaTypes: []string{"text/event-stream"}, delivery: (*Server).sseDelivery},
+	{name: "ndjson", mediaTypes: []string{"application/x-ndjson"}, delivery: (*Server).ndjsonDelivery},
+	{name: "html", mediaTypes: []string{"text/html"}, delivery: (*Server).htmlDelivery},
+}
+
+// mediaRange is one of the media ranges of an Accept header
+type mediaRange struct {
+	mediaType string // type/subtype, type/* or */*
+	params    map[string]string
+	q         float64
+}
+
+// matches returns whether the range includes mediaType, and how
+// specifically: 2 for the exact type, 1 for type/* and 0 for */*.
+func (m *mediaRange) matches(mediaType string) (bool, int) {
+	switch {
+	case m.mediaType == mediaType:
+		return true, 2
+	case m.mediaType == "*/*":
+		return true, 0
+	case strings.HasSuffix(m.mediaType, "/*"):
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(m.mediaType, "*")), 1
+	}
+	return false, 0
+}
+
+// parseAccept returns the media ranges of an Accept header, skipping
+// the ones that can't be parsed.
+func parseAccept(header string) []*mediaRange {
+	var ranges []*mediaRange
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil || !strings.Contains(mediaType, "/") {
+			continue
+		}
+
+		q := 1.0
+		if val, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(val, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+			delete(params, "q")
+		}
+		ranges = append(ranges, &mediaRange{mediaType, params, q})
+	}
+	return ranges
+}
+
+// quality returns the media range setting the quality of mediaType,
+// being the most specific range including it, and its specificity.
+func quality(ranges []*mediaRange, mediaType string) (*mediaRange, int) {
+	var best *mediaRange
+	bestSpecificity := -1
+	for _, m := range ranges {
+		if ok, specificity := m.matches(mediaType); ok && specificity > bestSpecificity {
+			best, bestSpecificity = m, specificity
+		}
+	}
+	return best, bestSpecificity
+}
+
+// negotiate picks the format of the format query parameter, or else
+// the one of highest quality in the Accept header, preferring exact
+// media types over wildcards. It fails with errNotAcceptable if none
+// is acceptable.
+func negotiate(r *http.Request) (*format, map[string]string, error) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		for _, f := range formats {
+			if f.name == name {
+				return f, nil, nil
+			}
+		}
+		return nil, nil, badRequestError{fmt.Errorf("Unknown format %q", name)}
+	}
+
+	ranges := parseAccept(r.Header.Get("Accept"))
+	if len(ranges) == 0 {
+		return formats[0], nil, nil
+	}
+
+	var best *format
+	var bestParams map[string]string
+	bestQ, bestSpecificity := 0.0, -1
+	for _, f := range formats {
+		for _, mediaType := range f.mediaTypes {
+			m, specificity := quality(ranges, mediaType)
+			if m == nil || m.q == 0 {
+				continue
+			}
+			if m.q > bestQ || m.q == bestQ && specificity > bestSpecificity {
+				best, bestQ, bestSpecificity = f, m.q, specificity
+				bestParams = nil
+				if specificity == 2 {
+					bestParams = m.params
+				}
+			}
+		}
+	}
+
+	if best == nil {
+		return nil, nil, errNotAcceptable
+	}
+	return best, bestParams, nil
+}
+
+// acceptable lists the media types subscribers can negotiate
+func acceptable() string {
+	var mediaTypes []string
+	for _, f := range formats {
+		mediaTypes = append(mediaTypes, f.mediaTypes...)
+	}
+	return strings.Join(mediaTypes, ", ")
+}
+
+func (s *Server) textDelivery(w http.ResponseWriter, r *http.Request, rd io.ReadCloser, params map[string]string) (*delivery, error) {
+	// We use a null byte for sending the keepalive ack.
+	return &delivery{encoder: encoders.NewTextEncoder(rd), ack: []byte{0}}, nil
+}
+
+func (s *Server) sseDelivery(w http.ResponseWriter, r *http.Request, rd io.ReadCloser, params map[string]string) (*delivery, error) {
+	d := &delivery{}
+
+	// The encoding query parameter overrides the one accepted.
+	encoding := params["encoding"]
+	if val := r.URL.Query().Get("encoding"); val != "" {
+		encoding = val
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	switch encoding {
+	case "base64":
+		w.Header().Set("Content-Type", "text/event-stream; encoding=base64")
+		d.encoder = encoders.NewSSEBase64Encoder(rd)
+	case "html":
+		d.encoder = encoders.NewSSEHTMLEncoder(rd)
+	case "":
+		if r.URL.Query().Get("buffer") == "lines" {
+			d.encoder = encoders.NewSSELineEncoder(rd, s.LineFlushDuration)
+		} else {
+			d.encoder = encoders.NewSSEEncoder(rd)
+		}
+	default:
+		return nil, badRequestError{fmt.Errorf("Unsupported encoding %q", encoding)}
+	}
+	d.encoder = encoders.NewSSEEndEncoder(d.encoder, s.endEvent(r))
+
+	if s.SSERetryDuration > 0 {
+		d.header = fmt.Sprintf("retry: %d\n\n", s.SSERetryDuration/time.Millisecond)
+	}
+
+	// For SSE, we change the ack to a :keepalive, or to
+	// an event clients can listen to.
+	d.ack = []byte(":keepalive\n")
+	if r.URL.Query().Get("heartbeat") == "event" {
+		d.ack = []byte("event: heartbeat\ndata: \n\n")
+	}
+	return d, nil
+}
+
+func (s *Server) ndjsonDelivery(w http.ResponseWriter, r *http.Request, rd io.ReadCloser, params map[string]string) (*delivery, error) {
+	line := int64(1)
+	if val := r.URL.Query().Get("line"); val != "" {
+		var err error
+		if line, err = strconv.ParseInt(val, 10, 64); err != nil || line < 1 {
+			return nil, badRequestError{fmt.Errorf("Invalid line %q", val)}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	// Keep every line valid JSON.
+	return &delivery{encoder: encoders.NewNDJSONEncoder(rd, line), ack: []byte("{\"heartbeat\":true}\n")}, nil
+}
+
+func (s *Server) htmlDelivery(w http.ResponseWriter, r *http.Request, rd io.ReadCloser, params map[string]string) (*delivery, error) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	// An empty comment doesn't show in the document.
+	return &delivery{encoder: encoders.NewHTMLEncoder(rd), header: htmlHeader, ack: []byte("<!---->")}, nil
+}
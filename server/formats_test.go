@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiate(t *testing.T) {
+	data := []struct {
+		accept string
+		query  string
+		format string
+		params map[string]string
+	}{
+		{"", "", "text", nil},
+		{"*/*", "", "text", nil},
+		{"text/event-stream", "", "sse", map[string]string{}},
+		{"text/event-stream, */*", "", "sse", map[string]string{}},
+		{"text/event-stream; encoding=base64", "", "sse", map[string]string{"encoding": "base64"}},
+		{"text/plain;q=0.5, text/event-stream;q=0.8", "", "sse", map[string]string{}},
+		{"application/x-ndjson, */*;q=0.1", "", "ndjson", map[string]string{}},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "", "html", map[string]string{}},
+		{"text/*", "", "text", nil},
+		{"text/*;q=0.5, text/event-stream", "", "sse", map[string]string{}},
+		{"text/ascii; version=feral", "", "text", map[string]string{"version": "feral"}},
+		{"text/event-stream", "format=text", "text", nil},
+		{"", "format=ndjson", "ndjson", nil},
+		{"invalid", "", "text", nil},
+	}
+
+	for _, d := range data {
+		r, _ := http.NewRequest("GET", "/streams/1?"+d.query, nil)
+		r.Header.Set("Accept", d.accept)
+		f, params, err := negotiate(r)
+		if assert.Nil(t, err, d.accept) {
+			assert.Equal(t, d.format, f.name, d.accept)
+			assert.Equal(t, d.params, params, d.accept)
+		}
+	}
+}
+
+func TestNegotiateFailure(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/streams/1", nil)
+	r.Header.Set("Accept", "application/json")
+	_, _, err := negotiate(r)
+	assert.Equal(t, errNotAcceptable, err)
+
+	r.Header.Set("Accept", "text/event-stream;q=0")
+	_, _, err = negotiate(r)
+	assert.Equal(t, errNotAcceptable, err)
+
+	r, _ = http.NewRequest("GET", "/streams/1?format=xml", nil)
+	_, _, err = negotiate(r)
+	assert.IsType(t, badRequestError{}, err)
+}
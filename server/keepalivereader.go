@@ -4,7 +4,6 @@ import (
 	"io"
 	"time"
 
-	"github.com/heroku/busl/broker"
 	"github.com/heroku/busl/util"
 )
 
@@ -21,9 +20,10 @@ type keepAliveReader struct {
 	ch       chan *payload // where all the original reads go to
 	done     <-chan bool   // closeNotifier
 	eof      bool          // marked true when we hit EOF
+	renew    func()        // called on every ack to keep the stream alive
 }
 
-func newKeepAliveReader(r io.Reader, packet []byte, interval time.Duration, done <-chan bool) io.ReadCloser {
+func newKeepAliveReader(r io.Reader, packet []byte, interval time.Duration, done <-chan bool, renew func()) io.ReadCloser {
 	ch := make(chan *payload, 100)
 
 	go func() {
@@ -38,7 +38,7 @@ func newKeepAliveReader(r io.Reader, packet []byte, interval time.Duration, done
 		}
 	}()
 
-	return &keepAliveReader{r: r, ch: ch, done: done, packet: packet, interval: interval}
+	return &keepAliveReader{r: r, ch: ch, done: done, packet: packet, interval: interval, renew: renew}
 }
 
 func (r *keepAliveReader) Read(p []byte) (int, error) {
@@ -63,7 +63,9 @@ func (r *keepAliveReader) Read(p []byte) (int, error) {
 
 	case <-timer.C:
 		util.Count("server.sub.keepAlive")
-		broker.RenewExpiry(r.r)
+		if r.renew != nil {
+			r.renew()
+		}
 		return copy(p, r.packet), nil
 
 	case <-r.done:
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/heroku/busl/util"
+)
+
+// serveMetrics serves the metrics to the clients sending the
+// MetricsToken, if set. Scrapers get their own token rather than
+// admin credentials, which would let them manage every stream.
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if s.MetricsToken != "" {
+		token := requestToken(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="busl"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.MetricsToken)) != 1 {
+			util.Count("server.metrics.denied")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+	s.Metrics.ServeHTTP(w, r)
+}
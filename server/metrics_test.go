@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/heroku/busl/auth"
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	p := util.NewPrometheus()
+	util.SetSinks(util.LogSink{}, p)
+	defer util.SetSinks(util.LogSink{})
+
+	s := NewServer(&Config{
+		HeartbeatDuration: time.Second,
+		StorageBaseURL:    func(*http.Request) string { return "" },
+		Broker:            baseServer.Broker,
+		Metrics:           p,
+		MetricsToken:      "scraper",
+	})
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	assert.Nil(t, s.Broker.Register(uuid, nil))
+	resp, err := http.Post(server.URL+"/streams/"+uuid, "", bytes.NewBufferString("hello"))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	resp, err = http.Get(server.URL + "/streams/" + uuid)
+	assert.Nil(t, err)
+	resp.Body.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/metrics", nil)
+	req.Header.Set("Authorization", "Bearer scraper")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	// Other tests may still be reporting metrics.
+	for _, metric := range []string{
+		`busl_http_status_total{status="2xx"} `,
+		"busl_server_pub_duration_seconds_count ",
+		"busl_server_sub_duration_seconds_count ",
+		"busl_server_publishers ",
+		"busl_server_subscribers ",
+	} {
+		assert.Contains(t, string(body), "\n"+metric)
+	}
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/metrics")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestMetricsToken(t *testing.T) {
+	authenticator, _ := auth.New(auth.Options{Basic: "admin:secret"})
+	s := NewServer(&Config{
+		HeartbeatDuration: time.Second,
+		StorageBaseURL:    func(*http.Request) string { return "" },
+		Broker:            baseServer.Broker,
+		Authenticator:     authenticator,
+		Metrics:           util.NewPrometheus(),
+		MetricsToken:      "scraper",
+	})
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	for _, c := range []struct {
+		header string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer invalid", http.StatusForbidden},
+		{"Basic YWRtaW46c2VjcmV0", http.StatusUnauthorized}, // admin:secret
+		{"Bearer scraper", http.StatusOK},
+	} {
+		req, _ := http.NewRequest("GET", server.URL+"/metrics", nil)
+		if c.header != "" {
+			req.Header.Set("Authorization", c.header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, c.status, resp.StatusCode, c.header)
+	}
+}
+
+func TestPublicMetrics(t *testing.T) {
+	s := NewServer(&Config{
+		HeartbeatDuration: time.Second,
+		StorageBaseURL:    func(*http.Request) string { return "" },
+		Broker:            baseServer.Broker,
+		Metrics:           util.NewPrometheus(),
+	})
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/metrics")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
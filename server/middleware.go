@@ -2,18 +2,23 @@ package server
 
 import (
 	"bytes"
-	"errors"
+	"context"
+	"encoding/json"
+	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
+	gcontext "github.com/gorilla/context"
 	"github.com/gorilla/mux"
-	"github.com/heroku/authenticater"
+	"github.com/heroku/busl/auth"
 	"github.com/heroku/busl/broker"
-	"github.com/heroku/busl/encoders"
 	"github.com/heroku/busl/storage"
+	"github.com/heroku/busl/tracing"
 	"github.com/heroku/busl/util"
 )
 
@@ -36,17 +41,53 @@ func (s *Server) enforceHTTPS(fn http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-func (s *Server) auth(fn http.HandlerFunc) http.HandlerFunc {
-	if s.Credentials == "" {
+// principalLogger records who requests were authenticated as
+// in the request logs.
+type principalLogger interface {
+	SetPrincipal(name string)
+}
+
+type contextKey int
+
+const (
+	principalKey contextKey = iota
+	traceKey
+)
+
+// auth requires an authenticated client, allowed op on the
+// stream, if any.
+func (s *Server) auth(op string, fn http.HandlerFunc) http.HandlerFunc {
+	if s.Authenticator == nil {
 		return fn
 	}
 
-	auth, err := authenticater.NewBasicAuthFromString(s.Credentials)
-	if err != nil {
-		log.Fatalf("server.middleware error=%v", err)
-		return nil
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := s.Authenticator.Authenticate(r)
+		if err != nil {
+			util.CountWithData("server.auth.fail", 1, "error=%q", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if l, ok := w.(principalLogger); ok {
+			l.SetPrincipal(p.Name)
+		}
+		if !p.Allows(op, key(r)) {
+			util.CountWithData("server.auth.forbidden", 1, "principal=%q op=%s", p.Name, op)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		gcontext.Set(r, principalKey, p)
+		fn(w, r)
 	}
-	return authenticater.WrapAuth(auth, fn)
+}
+
+// principal returns the authenticated client, nil when the
+// server doesn't authenticate requests.
+func principal(r *http.Request) *auth.Principal {
+	p, _ := gcontext.Get(r, principalKey).(*auth.Principal)
+	return p
 }
 
 func logRequest(fn http.HandlerFunc) http.HandlerFunc {
@@ -59,20 +100,13 @@ func logRequest(fn http.HandlerFunc) http.HandlerFunc {
 
 func (s *Server) addDefaultHeaders(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if origin := r.Header.Get("Origin"); origin != "" {
-			w.Header().Set("Access-Control-Allow-Origin", origin)
-		}
+		s.corsHeaders(w, r)
 
 		requestID := r.Header.Get("Request-ID")
 		if requestID == "" {
 			requestID, _ = util.NewUUID()
 		}
 		w.Header().Set("Request-ID", requestID)
-
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token")
-		w.Header().Set("Access-Control-Expose-Headers", "Cache-Control, Content-Type, Expires, Last-Modified")
-		w.Header().Set("Access-Control-Allow-Credentials", "true")
 		fn(w, r)
 	}
 }
@@ -81,22 +115,243 @@ func offset(r *http.Request) (int64, error) {
 	var off string
 
 	if off = r.Header.Get("last-event-id"); off == "" {
-		if val := r.Header.Get("Range"); val != "" {
-			d := strings.SplitN(val, "=", 2)
-			if d[0] != "bytes" && len(d) == 2 {
-				return 0, errors.New("HTTP 416: Invalid Range")
+		rng, err := parseRange(r.Header.Get("Range"))
+		if err != nil {
+			return 0, err
+		}
+		if rng != nil {
+			// Only the start matters when following the stream,
+			// and suffix ranges start from the beginning.
+			if rng.start < 0 {
+				return 0, nil
 			}
-			tuple := strings.SplitN(d[1], "-", 2)
-			off = tuple[0]
+			return rng.start, nil
 		}
 	}
 
+	if off == "" {
+		// For clients unable to set headers, e.g. browser WebSockets.
+		off = r.URL.Query().Get("offset")
+	}
+
 	if off == "" {
 		return 0, nil
 	}
 	return strconv.ParseInt(off, 10, 64)
 }
 
+// startOffset returns the offset subscribers start reading from.
+// Unless resuming with Last-Event-ID or Range, the tail and since
+// query parameters set it to the start of the last lines or to the
+// content written since the given time, the later one winning when
+// both are set.
+func (s *Server) startOffset(r *http.Request) (int64, error) {
+	query := r.URL.Query()
+	tail, since := query.Get("tail"), query.Get("since")
+	if (tail == "" && since == "") || r.Header.Get("Last-Event-ID") != "" || r.Header.Get("Range") != "" {
+		return offset(r)
+	}
+
+	var start int64
+	if tail != "" {
+		lines, err := strconv.Atoi(tail)
+		if err != nil || lines < 0 {
+			return 0, badRequestError{fmt.Errorf("Invalid tail %q", tail)}
+		}
+		if start, err = s.tailOffset(r, lines); err != nil {
+			return 0, err
+		}
+	}
+
+	if since != "" {
+		t, err := parseSince(since, time.Now())
+		if err != nil {
+			return 0, err
+		}
+		o, err := s.timeOffset(r, t)
+		if err != nil {
+			return 0, err
+		}
+		if o > start {
+			start = o
+		}
+	}
+	return start, nil
+}
+
+// parseSince reads a time, either in RFC 3339 format,
+// or as a duration before now, e.g. 5m.
+func parseSince(val string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, val); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d < 0 {
+		return time.Time{}, badRequestError{fmt.Errorf("Invalid since %q", val)}
+	}
+	return now.Add(-d), nil
+}
+
+// tailOffset returns the offset the last lines of the stream start at.
+// Streams only found on the storage backend are read backwards with
+// range requests.
+func (s *Server) tailOffset(r *http.Request, lines int) (int64, error) {
+	o, err := s.broker(r).TailOffset(key(r), lines)
+	if err != broker.ErrNotRegistered {
+		return o, err
+	}
+
+	info, err := storage.StatContext(requestContext(r), requestURI(r), s.StorageBaseURL(r))
+	if err != nil {
+		return 0, err
+	}
+
+	end := info.Length
+	o, err = broker.FindTail(lines, info.Length, func() ([]byte, int64, error) {
+		if end <= 0 {
+			return nil, 0, nil
+		}
+		offset := end - broker.TailChunkSize
+		if offset < 0 {
+			offset = 0
+		}
+		rd, err := storage.GetContext(requestContext(r), requestURI(r), s.StorageBaseURL(r), offset)
+		if rd != nil {
+			defer rd.Close()
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		chunk, err := ioutil.ReadAll(io.LimitReader(rd, end-offset))
+		end = offset
+		return chunk, offset, err
+	})
+	if err == nil && o >= info.Length {
+		return 0, errNoContent
+	}
+	return o, err
+}
+
+// timeOffset returns the offset of the content written since t. Stored
+// streams are only dated by their upload, so they're either skipped
+// entirely or returned whole.
+func (s *Server) timeOffset(r *http.Request, t time.Time) (int64, error) {
+	o, err := s.broker(r).TimeOffset(key(r), t)
+	if err != broker.ErrNotRegistered {
+		return o, err
+	}
+
+	info, err := storage.StatContext(requestContext(r), requestURI(r), s.StorageBaseURL(r))
+	if err != nil {
+		return 0, err
+	}
+	if info.LastModified.IsZero() || !info.LastModified.Before(t) {
+		return 0, nil
+	}
+	return 0, errNoContent
+}
+
+// byteRange is a range of a Range header, as in RFC 7233. The end is
+// inclusive, or -1 when open-ended. Suffix ranges have a negative
+// start, e.g. bytes=-500 is {-500, -1}.
+type byteRange struct {
+	start, end int64
+}
+
+// parseRange reads the Range header. Absent headers, other units
+// and multiple ranges give a nil range, for the whole stream.
+func parseRange(header string) (*byteRange, error) {
+	i := strings.Index(header, "=")
+	if i < 0 || strings.TrimSpace(header[:i]) != "bytes" {
+		return nil, nil
+	}
+	spec := strings.TrimSpace(header[i+1:])
+	if strings.Contains(spec, ",") {
+		return nil, nil
+	}
+
+	i = strings.Index(spec, "-")
+	if i < 0 {
+		return nil, storage.ErrRange
+	}
+	first, last := spec[:i], spec[i+1:]
+
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, storage.ErrRange
+		}
+		return &byteRange{start: -n, end: -1}, nil
+	}
+
+	rng := &byteRange{end: -1}
+	var err error
+	if rng.start, err = strconv.ParseInt(first, 10, 64); err != nil || rng.start < 0 {
+		return nil, storage.ErrRange
+	}
+	if last != "" {
+		if rng.end, err = strconv.ParseInt(last, 10, 64); err != nil || rng.end < rng.start {
+			return nil, storage.ErrRange
+		}
+	}
+	return rng, nil
+}
+
+// resolve returns the first and last offsets of the range within a
+// stream of the given length, the last being -1 for open-ended ranges
+// of running streams. ok is false if the range can't be satisfied.
+func (rng *byteRange) resolve(length int64, done bool) (start, end int64, ok bool) {
+	start, end = rng.start, rng.end
+
+	if start < 0 {
+		// The last bytes written so far.
+		start, end = length+start, length-1
+		if start < 0 {
+			start = 0
+		}
+		return start, end, length > 0
+	}
+
+	if done {
+		if start >= length {
+			return 0, 0, false
+		}
+		if end < 0 || end >= length {
+			end = length - 1
+		}
+	}
+	return start, end, true
+}
+
+// streamOptions returns the settings of a stream being created. The
+// server defaults are overridden by the max_size and overflow query
+// parameters.
+func (s *Server) streamOptions(r *http.Request) (*broker.StreamOptions, error) {
+	opts := &broker.StreamOptions{
+		MaxSize:     s.StreamMaxSize,
+		Overflow:    s.StreamOverflow,
+		ContentType: r.Header.Get("Content-Type"),
+	}
+	query := r.URL.Query()
+
+	if val := query.Get("max_size"); val != "" {
+		size, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("Invalid max_size %q", val)
+		}
+		opts.MaxSize = size
+	}
+
+	if val := query.Get("overflow"); val != "" {
+		overflow, err := broker.ParseOverflow(val)
+		if err != nil {
+			return nil, err
+		}
+		opts.Overflow = overflow
+	}
+	return opts, nil
+}
+
 // Given URL:
 //   http://build-output.heroku.com/streams/1/2/3?foo=bar
 //
@@ -105,30 +360,42 @@ func offset(r *http.Request) (int64, error) {
 func requestURI(r *http.Request) string {
 	res := key(r)
 
-	if r.URL.RawQuery != "" {
-		res += "?" + r.URL.RawQuery
+	if query := storageQuery(r.URL.RawQuery); query != "" {
+		res += "?" + query
 	}
 
 	return res
 }
 
+// subscriberParams are the query parameters used by busl
+// clients, left out when requesting the storage backend.
+var subscriberParams = map[string]bool{"offset": true, "tail": true, "since": true, "line": true, "format": true, "buffer": true, "heartbeat": true, "encoding": true, "token": true}
+
+// storageQuery removes the subscriber parameters from the raw query,
+// leaving the rest untouched so that presigned URLs remain valid.
+func storageQuery(rawQuery string) string {
+	parts := strings.Split(rawQuery, "&")
+	kept := parts[:0]
+	for _, part := range parts {
+		name, _ := url.QueryUnescape(strings.SplitN(part, "=", 2)[0])
+		if part != "" && !subscriberParams[name] {
+			kept = append(kept, part)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
 func key(r *http.Request) string {
 	return mux.Vars(r)["key"]
 }
 
-// Returns a broker or blob reader.
-func (s *Server) newStorageReader(w http.ResponseWriter, r *http.Request) (io.ReadCloser, error) {
-	// Get the offset from Last-Event-ID: or Range:
-	o, err := offset(r)
-	if err != nil {
-		return nil, err
-	}
-
-	rd, err := broker.NewReader(key(r))
+// Returns a broker or blob reader, starting at offset o.
+func (s *Server) newStorageReader(r *http.Request, o int64) (io.ReadCloser, error) {
+	rd, err := s.broker(r).NewReader(key(r))
 
 	// Not cached in the broker anymore, try the storage backend as a fallback.
 	if err == broker.ErrNotRegistered {
-		return storage.Get(requestURI(r), s.StorageBaseURL(r), o)
+		return storage.GetContext(requestContext(r), requestURI(r), s.StorageBaseURL(r), o)
 	}
 
 	if o > 0 {
@@ -140,7 +407,36 @@ func (s *Server) newStorageReader(w http.ResponseWriter, r *http.Request) (io.Re
 }
 
 func (s *Server) newReader(w http.ResponseWriter, r *http.Request) (io.ReadCloser, error) {
-	rd, err := s.newStorageReader(w, r)
+	f, params, err := negotiate(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.ranges {
+		w.Header().Set("Accept-Ranges", "bytes")
+
+		if r.Header.Get("Last-Event-ID") == "" {
+			rng, err := parseRange(r.Header.Get("Range"))
+			if err != nil {
+				return nil, err
+			}
+			if rng != nil {
+				return s.newRangeReader(w, r, rng)
+			}
+		}
+	}
+
+	o, err := s.startOffset(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var rd io.ReadCloser
+	if f.ranges && o == 0 {
+		rd, err = s.newEncodedReader(w, r)
+	} else {
+		rd, err = s.newStorageReader(r, o)
+	}
 	if err != nil {
 		if rd != nil {
 			rd.Close()
@@ -148,48 +444,129 @@ func (s *Server) newReader(w http.ResponseWriter, r *http.Request) (io.ReadClose
 		return rd, err
 	}
 
-	// For default requests, we use a null byte for sending
-	// the keepalive ack.
-	ack := []byte{0}
+	if broker.NoContent(s.broker(r), key(r), o) {
+		rd.Close()
+		return nil, errNoContent
+	}
+
+	if w.Header().Get("Content-Encoding") != "" {
+		// Passed through as stored: acks would corrupt it, and
+		// streams served from storage are done anyway.
+		return rd, nil
+	}
 
-	o, err := offset(r)
+	d, err := f.delivery(s, w, r, rd, params)
 	if err != nil {
 		rd.Close()
 		return nil, err
 	}
+	d.encoder.Seek(o, io.SeekStart)
 
-	if broker.NoContent(rd, o) {
-		rd.Close()
-		return nil, errNoContent
+	var body io.Reader = d.encoder
+	if d.header != "" {
+		body = &readCloser{io.MultiReader(strings.NewReader(d.header), d.encoder), d.encoder}
 	}
 
-	var encoder encoders.Encoder
-	if r.Header.Get("Accept") == "text/event-stream" {
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
+	done := w.(http.CloseNotifier).CloseNotify()
+	renew := func() { s.broker(r).RenewExpiry(key(r)) }
+	return newKeepAliveReader(body, d.ack, s.HeartbeatDuration, done, renew), nil
+}
 
-		encoder = encoders.NewSSEEncoder(rd)
-		encoder.(io.Seeker).Seek(o, 0)
+// streamEnd is the data of the SSE end event
+type streamEnd struct {
+	Length    int64      `json:"length"`
+	Created   *time.Time `json:"created_at,omitempty"`
+	LastWrite *time.Time `json:"last_write_at,omitempty"`
+	RequestID string     `json:"request_id,omitempty"`
+}
 
-		// For SSE, we change the ack to a :keepalive
-		ack = []byte(":keepalive\n")
-	} else {
-		encoder = encoders.NewTextEncoder(rd)
+// endEvent returns the ID and data of the SSE end event, which
+// carries the final metadata of the stream once it's done.
+func (s *Server) endEvent(r *http.Request) func() (int64, []byte, bool) {
+	return func() (int64, []byte, bool) {
+		meta, err := s.streamMeta(r)
+		if err != nil || !meta.Done {
+			return 0, nil, false
+		}
+
+		data, err := json.Marshal(&streamEnd{meta.Length, meta.Created, meta.LastWrite, meta.RequestID})
+		if err != nil {
+			return 0, nil, false
+		}
+		return meta.Length, data, true
+	}
+}
+
+// newRangeReader returns a reader for the requested range, and replies
+// with 206 Partial Content when the end of the range is known. Ranges
+// open-ended on running streams get a 200, as the Content-Range can't
+// be known yet. Unsatisfiable ranges fail with storage.ErrRange.
+func (s *Server) newRangeReader(w http.ResponseWriter, r *http.Request, rng *byteRange) (io.ReadCloser, error) {
+	meta, err := s.streamMeta(r)
+	if err != nil {
+		return nil, err
+	}
+
+	start, end, ok := rng.resolve(meta.Length, meta.Done)
+	if !ok {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", meta.Length))
+		return nil, storage.ErrRange
+	}
+
+	rd, err := s.newStorageReader(r, start)
+	if err != nil {
+		if rd != nil {
+			rd.Close()
+		}
+		return nil, err
 	}
-	encoder.Seek(o, io.SeekStart)
 
 	done := w.(http.CloseNotifier).CloseNotify()
-	return newKeepAliveReader(encoder, ack, s.HeartbeatDuration, done), nil
+	renew := func() { s.broker(r).RenewExpiry(key(r)) }
+	if end < 0 {
+		return newKeepAliveReader(rd, []byte{0}, s.HeartbeatDuration, done, renew), nil
+	}
+
+	total := "*"
+	if meta.Done {
+		total = strconv.FormatInt(meta.Length, 10)
+		w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", start, end, total))
+	w.WriteHeader(http.StatusPartialContent)
+
+	// No acks are sent, since they would be part of the range.
+	limited := &readCloser{io.LimitReader(rd, end-start+1), rd}
+	return newKeepAliveReader(limited, nil, s.HeartbeatDuration, done, renew), nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (s *Server) storeOutput(ctx context.Context, channel string, requestURI string, storageBase string) {
+	s.uploadOutput(ctx, channel, requestURI, storageBase)
 }
 
-func storeOutput(channel string, requestURI string, storageBase string) {
+// uploadOutput stores the content of the channel onto the storage
+// backend, traced as part of the span of ctx.
+func (s *Server) uploadOutput(ctx context.Context, channel string, requestURI string, storageBase string) error {
 	defer util.TimerEnd(util.TimerStart("server.storeOutput"))
+	ctx, span := tracing.Start(ctx, "server.uploadOutput", tracing.KindInternal)
+	defer span.End()
+	span.SetAttribute("busl.stream", channel)
 
-	if buf, err := broker.Get(channel); err == nil {
-		if err := storage.Put(requestURI, storageBase, bytes.NewBuffer(buf)); err != nil {
-			util.CountWithData("server.storeOutput.put.error", 1, "err=%s", err.Error())
-		}
-	} else {
+	buf, err := broker.Traced(ctx, s.Broker).Get(channel)
+	if err != nil {
 		util.CountWithData("server.storeOutput.get.error", 1, "err=%s", err.Error())
+		span.RecordError(err)
+		return err
+	}
+	if err := storage.PutContext(ctx, requestURI, storageBase, bytes.NewBuffer(buf)); err != nil {
+		span.RecordError(err)
+		util.CountWithData("server.storeOutput.put.error", 1, "err=%s", err.Error())
+		return err
 	}
+	return nil
 }
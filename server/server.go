@@ -7,20 +7,48 @@ import (
 
 	"github.com/braintree/manners"
 	"github.com/gorilla/mux"
+	"github.com/heroku/busl/auth"
+	"github.com/heroku/busl/broker"
 )
 
 // Config holds all the server options
 type Config struct {
 	EnforceHTTPS      bool
-	Credentials       string
+	Authenticator     auth.Authenticator // nil to let every client create streams, without admin API
 	HeartbeatDuration time.Duration
+	LineFlushDuration time.Duration // how long SSE partial lines are held back
+	SSERetryDuration  time.Duration // reconnection time sent to SSE clients, if set
 	StorageBaseURL    func(*http.Request) string
+	Metrics           http.Handler // served on /metrics, if set
+	MetricsToken      string       // bearer token required on /metrics, if set
+	Broker            broker.Broker
+
+	// Origins allowed to read streams from browsers, see allowedOrigin,
+	// with credentials if CORSCredentials. CORSExposeHeaders defaults
+	// to the stream headers.
+	CORSOrigins       []string
+	CORSCredentials   bool
+	CORSExposeHeaders []string
+
+	// Stream tokens are signed with TokenSecret, if set, and expire
+	// after TokenTTL, if set. InsecureStreamKeys lets requests without
+	// a token through, the stream keys being the only secret.
+	TokenSecret        []byte
+	TokenTTL           time.Duration
+	InsecureStreamKeys bool
+
+	// Default size limit and overflow policy of the streams,
+	// overridable when creating them.
+	StreamMaxSize  int64
+	StreamOverflow broker.Overflow
 }
 
 // Server is a launchable api listener
 type Server struct {
 	*manners.GracefulServer
 	*Config
+
+	closing <-chan struct{} // closed on shutdown
 }
 
 // NewServer creates a new server instance
@@ -34,6 +62,7 @@ func NewServer(config *Config) *Server {
 // Start starts the server instance
 func (s *Server) Start(port string, shutdown <-chan struct{}) {
 	log.Printf("http.start.port=%s\n", port)
+	s.closing = shutdown
 	s.Handler = s.router()
 	go s.listenForShutdown(shutdown)
 
@@ -52,13 +81,34 @@ func (s *Server) listenForShutdown(shutdown <-chan struct{}) {
 
 func (s *Server) router() http.Handler {
 	r := mux.NewRouter()
+	r.KeepContext = true // cleared by traceRequest
 
 	r.HandleFunc("/health", s.addDefaultHeaders(s.health))
+	if s.Metrics != nil {
+		r.HandleFunc("/metrics", s.serveMetrics).Methods("GET")
+	}
+
+	r.HandleFunc("/streams/{key:.+}/meta", s.addDefaultHeaders(s.authorize(scopeRead, s.getStreamMeta))).Methods("GET")
+	r.HandleFunc("/streams/{key:.+}/view", s.addDefaultHeaders(s.authorize(scopeRead, s.viewStream))).Methods("GET")
+	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(s.preflight)).Methods("OPTIONS")
+	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(s.authorize(scopeRead, s.headStream))).Methods("HEAD")
+	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(s.authorize(scopeRead, s.subscribeWebSocket))).Methods("GET").MatcherFunc(isWebSocket)
+	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(s.authorize(scopeRead, s.subscribe))).Methods("GET")
+	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(s.authorize(scopePublish, s.publish))).Methods("POST")
+	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(s.authorize(scopeAdmin, s.closeStream))).Methods("DELETE")
+	r.HandleFunc("/streams/{key:.+}", s.auth(auth.OpCreate, s.addDefaultHeaders(s.createStream))).Methods("PUT")
 
-	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(s.subscribe)).Methods("GET")
-	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(s.publish)).Methods("POST")
-	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(s.closeStream)).Methods("DELETE")
-	r.HandleFunc("/streams/{key:.+}", s.auth(s.addDefaultHeaders(s.createStream))).Methods("PUT")
+	// The admin API reaches every stream, so it's left out
+	// unless clients have to authenticate. It takes admin
+	// credentials rather than stream tokens, which only grant
+	// access to the /streams endpoints of their stream.
+	if s.Authenticator != nil {
+		r.HandleFunc("/admin/streams", s.auth(auth.OpAdmin, s.addDefaultHeaders(s.listStreams))).Methods("GET")
+		r.HandleFunc("/admin/streams/{key:.+}/close", s.auth(auth.OpAdmin, s.addDefaultHeaders(s.closeStream))).Methods("POST")
+		r.HandleFunc("/admin/streams/{key:.+}/upload", s.auth(auth.OpAdmin, s.addDefaultHeaders(s.uploadStream))).Methods("POST")
+		r.HandleFunc("/admin/streams/{key:.+}", s.auth(auth.OpAdmin, s.addDefaultHeaders(s.inspectStream))).Methods("GET")
+		r.HandleFunc("/admin/streams/{key:.+}", s.auth(auth.OpAdmin, s.addDefaultHeaders(s.deleteStream))).Methods("DELETE")
+	}
 
-	return logRequest(s.enforceHTTPS(r.ServeHTTP))
+	return logRequest(traceRequest(s.enforceHTTPS(r.ServeHTTP)))
 }
@@ -2,26 +2,47 @@ package server
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/heroku/busl/auth"
 	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/encoders"
+	"github.com/heroku/busl/storage"
 	"github.com/heroku/busl/util"
 	"github.com/stretchr/testify/assert"
 )
 
 var baseServer = NewServer(&Config{
 	EnforceHTTPS:      false,
-	Credentials:       "",
 	HeartbeatDuration: time.Second,
+	LineFlushDuration: time.Minute,
 	StorageBaseURL:    func(*http.Request) string { return "" },
+	Broker:            newTestBroker(),
 })
 
+// newTestBroker runs the suite against redis when REDIS_URL
+// is set, and against the in-memory broker otherwise.
+func newTestBroker() broker.Broker {
+	if url := os.Getenv("REDIS_URL"); url != "" {
+		b, err := broker.NewRedisBroker(broker.RedisOptions{URL: url})
+		if err != nil {
+			panic(err)
+		}
+		return b
+	}
+	return broker.NewMemoryBroker()
+}
+
 func Test410(t *testing.T) {
 	streamID, _ := util.NewUUID()
 	request, _ := http.NewRequest("GET", "/streams/"+streamID, nil)
@@ -47,10 +68,9 @@ func TestPubNotRegistered(t *testing.T) {
 func TestPubClosed(t *testing.T) {
 	uuid, _ := util.NewUUID()
 
-	registrar := broker.NewRedisRegistrar()
-	err := registrar.Register(uuid)
+	err := baseServer.Broker.Register(uuid, nil)
 	assert.Nil(t, err)
-	writer, err := broker.NewWriter(uuid)
+	writer, err := baseServer.Broker.NewWriter(uuid)
 	assert.Nil(t, err)
 	writer.Close()
 
@@ -68,8 +88,7 @@ func TestPubWithoutTransferEncoding(t *testing.T) {
 	server := httptest.NewServer(baseServer.router())
 	uuid, _ := util.NewUUID()
 
-	registrar := broker.NewRedisRegistrar()
-	err := registrar.Register(uuid)
+	err := baseServer.Broker.Register(uuid, nil)
 	assert.Nil(t, err)
 
 	req, _ := http.NewRequest("POST", server.URL+"/streams/"+uuid, bytes.NewBufferString("hello world"))
@@ -160,7 +179,7 @@ func TestPublisherReconnect(t *testing.T) {
 
 	done := make(chan bool)
 
-	writer, err := broker.NewWriter(uuid)
+	writer, err := baseServer.Broker.NewWriter(uuid)
 	assert.Nil(t, err)
 	_, err = writer.Write([]byte("hello"))
 	assert.Nil(t, err)
@@ -255,7 +274,11 @@ func TestPubSubRange(t *testing.T) {
 			assert.Equal(t, body, []byte(testdata.output))
 
 			if len(body) == 0 {
-				assert.Equal(t, resp.StatusCode, http.StatusNoContent)
+				// Nothing left past the end of a done stream.
+				assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+				assert.Equal(t, "bytes */12", resp.Header.Get("Content-Range"))
+			} else {
+				assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
 			}
 
 			done <- true
@@ -318,10 +341,14 @@ func TestPubSubSSE(t *testing.T) {
 			defer resp.Body.Close()
 
 			body, _ := ioutil.ReadAll(resp.Body)
-			assert.Equal(t, body, []byte(testdata.output))
+			events, end := splitEndEvent(string(body))
+			assert.Equal(t, testdata.output, events)
 
 			if len(body) == 0 {
 				assert.Equal(t, resp.StatusCode, http.StatusNoContent)
+			} else {
+				n := len(testdata.input)
+				assert.True(t, strings.HasPrefix(end, fmt.Sprintf("event: end\nid: %d\ndata: {\"length\":%d,", n, n)))
 			}
 
 			done <- true
@@ -331,6 +358,14 @@ func TestPubSubSSE(t *testing.T) {
 	}
 }
 
+// splitEndEvent splits an SSE response before its end event
+func splitEndEvent(body string) (string, string) {
+	if i := strings.Index(body, "event: end\n"); i >= 0 {
+		return body[:i], body[i:]
+	}
+	return body, ""
+}
+
 func TestPut(t *testing.T) {
 	server := httptest.NewServer(baseServer.router())
 	defer server.Close()
@@ -338,19 +373,88 @@ func TestPut(t *testing.T) {
 	transport := &http.Transport{}
 	client := &http.Client{Transport: transport}
 
-	// uuid = curl -XPUT <url>/streams/1/2/3
-	request, _ := http.NewRequest("PUT", server.URL+"/streams/1/2/3", nil)
+	// Streams are kept across runs when testing against redis.
+	uuid, _ := util.NewUUID()
+	key := uuid + "/1/2/3"
+
+	// uuid = curl -XPUT <url>/streams/<uuid>/1/2/3
+	request, _ := http.NewRequest("PUT", server.URL+"/streams/"+key, nil)
 	resp, err := client.Do(request)
 	assert.Nil(t, err)
 	defer resp.Body.Close()
 	assert.Equal(t, resp.StatusCode, http.StatusCreated)
 
-	registrar := broker.NewRedisRegistrar()
-	r, err := registrar.IsRegistered("1/2/3")
+	r, err := baseServer.Broker.IsRegistered(key)
 	assert.Nil(t, err)
 	assert.True(t, r)
 }
 
+func TestPutExisting(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+	uuid, _ := util.NewUUID()
+	url := server.URL + "/streams/" + uuid
+
+	put := func(url string, header ...string) int {
+		request, _ := http.NewRequest("PUT", url, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			request.Header.Set(header[i], header[i+1])
+		}
+		resp, err := client.Do(request)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusCreated, put(url, "If-None-Match", "*"))
+	w, _ := baseServer.Broker.NewWriter(uuid)
+	w.Write([]byte("hello"))
+
+	assert.Equal(t, http.StatusOK, put(url))
+	assert.Equal(t, http.StatusConflict, put(url, "If-None-Match", "*"))
+	buf, _ := baseServer.Broker.Get(uuid)
+	assert.Equal(t, "hello", string(buf))
+
+	assert.Equal(t, http.StatusCreated, put(url+"?reset=true"))
+	buf, _ = baseServer.Broker.Get(uuid)
+	assert.Equal(t, "", string(buf))
+}
+
+func TestPutMaxSize(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+	uuid, _ := util.NewUUID()
+
+	request, _ := http.NewRequest("PUT", server.URL+"/streams/"+uuid+"?max_size=5", nil)
+	resp, err := client.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	request, _ = http.NewRequest("POST", server.URL+"/streams/"+uuid, bytes.NewBufferString("hello world"))
+	resp, err = client.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	buf, _ := baseServer.Broker.Get(uuid)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestPutInvalidOverflow(t *testing.T) {
+	uuid, _ := util.NewUUID()
+	request, _ := http.NewRequest("PUT", "/streams/"+uuid+"?overflow=explode", nil)
+	response := httptest.NewRecorder()
+
+	baseServer.createStream(response, request)
+
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
+
 func TestSubGoneWithBackend(t *testing.T) {
 	uuid, _ := util.NewUUID()
 
@@ -393,8 +497,7 @@ func TestPutWithBackend(t *testing.T) {
 	transport := &http.Transport{}
 	client := &http.Client{Transport: transport}
 
-	registrar := broker.NewRedisRegistrar()
-	registrar.Register(uuid)
+	baseServer.Broker.Register(uuid, nil)
 
 	// uuid = curl -XPUT <url>/streams/1/2/3
 	request, _ := http.NewRequest("POST", server.URL+"/streams/"+uuid, bytes.NewReader([]byte("hello world")))
@@ -407,9 +510,9 @@ func TestPutWithBackend(t *testing.T) {
 }
 
 func TestAuthentication(t *testing.T) {
-	baseServer.Credentials = "u:pass1|u:pass2"
+	baseServer.Authenticator, _ = auth.New(auth.Options{Basic: "u:pass1|u:pass2"})
 	defer func() {
-		baseServer.Credentials = ""
+		baseServer.Authenticator = nil
 	}()
 
 	server := httptest.NewServer(baseServer.router())
@@ -419,7 +522,7 @@ func TestAuthentication(t *testing.T) {
 	client := &http.Client{Transport: transport}
 
 	testdata := map[string]string{
-		"PUT": "/streams/1/2/3",
+		"PUT": "/streams/1/2/3?reset=true",
 	}
 
 	status := map[string]int{
@@ -454,6 +557,96 @@ func TestAuthentication(t *testing.T) {
 	}
 }
 
+func TestHeadStream(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+	uuid, _ := util.NewUUID()
+
+	request, _ := http.NewRequest("PUT", server.URL+"/streams/"+uuid, nil)
+	request.Header.Set("Content-Type", "text/plain")
+	request.Header.Set("Request-ID", "put-request")
+	resp, err := client.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+
+	w, _ := baseServer.Broker.NewWriter(uuid)
+	w.Write([]byte("hello"))
+
+	resp, err = client.Head(server.URL + "/streams/" + uuid)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "broker", resp.Header.Get("Stream-Source"))
+	assert.Equal(t, "5", resp.Header.Get("Stream-Length"))
+	assert.Equal(t, "false", resp.Header.Get("Stream-Done"))
+	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "put-request", resp.Header.Get("Stream-Request-ID"))
+	assert.Equal(t, "0", resp.Header.Get("Stream-Subscribers"))
+	assert.NotEmpty(t, resp.Header.Get("Stream-Created"))
+	assert.NotEmpty(t, resp.Header.Get("Last-Modified"))
+
+	resp, err = client.Head(server.URL + "/streams/missing")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestStreamMeta(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid, &broker.StreamOptions{MaxSize: 10, Overflow: broker.OverflowRolling})
+	w, _ := baseServer.Broker.NewWriter(uuid)
+	w.Write([]byte("hello"))
+	w.Close()
+
+	resp, err := http.Get(server.URL + "/streams/" + uuid + "/meta")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var meta map[string]interface{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&meta))
+	assert.Equal(t, "broker", meta["source"])
+	assert.Equal(t, float64(5), meta["length"])
+	assert.Equal(t, true, meta["done"])
+	assert.Equal(t, float64(10), meta["max_size"])
+	assert.Equal(t, "rolling", meta["overflow"])
+	assert.NotNil(t, meta["created_at"])
+}
+
+func TestStreamMetaWithBackend(t *testing.T) {
+	uuid, _ := util.NewUUID()
+
+	storage, get, _ := fileServer(uuid)
+	defer storage.Close()
+
+	baseServer.StorageBaseURL = func(*http.Request) string { return storage.URL }
+	defer func() {
+		baseServer.StorageBaseURL = func(*http.Request) string { return "" }
+	}()
+
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	get <- []byte("hello world")
+
+	resp, err := http.Get(server.URL + "/streams/" + uuid + "/meta")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var meta map[string]interface{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&meta))
+	assert.Equal(t, "storage", meta["source"])
+	assert.Equal(t, float64(11), meta["length"])
+	assert.Equal(t, true, meta["done"])
+}
+
 func fileServer(id string) (*httptest.Server, chan []byte, chan []byte) {
 	get := make(chan []byte, 10)
 	put := make(chan []byte, 10)
@@ -473,6 +666,481 @@ func fileServer(id string) (*httptest.Server, chan []byte, chan []byte) {
 	return server, get, put
 }
 
+func TestOffsetParam(t *testing.T) {
+	request, _ := http.NewRequest("GET", "/streams/1/2/3?X-Amz-Signature=a%2Fb&offset=5&tail=10&X-Amz-Date=1", nil)
+	assert.Equal(t, "X-Amz-Signature=a%2Fb&X-Amz-Date=1", storageQuery(request.URL.RawQuery))
+
+	offset, err := offset(request)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), offset)
+}
+
+func TestParseRange(t *testing.T) {
+	for _, test := range []struct {
+		header string
+		rng    *byteRange
+		err    error
+	}{
+		{"", nil, nil},
+		{"bytes=5-", &byteRange{5, -1}, nil},
+		{"bytes=5-9", &byteRange{5, 9}, nil},
+		{"bytes= 5-5", &byteRange{5, 5}, nil},
+		{"bytes=-500", &byteRange{-500, -1}, nil},
+		{"bytes=0-1,5-6", nil, nil},
+		{"lines=1-2", nil, nil},
+		{"bytes=9-5", nil, storage.ErrRange},
+		{"bytes=-0", nil, storage.ErrRange},
+		{"bytes=a-", nil, storage.ErrRange},
+		{"bytes=5", nil, storage.ErrRange},
+	} {
+		rng, err := parseRange(test.header)
+		assert.Equal(t, test.err, err, test.header)
+		assert.Equal(t, test.rng, rng, test.header)
+	}
+}
+
+func TestSubscribeRange(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid, nil)
+	w, _ := baseServer.Broker.NewWriter(uuid)
+	w.Write([]byte("hello world"))
+	w.Close()
+
+	for _, test := range []struct {
+		header       string
+		status       int
+		contentRange string
+		body         string
+	}{
+		{"", http.StatusOK, "", "hello world"},
+		{"bytes=0-4", http.StatusPartialContent, "bytes 0-4/11", "hello"},
+		{"bytes=6-100", http.StatusPartialContent, "bytes 6-10/11", "world"},
+		{"bytes=6-", http.StatusPartialContent, "bytes 6-10/11", "world"},
+		{"bytes=-3", http.StatusPartialContent, "bytes 8-10/11", "rld"},
+		{"bytes=-100", http.StatusPartialContent, "bytes 0-10/11", "hello world"},
+		{"bytes=0-1,4-5", http.StatusOK, "", "hello world"},
+		{"bytes=11-", http.StatusRequestedRangeNotSatisfiable, "bytes */11", ""},
+		{"bytes=5-1", http.StatusRequestedRangeNotSatisfiable, "", ""},
+	} {
+		request, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid, nil)
+		if test.header != "" {
+			request.Header.Set("Range", test.header)
+		}
+		resp, err := http.DefaultClient.Do(request)
+		assert.Nil(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		assert.Equal(t, test.status, resp.StatusCode, test.header)
+		assert.Equal(t, test.contentRange, resp.Header.Get("Content-Range"), test.header)
+		assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"), test.header)
+		if test.status != http.StatusRequestedRangeNotSatisfiable {
+			assert.Equal(t, test.body, string(body), test.header)
+		}
+	}
+}
+
+func TestSubscribeRangeRunning(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid, nil)
+	w, _ := baseServer.Broker.NewWriter(uuid)
+	defer w.Close()
+	w.Write([]byte("hello"))
+
+	request, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid, nil)
+	request.Header.Set("Range", "bytes=3-7")
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "bytes 3-7/*", resp.Header.Get("Content-Range"))
+
+	// The response ends with the range, although the stream goes on.
+	w.Write([]byte(" world"))
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "lo wo", string(body))
+}
+
+func TestSubscribeRangeWithBackend(t *testing.T) {
+	uuid, _ := util.NewUUID()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+uuid, func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("hello world"))
+	})
+	storage := httptest.NewServer(mux)
+	defer storage.Close()
+
+	baseServer.StorageBaseURL = func(*http.Request) string { return storage.URL }
+	defer func() {
+		baseServer.StorageBaseURL = func(*http.Request) string { return "" }
+	}()
+
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid, nil)
+	request.Header.Set("Range", "bytes=-5")
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "bytes 6-10/11", resp.Header.Get("Content-Range"))
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "world", string(body))
+}
+
+func TestSubscribeTail(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid, nil)
+	w, _ := baseServer.Broker.NewWriter(uuid)
+	w.Write([]byte("one\ntwo\nthree\n"))
+
+	resp, err := http.Get(server.URL + "/streams/" + uuid + "?tail=2")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	// Following goes on past the last lines.
+	w.Write([]byte("four\n"))
+	w.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "two\nthree\nfour\n", string(body))
+}
+
+func TestSubscribeSince(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid, nil)
+	w, _ := baseServer.Broker.NewWriter(uuid)
+	w.Write([]byte("old\n"))
+	time.Sleep(1100 * time.Millisecond)
+	since := time.Now().UTC().Format(time.RFC3339Nano)
+	w.Write([]byte("new\n"))
+	w.Close()
+
+	for query, output := range map[string]string{
+		"since=1h":                   "old\nnew\n",
+		"since=" + since:             "new\n",
+		"since=1h&tail=1":            "new\n",
+		"since=" + since + "&tail=2": "new\n",
+	} {
+		resp, err := http.Get(server.URL + "/streams/" + uuid + "?" + query)
+		assert.Nil(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, output, string(body), query)
+	}
+
+	resp, err := http.Get(server.URL + "/streams/" + uuid + "?since=2006-01-02T15:04:05Z&tail=0")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
+
+func TestSubscribeTailInvalid(t *testing.T) {
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid, nil)
+
+	for _, query := range []string{"tail=-1", "tail=many", "since=yesterday", "since=-5m"} {
+		request, _ := http.NewRequest("GET", "/streams/"+uuid+"?"+query, nil)
+		response := httptest.NewRecorder()
+		baseServer.router().ServeHTTP(response, request)
+		assert.Equal(t, http.StatusBadRequest, response.Code, query)
+	}
+}
+
+func TestSubscribeTailWithBackend(t *testing.T) {
+	uuid, _ := util.NewUUID()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+uuid, func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Now().Add(-time.Hour), strings.NewReader("one\ntwo\nthree\n"))
+	})
+	storage := httptest.NewServer(mux)
+	defer storage.Close()
+
+	baseServer.StorageBaseURL = func(*http.Request) string { return storage.URL }
+	defer func() {
+		baseServer.StorageBaseURL = func(*http.Request) string { return "" }
+	}()
+
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/streams/" + uuid + "?tail=1")
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "three\n", string(body))
+
+	// Stored streams are dated by their upload.
+	resp, err = http.Get(server.URL + "/streams/" + uuid + "?since=5m")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)
+	since, err := parseSince("5m", now)
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(-5*time.Minute), since)
+
+	since, err = parseSince("2016-01-02T15:00:00Z", now)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2016, 1, 2, 15, 0, 0, 0, time.UTC), since)
+}
+
+func TestPubSubNDJSON(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid, nil)
+	w, _ := baseServer.Broker.NewWriter(uuid)
+	w.Write([]byte("hello\nwor"))
+	w.Write([]byte("ld\n"))
+	w.Close()
+
+	request, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid+"?offset=6&line=2", nil)
+	request.Header.Set("Accept", "application/x-ndjson, */*")
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+
+	var lines []encoders.NDJSONLine
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var line encoders.NDJSONLine
+		if err := dec.Decode(&line); err != nil {
+			break
+		}
+		lines = append(lines, line)
+	}
+
+	assert.Equal(t, 1, len(lines))
+	assert.Equal(t, int64(6), lines[0].Offset)
+	assert.Equal(t, int64(12), lines[0].Next)
+	assert.Equal(t, int64(2), lines[0].Line)
+	assert.Equal(t, "world", *lines[0].Text)
+	assert.NotNil(t, lines[0].Time)
+}
+
+func TestPubSubHTML(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid, nil)
+	w, _ := baseServer.Broker.NewWriter(uuid)
+	w.Write([]byte("<b>\x1b[31mred\x1b[0m"))
+	w.Close()
+
+	request, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid, nil)
+	request.Header.Set("Accept", "text/html,*/*;q=0.8")
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.True(t, strings.HasPrefix(string(body), "<!DOCTYPE html>"))
+	assert.True(t, strings.HasSuffix(string(body), `<pre>&lt;b&gt;<span class="ansi-red">red</span>`))
+}
+
+func TestPubSubSSEHTML(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid, nil)
+	w, _ := baseServer.Broker.NewWriter(uuid)
+	w.Write([]byte("hi \x1b[1mthere"))
+	w.Close()
+
+	request, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid+"?encoding=html&offset=3", nil)
+	request.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	events, _ := splitEndEvent(string(body))
+	assert.Equal(t, "id: 12\ndata: <span class=\"ansi-bold\">there</span>\n\n", events)
+}
+
+func TestPubSubSSELines(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid, nil)
+	w, _ := baseServer.Broker.NewWriter(uuid)
+	w.Write([]byte("hello\nwor"))
+
+	request, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid+"?buffer=lines", nil)
+	request.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	// The partial line is held back until it completes.
+	buf := make([]byte, 1024)
+	n, _ := io.ReadAtLeast(resp.Body, buf, len("id: 6\ndata: hello\ndata: \n\n"))
+	assert.Equal(t, "id: 6\ndata: hello\ndata: \n\n", string(buf[:n]))
+
+	w.Write([]byte("ld\n"))
+	w.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	events, _ := splitEndEvent(string(body))
+	assert.Equal(t, "id: 12\ndata: world\ndata: \n\n", events)
+}
+
+func TestPubSubSSEBase64(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid, nil)
+	w, _ := baseServer.Broker.NewWriter(uuid)
+	w.Write([]byte("\x00\xff\n\x01"))
+	w.Close()
+
+	request, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid+"?offset=1", nil)
+	request.Header.Set("Accept", "text/event-stream; encoding=base64")
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream; encoding=base64", resp.Header.Get("Content-Type"))
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	events, _ := splitEndEvent(string(body))
+	assert.Equal(t, "id: 4\ndata: /woB\n\n", events)
+
+	request.Header.Set("Accept", "text/event-stream; encoding=gzip")
+	resp, err = http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestSubscribeNegotiation(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid, nil)
+	w, _ := baseServer.Broker.NewWriter(uuid)
+	w.Write([]byte("hello"))
+	w.Close()
+
+	request, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid, nil)
+	request.Header.Set("Accept", "text/event-stream, */*")
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	request.Header.Set("Accept", "application/json")
+	resp, err = http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotAcceptable, resp.StatusCode)
+	assert.Contains(t, string(body), "text/event-stream")
+
+	// The format parameter overrides the Accept header.
+	request, _ = http.NewRequest("GET", server.URL+"/streams/"+uuid+"?format=ndjson", nil)
+	request.Header.Set("Accept", "application/json")
+	resp, err = http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+}
+
+func TestSubscribeNotRegisteredFeral(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL+"/streams/missing", nil)
+	request.Header.Set("Accept", "text/ascii; version=feral, */*;q=0.1")
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Contains(t, string(body), "GONE")
+}
+
+func TestSSEEvents(t *testing.T) {
+	s := NewServer(&Config{
+		HeartbeatDuration: 10 * time.Millisecond,
+		SSERetryDuration:  2 * time.Second,
+		StorageBaseURL:    func(*http.Request) string { return "" },
+		Broker:            baseServer.Broker,
+	})
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	s.Broker.Register(uuid, nil)
+	w, _ := s.Broker.NewWriter(uuid)
+	w.Write([]byte("hi"))
+
+	request, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid+"?heartbeat=event", nil)
+	request.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	heartbeat := "event: heartbeat\ndata: \n\n"
+	var head string
+	buf := make([]byte, 1024)
+	for !strings.Contains(head, heartbeat) {
+		n, err := resp.Body.Read(buf)
+		head += string(buf[:n])
+		if !assert.Nil(t, err) {
+			break
+		}
+	}
+	assert.True(t, strings.HasPrefix(head, "retry: 2000\n\nid: 2\ndata: hi\n\n"+heartbeat))
+
+	w.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	events, end := splitEndEvent(string(body))
+	assert.Equal(t, "", strings.Replace(events, heartbeat, "", -1))
+	assert.True(t, strings.HasPrefix(end, "event: end\nid: 2\ndata: {\"length\":2,"))
+}
+
+func TestViewStream(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/streams/1234/view")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Contains(t, string(body), "new EventSource(")
+}
+
 func TestCloseStream(t *testing.T) {
 	server := httptest.NewServer(baseServer.router())
 	defer server.Close()
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/util"
+)
+
+// Scopes of the stream tokens. An admin token grants every scope.
+const (
+	scopePublish = "publish"
+	scopeRead    = "read"
+	scopeAdmin   = "admin"
+)
+
+var (
+	errTokenRequired = errors.New("Stream token required")
+	errTokenInvalid  = errors.New("Invalid stream token")
+	errTokenExpired  = errors.New("Stream token expired")
+)
+
+// streamTokens are returned when creating a stream, if the
+// server signs tokens.
+type streamTokens struct {
+	Publish string     `json:"publish"`
+	Read    string     `json:"read"`
+	Admin   string     `json:"admin"`
+	Expires *time.Time `json:"expires_at,omitempty"`
+}
+
+// newStreamTokens signs the tokens of a stream, expiring after
+// TokenTTL, if set. They're bound to the nonce of the stream, so
+// that resetting it, or registering it again, revokes them.
+func (s *Server) newStreamTokens(key, nonce string) *streamTokens {
+	tokens := &streamTokens{}
+	var expires int64
+	if s.TokenTTL > 0 {
+		t := time.Now().Add(s.TokenTTL).UTC().Truncate(time.Second)
+		tokens.Expires = &t
+		expires = t.Unix()
+	}
+
+	tokens.Publish = s.signToken(key, scopePublish, expires, nonce)
+	tokens.Read = s.signToken(key, scopeRead, expires, nonce)
+	tokens.Admin = s.signToken(key, scopeAdmin, expires, nonce)
+	return tokens
+}
+
+// signToken returns a token of the form
+// <scope>.<expires>.<nonce>.<signature>, the stream key being part
+// of the signed content only. A zero expiry never expires.
+func (s *Server) signToken(key, scope string, expires int64, nonce string) string {
+	claims := scope + "." + strconv.FormatInt(expires, 10) + "." + nonce
+	return claims + "." + s.tokenSignature(key, claims)
+}
+
+func (s *Server) tokenSignature(key, claims string) string {
+	mac := hmac.New(sha256.New, s.TokenSecret)
+	mac.Write([]byte(claims + "." + key))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyToken checks that the token sent with the request grants
+// scope over the stream. Requests without a token are let through
+// when the server doesn't sign tokens, or allows insecure keys.
+func (s *Server) verifyToken(r *http.Request, scope string) error {
+	if len(s.TokenSecret) == 0 {
+		return nil
+	}
+
+	token := requestToken(r)
+	if token == "" {
+		if s.InsecureStreamKeys {
+			return nil
+		}
+		return errTokenRequired
+	}
+
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return errTokenInvalid
+	}
+	claims, signature := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(s.tokenSignature(key(r), claims))) {
+		return errTokenInvalid
+	}
+
+	parts := strings.Split(claims, ".")
+	if len(parts) != 3 {
+		return errTokenInvalid
+	}
+	if parts[0] != scope && parts[0] != scopeAdmin {
+		return errTokenInvalid
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return errTokenInvalid
+	}
+	if expires > 0 && time.Now().Unix() >= expires {
+		return errTokenExpired
+	}
+
+	// Streams only left in storage are read with the tokens
+	// they had, since no later stream took their key.
+	meta, err := s.broker(r).Meta(key(r))
+	if err == broker.ErrNotRegistered {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(meta.Nonce)) {
+		return errTokenInvalid
+	}
+	return nil
+}
+
+// verifyReset checks that the request may reset the stream: new
+// streams may always be created, while existing ones take their
+// admin token.
+func (s *Server) verifyReset(r *http.Request) error {
+	if len(s.TokenSecret) == 0 {
+		return nil
+	}
+
+	registered, err := s.broker(r).IsRegistered(key(r))
+	if err != nil || !registered {
+		return err
+	}
+	return s.verifyToken(r, scopeAdmin)
+}
+
+// requestToken returns the stream token, sent as the token query
+// parameter or as a bearer token.
+func requestToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+
+	const bearer = "Bearer "
+	if h := r.Header.Get("Authorization"); len(h) > len(bearer) && strings.EqualFold(h[:len(bearer)], bearer) {
+		return strings.TrimSpace(h[len(bearer):])
+	}
+	return ""
+}
+
+// authorize requires a token granting scope over the stream.
+func (s *Server) authorize(scope string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.verifyToken(r, scope); err != nil {
+			util.CountWithData("server.token.denied", 1, "scope=%s error=%q", scope, err)
+			handleError(w, r, err)
+			return
+		}
+		fn(w, r)
+	}
+}
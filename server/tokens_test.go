@@ -0,0 +1,280 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/heroku/busl/auth"
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTokenServer(insecure bool) *Server {
+	return NewServer(&Config{
+		HeartbeatDuration:  time.Second,
+		LineFlushDuration:  time.Minute,
+		StorageBaseURL:     func(*http.Request) string { return "" },
+		Broker:             newTestBroker(),
+		TokenSecret:        []byte("secret"),
+		TokenTTL:           time.Hour,
+		InsecureStreamKeys: insecure,
+	})
+}
+
+func createWithTokens(t *testing.T, url string) *streamTokens {
+	req, _ := http.NewRequest("PUT", url, nil)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	tokens := &streamTokens{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(tokens))
+	return tokens
+}
+
+func doWithToken(method, url, token, body string) (*http.Response, []byte, error) {
+	req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return resp, b, err
+}
+
+func TestStreamTokens(t *testing.T) {
+	s := newTokenServer(false)
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	url := server.URL + "/streams/" + uuid
+	tokens := createWithTokens(t, url)
+	assert.NotNil(t, tokens.Expires)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *tokens.Expires, time.Minute)
+
+	resp, _, err := doWithToken("POST", url, "", "hello")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, `Bearer realm="busl"`, resp.Header.Get("WWW-Authenticate"))
+
+	resp, _, err = doWithToken("POST", url, tokens.Read, "hello")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, _, err = doWithToken("POST", url, tokens.Publish, "hello")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, _, err = doWithToken("GET", url, "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, _, err = doWithToken("GET", url, tokens.Publish, "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, body, err := doWithToken("GET", url+"?token="+tokens.Read, "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello", string(body))
+
+	resp, _, err = doWithToken("GET", url+"/meta", tokens.Admin, "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, _, err = doWithToken("HEAD", url, "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestStreamTokensClose(t *testing.T) {
+	s := newTokenServer(false)
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	url := server.URL + "/streams/" + uuid
+	tokens := createWithTokens(t, url)
+
+	for _, token := range []string{"", tokens.Publish, tokens.Read} {
+		resp, _, err := doWithToken("DELETE", url, token, "")
+		assert.Nil(t, err)
+		assert.NotEqual(t, http.StatusOK, resp.StatusCode)
+	}
+	done, err := s.Broker.IsDone(uuid)
+	assert.Nil(t, err)
+	assert.False(t, done)
+
+	resp, _, err := doWithToken("DELETE", url, tokens.Admin, "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestStreamTokenMismatch(t *testing.T) {
+	s := newTokenServer(false)
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	other, _ := util.NewUUID()
+	tokens := createWithTokens(t, server.URL+"/streams/"+uuid)
+	createWithTokens(t, server.URL+"/streams/"+other)
+
+	for _, token := range []string{
+		// signed for another stream
+		tokens.Read,
+		// tampered with
+		"admin" + tokens.Read[len("read"):],
+		"read.0.",
+		"garbage",
+	} {
+		resp, body, err := doWithToken("GET", server.URL+"/streams/"+other, token, "")
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, token)
+		assert.NotEqual(t, "", string(body))
+	}
+
+	resp, body, err := doWithToken("GET", server.URL+"/streams/"+other, s.signToken(other, scopeRead, time.Now().Add(-time.Minute).Unix(), ""), "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, errTokenExpired.Error()+"\n", string(body))
+}
+
+func TestStreamTokensExistingStream(t *testing.T) {
+	s := newTokenServer(false)
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	url := server.URL + "/streams/" + uuid
+	tokens := createWithTokens(t, url)
+
+	// Knowing the key isn't enough to get tokens.
+	resp, body, err := doWithToken("PUT", url, "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "", string(body))
+
+	resp, _, err = doWithToken("PUT", url+"?reset=true", "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, _, err = doWithToken("PUT", url+"?reset=true", tokens.Publish, "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, body, err = doWithToken("PUT", url+"?reset=true", tokens.Admin, "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	reset := &streamTokens{}
+	assert.Nil(t, json.Unmarshal(body, reset))
+	assert.NotEmpty(t, reset.Admin)
+
+	// Resetting revokes the previous tokens.
+	assert.NotEqual(t, tokens.Read, reset.Read)
+	resp, _, err = doWithToken("GET", url, tokens.Read, "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, _, err = doWithToken("HEAD", url, reset.Read, "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// New streams don't take any.
+	uuid, _ = util.NewUUID()
+	resp, _, err = doWithToken("PUT", server.URL+"/streams/"+uuid+"?reset=true", "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+}
+
+func TestStreamTokensRegisteredAgain(t *testing.T) {
+	s := newTokenServer(false)
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	url := server.URL + "/streams/" + uuid
+	tokens := createWithTokens(t, url)
+	assert.Nil(t, s.Broker.Delete(uuid))
+
+	// The tokens of a previous stream don't grant anything over
+	// the stream now using its key.
+	again := createWithTokens(t, url)
+	resp, _, err := doWithToken("POST", url, tokens.Publish, "hello")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, _, err = doWithToken("POST", url, again.Publish, "hello")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestStreamTokensAdminAPI(t *testing.T) {
+	s := newTokenServer(false)
+	s.Authenticator, _ = auth.New(auth.Options{Basic: "admin:secret"})
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	assert.Nil(t, s.Broker.Register(uuid, nil))
+	meta, _ := s.Broker.Meta(uuid)
+	tokens := s.newStreamTokens(uuid, meta.Nonce)
+
+	// Stream tokens don't grant access to the admin API...
+	resp, _, err := doWithToken("POST", server.URL+"/admin/streams/"+uuid+"/close", tokens.Admin, "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// ...which takes admin credentials alone.
+	req, _ := http.NewRequest("POST", server.URL+"/admin/streams/"+uuid+"/close", nil)
+	req.SetBasicAuth("admin", "secret")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestInsecureStreamKeys(t *testing.T) {
+	s := newTokenServer(true)
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	url := server.URL + "/streams/" + uuid
+	tokens := createWithTokens(t, url)
+
+	resp, _, err := doWithToken("POST", url, "", "hello")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, body, err := doWithToken("GET", url, "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello", string(body))
+
+	// Tokens sent along are still checked.
+	resp, _, err = doWithToken("GET", url, tokens.Publish, "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestCreateWithoutTokenSecret(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	resp, body, err := doWithToken("PUT", server.URL+"/streams/"+uuid, "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "", string(body))
+}
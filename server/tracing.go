@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	gcontext "github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/tracing"
+)
+
+// statusRecorder tells the status of the response, as logged.
+type statusRecorder interface {
+	Status() int
+}
+
+// traceRequest records a server span for the request, continuing the
+// trace of the client if it sent a traceparent header. The router keeps
+// the request context for the span to be named after the route.
+func traceRequest(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer gcontext.Clear(r)
+
+		ctx, span := tracing.Start(tracing.Extract(context.Background(), r.Header), r.Method, tracing.KindServer)
+		defer span.End()
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.Path)
+		gcontext.Set(r, traceKey, ctx)
+
+		fn(w, r)
+
+		if route := routeName(r); route != "" {
+			span.SetName(r.Method + " " + route)
+		}
+		if k := key(r); k != "" {
+			span.SetAttribute("busl.stream", k)
+		}
+		if id := w.Header().Get("Request-ID"); id != "" {
+			span.SetAttribute("http.request_id", id)
+		}
+		if l, ok := w.(statusRecorder); ok {
+			span.SetAttribute("http.status_code", l.Status())
+			if l.Status() >= 500 {
+				span.RecordError(fmt.Errorf("HTTP %d", l.Status()))
+			}
+		}
+	}
+}
+
+// routeName returns the path of the request, with the stream key
+// replaced by {key}, or nothing if no route matched.
+func routeName(r *http.Request) string {
+	if mux.CurrentRoute(r) == nil {
+		return ""
+	}
+
+	path := r.URL.Path
+	if k := key(r); k != "" {
+		// Stream keys follow the first /streams/.
+		if i := strings.Index(path, "/streams/") + len("/streams/"); strings.HasPrefix(path[i:], k) {
+			path = path[:i] + "{key}" + path[i+len(k):]
+		}
+	}
+	return path
+}
+
+// requestContext returns the context carrying the span of the request
+func requestContext(r *http.Request) context.Context {
+	if ctx, ok := gcontext.Get(r, traceKey).(context.Context); ok {
+		return ctx
+	}
+	return context.Background()
+}
+
+// broker returns the broker, traced as part of the request
+func (s *Server) broker(r *http.Request) broker.Broker {
+	return broker.Traced(requestContext(r), s.Broker)
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/heroku/busl/auth"
+	"github.com/heroku/busl/tracing"
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestTracePublish(t *testing.T) {
+	var spans bytes.Buffer
+	tracing.SetExporter("busl", &tracing.ConsoleExporter{W: &spans})
+	defer tracing.Shutdown()
+
+	uploaded := make(chan string, 1)
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uploaded <- r.Header.Get("Traceparent")
+	}))
+	defer storage.Close()
+
+	s := NewServer(&Config{
+		HeartbeatDuration: time.Second,
+		StorageBaseURL:    func(*http.Request) string { return storage.URL },
+		Broker:            baseServer.Broker,
+	})
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	assert.Nil(t, s.Broker.Register(uuid, nil))
+	req, _ := http.NewRequest("POST", server.URL+"/streams/"+uuid, bytes.NewBufferString("hello"))
+	req.Header.Set("Traceparent", testTraceparent)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+
+	select {
+	case traceparent := <-uploaded:
+		// The trace continues, from another span.
+		assert.Equal(t, testTraceparent[:36], traceparent[:36])
+		assert.NotEqual(t, testTraceparent, traceparent)
+	case <-time.After(5 * time.Second):
+		t.Fatal("output never uploaded")
+	}
+	tracing.Shutdown()
+
+	byName := exportedSpans(&spans)
+
+	server1 := byName["POST /streams/{key}"]
+	if assert.NotNil(t, server1) {
+		assert.Equal(t, "00f067aa0ba902b7", server1["parentSpanId"])
+		assert.Equal(t, float64(tracing.KindServer), server1["kind"])
+		assert.Contains(t, server1["attributes"], map[string]interface{}{
+			"key": "http.status_code", "value": map[string]interface{}{"intValue": "200"},
+		})
+	}
+	for _, name := range []string{"broker.NewWriter", "broker.Len"} {
+		if assert.NotNil(t, byName[name], name) {
+			assert.Equal(t, server1["spanId"], byName[name]["parentSpanId"], name)
+		}
+	}
+}
+
+func TestTraceUpload(t *testing.T) {
+	var spans bytes.Buffer
+	tracing.SetExporter("busl", &tracing.ConsoleExporter{W: &spans})
+	defer tracing.Shutdown()
+
+	uuid, _ := util.NewUUID()
+	storage, _, _ := fileServer(uuid)
+	defer storage.Close()
+
+	authenticator, _ := auth.New(auth.Options{Basic: "admin:secret"})
+	s := NewServer(&Config{
+		HeartbeatDuration: time.Second,
+		StorageBaseURL:    func(*http.Request) string { return storage.URL },
+		Broker:            baseServer.Broker,
+		Authenticator:     authenticator,
+	})
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	assert.Nil(t, s.Broker.Register(uuid, nil))
+	req, _ := http.NewRequest("POST", server.URL+"/admin/streams/"+uuid+"/upload", nil)
+	req.SetBasicAuth("admin", "secret")
+	req.Header.Set("Traceparent", testTraceparent)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	tracing.Shutdown()
+
+	byName := exportedSpans(&spans)
+	for child, parent := range map[string]string{
+		"server.uploadOutput": "POST /admin/streams/{key}/upload",
+		"broker.Get":          "server.uploadOutput",
+		"storage.Put":         "server.uploadOutput",
+		"storage PUT":         "storage.Put",
+	} {
+		if assert.NotNil(t, byName[child], child) {
+			assert.Equal(t, byName[parent]["spanId"], byName[child]["parentSpanId"], child)
+		}
+	}
+}
+
+// exportedSpans decodes the spans of the test trace, by name
+func exportedSpans(spans *bytes.Buffer) map[string]map[string]interface{} {
+	byName := make(map[string]map[string]interface{})
+	dec := json.NewDecoder(spans)
+	for {
+		var span map[string]interface{}
+		if dec.Decode(&span) != nil {
+			return byName
+		}
+		if span["traceId"] == testTraceparent[3:35] {
+			byName[span["name"].(string)] = span
+		}
+	}
+}
+
+func TestTraceNotFound(t *testing.T) {
+	var spans bytes.Buffer
+	tracing.SetExporter("busl", &tracing.ConsoleExporter{W: &spans})
+	defer tracing.Shutdown()
+
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/unknown/route")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	tracing.Shutdown()
+
+	// Uploads of other tests may still be traced.
+	var names []string
+	dec := json.NewDecoder(&spans)
+	for {
+		var span struct {
+			Name string
+			Kind tracing.Kind
+		}
+		if dec.Decode(&span) != nil {
+			break
+		}
+		if span.Kind == tracing.KindServer {
+			names = append(names, span.Name)
+		}
+	}
+	assert.Equal(t, []string{"GET"}, names)
+}
+
+func TestRouteName(t *testing.T) {
+	var names []string
+	r := mux.NewRouter()
+	r.KeepContext = true
+	r.HandleFunc("/streams/{key:.+}/meta", func(w http.ResponseWriter, r *http.Request) {
+		names = append(names, routeName(r))
+	})
+	r.HandleFunc("/admin/streams/{key:.+}", func(w http.ResponseWriter, r *http.Request) {
+		names = append(names, routeName(r))
+	})
+	for _, path := range []string{"/streams/streams/meta/meta", "/admin/streams/1/2/3", "/unknown"} {
+		req := httptest.NewRequest("GET", path, nil)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+		names = append(names, routeName(req))
+	}
+	assert.Equal(t, []string{
+		"/streams/{key}/meta", "/streams/{key}/meta",
+		"/admin/streams/{key}", "/admin/streams/{key}",
+		"",
+	}, names)
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"io"
+	"net/http"
+)
+
+// ansiCSS styles the ansi-* classes output by the HTML encoder.
+const ansiCSS = `
+body { margin: 0; background: #1d1f21; color: #c5c8c6; }
+pre { margin: 0; padding: 1em; font: 13px/1.4 Menlo, Consolas, monospace; white-space: pre-wrap; word-wrap: break-word; }
+.ansi-bold { font-weight: bold; }
+.ansi-dim { opacity: 0.6; }
+.ansi-italic { font-style: italic; }
+.ansi-underline { text-decoration: underline; }
+.ansi-strike { text-decoration: line-through; }
+.ansi-black { color: #1d1f21; } .ansi-bg-black { background-color: #1d1f21; }
+.ansi-red { color: #cc6666; } .ansi-bg-red { background-color: #cc6666; }
+.ansi-green { color: #b5bd68; } .ansi-bg-green { background-color: #b5bd68; }
+.ansi-yellow { color: #f0c674; } .ansi-bg-yellow { background-color: #f0c674; }
+.ansi-blue { color: #81a2be; } .ansi-bg-blue { background-color: #81a2be; }
+.ansi-magenta { color: #b294bb; } .ansi-bg-magenta { background-color: #b294bb; }
+.ansi-cyan { color: #8abeb7; } .ansi-bg-cyan { background-color: #8abeb7; }
+.ansi-white { color: #c5c8c6; } .ansi-bg-white { background-color: #c5c8c6; }
+.ansi-bright-black { color: #666666; } .ansi-bg-bright-black { background-color: #666666; }
+.ansi-bright-red { color: #d54e53; } .ansi-bg-bright-red { background-color: #d54e53; }
+.ansi-bright-green { color: #b9ca4a; } .ansi-bg-bright-green { background-color: #b9ca4a; }
+.ansi-bright-yellow { color: #e7c547; } .ansi-bg-bright-yellow { background-color: #e7c547; }
+.ansi-bright-blue { color: #7aa6da; } .ansi-bg-bright-blue { background-color: #7aa6da; }
+.ansi-bright-magenta { color: #c397d8; } .ansi-bg-bright-magenta { background-color: #c397d8; }
+.ansi-bright-cyan { color: #70c0b1; } .ansi-bg-bright-cyan { background-color: #70c0b1; }
+.ansi-bright-white { color: #eaeaea; } .ansi-bg-bright-white { background-color: #eaeaea; }
+`
+
+// htmlHeader starts the document streamed to text/html subscribers.
+const htmlHeader = `<!DOCTYPE html>
+<meta charset="utf-8">
+<style>` + ansiCSS + `</style>
+<pre>`
+
+// viewerHTML follows a stream over SSE, with HTML encoded events, until
+// the end event. The browser resumes from the Last-Event-ID when the
+// connection drops; when it gives up, the page checks the stream meta
+// to reconnect from the last offset, unless the stream is done.
+const viewerHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>busl</title>
+<style>` + ansiCSS + `
+#status { position: fixed; top: 0; right: 0; padding: 0.25em 0.5em; background: #373b41; font: 12px sans-serif; }
+</style>
+</head>
+<body>
+<div id="status">connecting</div>
+<pre id="log"></pre>
+<script>
+(function() {
+  var log = document.getElementById('log');
+  var status = document.getElementById('status');
+  var base = location.pathname.replace(/\/view$/, '');
+  var query = location.search ? location.search + '&' : '?';
+  var offset = 0;
+
+  function atBottom() {
+    return window.innerHeight + window.pageYOffset >= document.body.scrollHeight - 20;
+  }
+
+  function retry() {
+    setTimeout(connect, 1000);
+  }
+
+  function connect() {
+    var source = new EventSource(base + query + 'encoding=html&offset=' + offset);
+    source.onopen = function() {
+      status.textContent = 'live';
+    };
+    source.onmessage = function(e) {
+      var follow = atBottom();
+      log.insertAdjacentHTML('beforeend', e.data);
+      offset = parseInt(e.lastEventId, 10) || offset;
+      if (follow) {
+        window.scrollTo(0, document.body.scrollHeight);
+      }
+    };
+    source.addEventListener('end', function(e) {
+      source.close();
+      status.textContent = 'done';
+    });
+    source.onerror = function() {
+      if (source.readyState !== EventSource.CLOSED) {
+        status.textContent = 'reconnecting';
+        return;
+      }
+      source.close();
+
+      var xhr = new XMLHttpRequest();
+      xhr.open('GET', base + '/meta' + location.search);
+      xhr.onload = function() {
+        if (xhr.status === 404) {
+          status.textContent = 'not found';
+          return;
+        }
+        var meta = xhr.status === 200 ? JSON.parse(xhr.responseText) : {};
+        if (meta.done && meta.length <= offset) {
+          status.textContent = 'done';
+          return;
+        }
+        status.textContent = 'reconnecting';
+        retry();
+      };
+      xhr.onerror = retry;
+      xhr.send();
+    };
+  }
+
+  connect();
+})();
+</script>
+</body>
+</html>
+`
+
+func (s *Server) viewStream(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, viewerHTML)
+}
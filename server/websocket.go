@@ -0,0 +1,204 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/util"
+)
+
+const (
+	wsWriteTimeout     = 10 * time.Second
+	wsCloseGrace       = time.Second      // to receive the client's close frame
+	wsDefaultHeartbeat = 10 * time.Second // when HeartbeatDuration isn't set
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 32 * 1024,
+
+	// Origins are checked beforehand, see checkWebSocketOrigin.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+func isWebSocket(r *http.Request, rm *mux.RouteMatch) bool {
+	return websocket.IsWebSocketUpgrade(r)
+}
+
+// subscribeWebSocket streams the content as text messages, cut on
+// UTF-8 character boundaries, or as binary messages with the binary
+// encoding, for streams that aren't text. Heartbeats are sent as ping
+// frames, and the connection ends with a close frame: 1000 once the
+// stream is done, 1001 when the server shuts down, or 1011 on errors.
+// Clients resume with the offset query parameter, counting the bytes
+// received.
+func (s *Server) subscribeWebSocket(w http.ResponseWriter, r *http.Request) {
+	if !s.checkWebSocketOrigin(r) {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	o, err := s.startOffset(r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	messageType := websocket.TextMessage
+	switch encoding := r.URL.Query().Get("encoding"); encoding {
+	case "", "text":
+	case "binary":
+		messageType = websocket.BinaryMessage
+	default:
+		handleError(w, r, badRequestError{fmt.Errorf("Unsupported encoding %q", encoding)})
+		return
+	}
+
+	rd, err := s.newStorageReader(r, o)
+	if rd != nil {
+		defer rd.Close()
+	}
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	done := broker.NoContent(s.broker(r), key(r), o)
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader replied with an HTTP error already.
+		util.CountWithData("server.ws.upgrade.error", 1, "error=%s", err)
+		return
+	}
+	defer conn.Close()
+
+	// Hijacked connections aren't tracked by the graceful server.
+	s.StartRoutine()
+	defer s.FinishRoutine()
+
+	// Reading is required to process control frames.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	util.CountWithData("server.ws.start", 1, "request_id=%q", r.Header.Get("Request-Id"))
+	util.GaugeAdd("server.subscribers", 1)
+	defer util.GaugeAdd("server.subscribers", -1)
+	defer util.MeasureSince("server.sub.duration", time.Now())
+
+	code, reason := websocket.CloseNormalClosure, "done"
+	if !done {
+		code, reason = s.pumpWebSocket(conn, messageType, rd, gone, func() { s.broker(r).RenewExpiry(key(r)) })
+	}
+	util.CountWithData("server.ws.finish", 1, "code=%d request_id=%q", code, r.Header.Get("Request-Id"))
+
+	if code != 0 {
+		// Give the client a chance to acknowledge the close frame.
+		msg := websocket.FormatCloseMessage(code, reason)
+		if err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteTimeout)); err == nil {
+			select {
+			case <-gone:
+			case <-time.After(wsCloseGrace):
+			}
+		}
+	}
+}
+
+// pumpWebSocket writes what rd reads to the connection as messages of
+// the given type, until either end goes away. It returns the code and
+// reason to close with, or zero if the client is gone.
+func (s *Server) pumpWebSocket(conn *websocket.Conn, messageType int, rd io.Reader, gone <-chan struct{}, renew func()) (int, string) {
+	interval := s.HeartbeatDuration
+	if interval <= 0 {
+		interval = wsDefaultHeartbeat
+	}
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(2*interval + wsWriteTimeout))
+		return nil
+	})
+
+	quit := make(chan struct{})
+	defer close(quit)
+	reads := make(chan *payload)
+	go func() {
+		for {
+			payload := &payload{p: make([]byte, 32*1024)}
+			payload.n, payload.err = rd.Read(payload.p)
+			select {
+			case reads <- payload:
+			case <-quit:
+				return
+			}
+			if payload.err != nil {
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(interval)
+	defer heartbeat.Stop()
+
+	var pending []byte // an incomplete UTF-8 character
+	for {
+		select {
+		case payload := <-reads:
+			buf := append(pending, payload.p[:payload.n]...)
+			if messageType == websocket.TextMessage {
+				buf, pending = splitRunes(buf)
+			}
+			if len(buf) > 0 {
+				conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+				if err := conn.WriteMessage(messageType, buf); err != nil {
+					return 0, ""
+				}
+			}
+
+			if payload.err == io.EOF {
+				return websocket.CloseNormalClosure, "done"
+			}
+			if payload.err != nil {
+				util.CountWithData("server.ws.read.error", 1, "error=%s", payload.err)
+				return websocket.CloseInternalServerErr, "read error"
+			}
+
+		case <-heartbeat.C:
+			util.Count("server.ws.keepAlive")
+			renew()
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return 0, ""
+			}
+
+		case <-gone:
+			util.Count("server.ws.clientClosed")
+			return 0, ""
+
+		case <-s.closing:
+			return websocket.CloseGoingAway, "shutting down"
+		}
+	}
+}
+
+// splitRunes splits off the incomplete UTF-8 character p may end with
+func splitRunes(p []byte) ([]byte, []byte) {
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				return p[:i], p[i:]
+			}
+			break
+		}
+	}
+	return p, nil
+}
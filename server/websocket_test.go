@@ -0,0 +1,210 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func dialWebSocket(t *testing.T, server *httptest.Server, path string) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + path
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// readWebSocket returns the messages received until
+// the connection got closed, and the close code.
+func readWebSocket(conn *websocket.Conn) (string, int) {
+	var received string
+	for {
+		_, p, err := conn.ReadMessage()
+		if err != nil {
+			if closeErr, ok := err.(*websocket.CloseError); ok {
+				return received, closeErr.Code
+			}
+			return received, 0
+		}
+		received += string(p)
+	}
+}
+
+func TestWebSocketPubSub(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid, nil)
+
+	conn := dialWebSocket(t, server, "/streams/"+uuid)
+	defer conn.Close()
+
+	w, _ := baseServer.Broker.NewWriter(uuid)
+	w.Write([]byte("hello \xe4\xb8"))
+	w.Write([]byte("\x96\xe7\x95\x8c"))
+	w.Close()
+
+	received, code := readWebSocket(conn)
+	assert.Equal(t, "hello 世界", received)
+	assert.Equal(t, websocket.CloseNormalClosure, code)
+}
+
+func TestWebSocketOffset(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid, nil)
+	w, _ := baseServer.Broker.NewWriter(uuid)
+	w.Write([]byte("hello world"))
+	w.Close()
+
+	conn := dialWebSocket(t, server, "/streams/"+uuid+"?offset=6")
+	defer conn.Close()
+	received, code := readWebSocket(conn)
+	assert.Equal(t, "world", received)
+	assert.Equal(t, websocket.CloseNormalClosure, code)
+
+	// Nothing left past the end of a done stream.
+	conn = dialWebSocket(t, server, "/streams/"+uuid+"?offset=11")
+	defer conn.Close()
+	received, code = readWebSocket(conn)
+	assert.Equal(t, "", received)
+	assert.Equal(t, websocket.CloseNormalClosure, code)
+}
+
+func TestWebSocketBinary(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	baseServer.Broker.Register(uuid, nil)
+	w, _ := baseServer.Broker.NewWriter(uuid)
+	w.Write([]byte("\x00\xff\xe4\xb8"))
+	w.Close()
+
+	conn := dialWebSocket(t, server, "/streams/"+uuid+"?encoding=binary")
+	defer conn.Close()
+	messageType, p, err := conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, websocket.BinaryMessage, messageType)
+	assert.Equal(t, []byte("\x00\xff\xe4\xb8"), p)
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/streams/" + uuid + "?encoding=gzip"
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.Equal(t, websocket.ErrBadHandshake, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestWebSocketNotRegistered(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/streams/missing"
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.Equal(t, websocket.ErrBadHandshake, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestWebSocketHeartbeat(t *testing.T) {
+	s := NewServer(&Config{
+		HeartbeatDuration: 10 * time.Millisecond,
+		StorageBaseURL:    baseServer.StorageBaseURL,
+		Broker:            baseServer.Broker,
+	})
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	s.Broker.Register(uuid, nil)
+
+	conn := dialWebSocket(t, server, "/streams/"+uuid)
+	defer conn.Close()
+
+	pinged := make(chan struct{}, 1)
+	conn.SetPingHandler(func(string) error {
+		select {
+		case pinged <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	go readWebSocket(conn)
+
+	select {
+	case <-pinged:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no ping received")
+	}
+}
+
+func TestWebSocketWithoutHeartbeatDuration(t *testing.T) {
+	s := NewServer(&Config{
+		StorageBaseURL: baseServer.StorageBaseURL,
+		Broker:         baseServer.Broker,
+	})
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	s.Broker.Register(uuid, nil)
+
+	conn := dialWebSocket(t, server, "/streams/"+uuid)
+	defer conn.Close()
+
+	w, _ := s.Broker.NewWriter(uuid)
+	w.Write([]byte("hello"))
+	w.Close()
+
+	received, code := readWebSocket(conn)
+	assert.Equal(t, "hello", received)
+	assert.Equal(t, websocket.CloseNormalClosure, code)
+}
+
+func TestWebSocketShutdown(t *testing.T) {
+	closing := make(chan struct{})
+	s := NewServer(baseServer.Config)
+	s.closing = closing
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	s.Broker.Register(uuid, nil)
+	w, _ := s.Broker.NewWriter(uuid)
+	w.Write([]byte("hello"))
+
+	conn := dialWebSocket(t, server, "/streams/"+uuid)
+	defer conn.Close()
+	_, p, err := conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(p))
+
+	close(closing)
+	_, code := readWebSocket(conn)
+	assert.Equal(t, websocket.CloseGoingAway, code)
+}
+
+func TestSplitRunes(t *testing.T) {
+	for _, test := range []struct{ in, complete, rest string }{
+		{"hello", "hello", ""},
+		{"", "", ""},
+		{"hé", "hé", ""},
+		{"h\xc3", "h", "\xc3"},
+		{"h\xe4\xb8", "h", "\xe4\xb8"},
+		{"h\xf0\x9f\x98", "h", "\xf0\x9f\x98"},
+		{"h\xf0\x9f\x98\x80", "h\xf0\x9f\x98\x80", ""},
+		{"\xff", "\xff", ""},
+	} {
+		complete, rest := splitRunes([]byte(test.in))
+		assert.Equal(t, test.complete, string(complete))
+		assert.Equal(t, test.rest, string(rest))
+	}
+}
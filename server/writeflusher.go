@@ -10,14 +10,30 @@ import (
 // data.
 type writeFlusher struct {
 	w io.Writer
+	c compressor // compressing to w, if set
 }
 
 func newWriteFlusher(w io.Writer) io.Writer {
-	return &writeFlusher{w}
+	return &writeFlusher{w: w}
+}
+
+// newCompressingWriteFlusher compresses the data with c, which writes
+// to w, flushing the compressor as well on every write.
+func newCompressingWriteFlusher(w io.Writer, c compressor) io.Writer {
+	return &writeFlusher{w, c}
 }
 
 func (wf *writeFlusher) Write(p []byte) (int, error) {
-	n, err := wf.w.Write(p)
+	if wf.c == nil {
+		n, err := wf.w.Write(p)
+		wf.w.(http.Flusher).Flush()
+		return n, err
+	}
+
+	n, err := wf.c.Write(p)
+	if err == nil {
+		err = wf.c.Flush()
+	}
 	wf.w.(http.Flusher).Flush()
 	return n, err
 }
@@ -1,12 +1,17 @@
 package storage
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/heroku/busl/tracing"
 	"github.com/heroku/busl/util"
 )
 
@@ -33,9 +38,18 @@ var (
 //   requestURI := "1/2/3?X-Amz-Algorithm=...&..."
 //   err := storage.Put(requestURI, reader)
 //
-func Put(requestURI, baseURI string, reader io.Reader) (err error) {
+func Put(requestURI, baseURI string, reader io.Reader) error {
+	return PutContext(context.Background(), requestURI, baseURI, reader)
+}
+
+// PutContext is Put, traced as part of the span of ctx
+func PutContext(ctx context.Context, requestURI, baseURI string, reader io.Reader) (err error) {
+	defer util.MeasureSince("storage.put.duration", time.Now())
+	ctx, span := tracing.Start(ctx, "storage.Put", tracing.KindInternal)
+	defer func() { span.RecordError(err); span.End() }()
+
 	for i := retries; i > 0; i-- {
-		err = put(requestURI, baseURI, reader)
+		err = put(ctx, requestURI, baseURI, reader)
 
 		// Break if we get nil / any error other than Err5xx
 		if err == nil {
@@ -57,12 +71,12 @@ func Put(requestURI, baseURI string, reader io.Reader) (err error) {
 	return err
 }
 
-func put(requestURI, baseURI string, reader io.Reader) error {
+func put(ctx context.Context, requestURI, baseURI string, reader io.Reader) error {
 	req, err := newRequest("PUT", requestURI, baseURI, reader)
 	if err != nil {
 		return err
 	}
-	res, err := process(req)
+	res, err := processTraced(ctx, req)
 	if res != nil {
 		defer res.Body.Close()
 	}
@@ -79,18 +93,46 @@ func put(requestURI, baseURI string, reader io.Reader) error {
 //   requestURI := "1/2/3?X-Amz-Algorithm=...&..."
 //   reader, err := storage.Get(requestURI, 0)
 //
-func Get(requestURI, baseURI string, offset int64) (rd io.ReadCloser, err error) {
+func Get(requestURI, baseURI string, offset int64) (io.ReadCloser, error) {
+	return GetContext(context.Background(), requestURI, baseURI, offset)
+}
+
+// GetContext is Get, traced as part of the span of ctx
+func GetContext(ctx context.Context, requestURI, baseURI string, offset int64) (io.ReadCloser, error) {
+	rd, _, err := getEncoded(ctx, requestURI, baseURI, offset, "")
+	return rd, err
+}
+
+// GetEncoded grabs the data stored in requestURI as Get does, from the
+// start, accepting the given content encodings rather than having the
+// blob decoded. It returns the content encoding of the reader, empty
+// for identity.
+func GetEncoded(requestURI, baseURI, acceptEncoding string) (io.ReadCloser, string, error) {
+	return GetEncodedContext(context.Background(), requestURI, baseURI, acceptEncoding)
+}
+
+// GetEncodedContext is GetEncoded, traced as part of the span of ctx
+func GetEncodedContext(ctx context.Context, requestURI, baseURI, acceptEncoding string) (io.ReadCloser, string, error) {
+	return getEncoded(ctx, requestURI, baseURI, 0, acceptEncoding)
+}
+
+func getEncoded(ctx context.Context, requestURI, baseURI string, offset int64, acceptEncoding string) (rd io.ReadCloser, encoding string, err error) {
+	defer util.MeasureSince("storage.get.duration", time.Now())
+	ctx, span := tracing.Start(ctx, "storage.Get", tracing.KindInternal)
+	defer func() { span.RecordError(err); span.End() }()
+	span.SetAttribute("busl.offset", offset)
+
 	for i := retries; i > 0; i-- {
-		rd, err = get(requestURI, baseURI, offset)
+		rd, encoding, err = get(ctx, requestURI, baseURI, offset, acceptEncoding)
 
 		if err == nil {
 			util.Count("storage.get.success")
-			return rd, nil
+			return rd, encoding, nil
 		}
 
 		if err != Err5xx {
 			util.Count("storage.get.error")
-			return rd, err
+			return rd, "", err
 		}
 
 		// Close the body immediately to prevent
@@ -104,13 +146,13 @@ func Get(requestURI, baseURI string, offset int64) (rd io.ReadCloser, err error)
 
 	// We've ran out of retries
 	util.Count("storage.get.maxretries")
-	return rd, err
+	return rd, "", err
 }
 
-func get(requestURI, baseURI string, offset int64) (io.ReadCloser, error) {
+func get(ctx context.Context, requestURI, baseURI string, offset int64, acceptEncoding string) (io.ReadCloser, string, error) {
 	req, err := newRequest("GET", requestURI, baseURI, nil)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	req.TransferEncoding = []string{"chunked"}
 	req.Header.Add("Transfer-Encoding", "chunked")
@@ -118,12 +160,101 @@ func get(requestURI, baseURI string, offset int64) (io.ReadCloser, error) {
 	if offset > 0 {
 		req.Header.Add("Range", fmt.Sprintf("bytes=%d-", offset))
 	}
+	if acceptEncoding != "" {
+		// The transport no longer decodes the response then.
+		req.Header.Add("Accept-Encoding", acceptEncoding)
+	}
 
-	res, err := process(req)
+	res, err := processTraced(ctx, req)
 	if res == nil {
+		return nil, "", err
+	}
+	return res.Body, res.Header.Get("Content-Encoding"), err
+}
+
+// Info describes a blob
+type Info struct {
+	Length       int64
+	ContentType  string
+	LastModified time.Time // zero if unknown
+}
+
+// Stat describes the data stored in requestURI, without downloading it.
+// The requestURI is resolved using the `STORAGE_BASE_URL` as the base.
+//
+// Presigned URLs are only valid for a single method, so rather than
+// a HEAD request this fetches the first byte, and reads the length
+// from the `Content-Range` header.
+//
+// Retries transient errors `retries` number of times.
+func Stat(requestURI, baseURI string) (*Info, error) {
+	return StatContext(context.Background(), requestURI, baseURI)
+}
+
+// StatContext is Stat, traced as part of the span of ctx
+func StatContext(ctx context.Context, requestURI, baseURI string) (info *Info, err error) {
+	ctx, span := tracing.Start(ctx, "storage.Stat", tracing.KindInternal)
+	defer func() { span.RecordError(err); span.End() }()
+
+	for i := retries; i > 0; i-- {
+		info, err = stat(ctx, requestURI, baseURI)
+
+		if err == nil {
+			util.Count("storage.stat.success")
+			return info, nil
+		}
+
+		if err != Err5xx {
+			util.Count("storage.stat.error")
+			return nil, err
+		}
+
+		util.Count("storage.stat.retry")
+	}
+
+	// We've ran out of retries
+	util.Count("storage.stat.maxretries")
+	return nil, err
+}
+
+func stat(ctx context.Context, requestURI, baseURI string) (*Info, error) {
+	req, err := newRequest("GET", requestURI, baseURI, nil)
+	if err != nil {
 		return nil, err
 	}
-	return res.Body, err
+	req.Header.Add("Range", "bytes=0-0")
+
+	res, err := processTraced(ctx, req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err == ErrRange {
+		// Empty blobs have no satisfiable range.
+		return &Info{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info := &Info{
+		Length:      res.ContentLength,
+		ContentType: res.Header.Get("Content-Type"),
+	}
+	if t, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		info.LastModified = t
+	}
+
+	// e.g. Content-Range: bytes 0-0/1234
+	if cr := res.Header.Get("Content-Range"); res.StatusCode == http.StatusPartialContent && cr != "" {
+		i := strings.LastIndex(cr, "/")
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid Content-Range %q", cr)
+		}
+		if info.Length, err = strconv.ParseInt(cr[i+1:], 10, 64); err != nil {
+			return nil, fmt.Errorf("Invalid Content-Range %q", cr)
+		}
+	}
+	return info, nil
 }
 
 // constructs an http.Request object, resolving requestURI
@@ -164,6 +295,23 @@ func process(req *http.Request) (*http.Response, error) {
 	return res, err
 }
 
+// processTraced executes the HTTP request in a client span, whose
+// context is sent along in the traceparent header.
+func processTraced(ctx context.Context, req *http.Request) (*http.Response, error) {
+	ctx, span := tracing.Start(ctx, "storage "+req.Method, tracing.KindClient)
+	defer span.End()
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.host", req.URL.Host)
+	tracing.Inject(ctx, req.Header)
+
+	res, err := process(req)
+	if res != nil {
+		span.SetAttribute("http.status_code", res.StatusCode)
+	}
+	span.RecordError(err)
+	return res, err
+}
+
 func absoluteURL(baseURI, requestURI string) (*url.URL, error) {
 	if ref, err := url.ParseRequestURI(normalize(requestURI)); err != nil {
 		return nil, err
@@ -1,14 +1,18 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strings"
 	"testing"
 
+	"github.com/heroku/busl/tracing"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -59,6 +63,45 @@ func TestGetWithoutBaseURL(t *testing.T) {
 	assert.Equal(t, err, ErrNoStorage)
 }
 
+func TestStatWithoutBaseURL(t *testing.T) {
+	_, err := Stat("1/2/3", "")
+	assert.Equal(t, err, ErrNoStorage)
+}
+
+func TestStat(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "GET", r.Method)
+		assert.Equal(t, "bytes=0-0", r.Header.Get("Range"))
+
+		switch r.URL.Path {
+		case "/empty":
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+			w.Header().Set("Content-Range", "bytes 0-0/5")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte("h"))
+		}
+	}))
+	defer server.Close()
+
+	info, err := Stat("1/2/3", server.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), info.Length)
+	assert.Equal(t, "text/plain", info.ContentType)
+	assert.Equal(t, 2006, info.LastModified.Year())
+
+	info, err = Stat("empty", server.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), info.Length)
+
+	_, err = Stat("missing", server.URL)
+	assert.Equal(t, ErrNotFound, err)
+}
+
 func TestPut(t *testing.T) {
 	requestURI, _ := setup()
 	if requestURI == "" {
@@ -108,3 +151,27 @@ func TestGetIllegalOffset(t *testing.T) {
 		t.Fatalf("%v != Expected 200, got 416", err)
 	}
 }
+
+func TestTracePropagation(t *testing.T) {
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+	}))
+	defer server.Close()
+
+	parent := tracing.SpanContext{TraceID: tracing.TraceID{1}, SpanID: tracing.SpanID{2}}
+	ctx := tracing.WithRemote(context.Background(), parent)
+
+	assert.Nil(t, PutContext(ctx, "1/2/3", server.URL, strings.NewReader("hello")))
+	assert.Equal(t, "00-01000000000000000000000000000000-", traceparent[:36])
+	assert.NotEqual(t, parent.Traceparent(), traceparent)
+
+	rd, err := GetContext(ctx, "1/2/3", server.URL, 0)
+	assert.Nil(t, err)
+	rd.Close()
+	assert.Equal(t, "00-01000000000000000000000000000000-", traceparent[:36])
+
+	traceparent = ""
+	assert.Nil(t, Put("1/2/3", server.URL, strings.NewReader("hello")))
+	assert.Len(t, traceparent, 55)
+}
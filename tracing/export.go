@@ -0,0 +1,338 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	batchSize     = 512
+	queueSize     = 2048
+	flushInterval = 5 * time.Second
+	exportTimeout = 10 * time.Second
+)
+
+// Exporter sends the spans of the service somewhere
+type Exporter interface {
+	Export(service string, spans []*Span) error
+}
+
+// batcher exports the ended spans in batches, in the background
+type batcher struct {
+	exporter Exporter
+	service  string
+	queue    chan *Span
+	flush    chan chan struct{}
+}
+
+var (
+	mu      sync.RWMutex
+	current *batcher
+)
+
+func enabled() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current != nil
+}
+
+func export(s *Span) {
+	mu.RLock()
+	defer mu.RUnlock()
+	if current == nil {
+		return
+	}
+
+	select {
+	case current.queue <- s:
+	default:
+		// Spans are dropped rather than slowing requests down.
+	}
+}
+
+// SetExporter exports the spans of the service with e, nil to stop
+// tracing. The spans queued for the previous exporter are flushed.
+func SetExporter(service string, e Exporter) {
+	mu.Lock()
+	prev := current
+	current = nil
+	if e != nil {
+		current = &batcher{exporter: e, service: service, queue: make(chan *Span, queueSize), flush: make(chan chan struct{})}
+		go current.run()
+	}
+	mu.Unlock()
+
+	if prev != nil {
+		prev.stop()
+	}
+}
+
+// Shutdown flushes the spans queued and stops tracing
+func Shutdown() {
+	SetExporter("", nil)
+}
+
+func (b *batcher) run() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var spans []*Span
+	send := func() {
+		if len(spans) == 0 {
+			return
+		}
+		if err := b.exporter.Export(b.service, spans); err != nil {
+			log.Printf("tracing.export error=%q spans=%d", err, len(spans))
+		}
+		spans = nil
+	}
+
+	for {
+		select {
+		case s := <-b.queue:
+			if spans = append(spans, s); len(spans) >= batchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-b.flush:
+			for len(b.queue) > 0 {
+				spans = append(spans, <-b.queue)
+			}
+			send()
+			close(done)
+			return
+		}
+	}
+}
+
+func (b *batcher) stop() {
+	done := make(chan struct{})
+	b.flush <- done
+	<-done
+}
+
+// The OTLP/JSON encoding of spans, see
+// https://github.com/open-telemetry/opentelemetry-proto
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID      string          `json:"traceId"`
+		SpanID       string          `json:"spanId"`
+		ParentSpanID string          `json:"parentSpanId,omitempty"`
+		Name         string          `json:"name"`
+		Kind         Kind            `json:"kind"`
+		Start        string          `json:"startTimeUnixNano"`
+		End          string          `json:"endTimeUnixNano"`
+		Attributes   []otlpAttribute `json:"attributes,omitempty"`
+		Status       *otlpStatus     `json:"status,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"` // 2 for errors
+		Message string `json:"message,omitempty"`
+	}
+)
+
+func newOTLPSpan(s *Span) otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	span := otlpSpan{
+		TraceID: hex.EncodeToString(s.sc.TraceID[:]),
+		SpanID:  hex.EncodeToString(s.sc.SpanID[:]),
+		Name:    s.name,
+		Kind:    s.kind,
+		Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+		End:     strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parent != (SpanID{}) {
+		span.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	for _, a := range s.attrs {
+		span.Attributes = append(span.Attributes, newOTLPAttribute(a.Key, a.Value))
+	}
+	if s.errorMsg != "" {
+		span.Status = &otlpStatus{Code: 2, Message: s.errorMsg}
+	}
+	return span
+}
+
+func newOTLPAttribute(key string, value interface{}) otlpAttribute {
+	var v map[string]interface{}
+	switch value := value.(type) {
+	case string:
+		v = map[string]interface{}{"stringValue": value}
+	case bool:
+		v = map[string]interface{}{"boolValue": value}
+	case int:
+		v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+	case int64:
+		v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+	case float64:
+		v = map[string]interface{}{"doubleValue": value}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+	return otlpAttribute{key, v}
+}
+
+func newOTLPRequest(service string, spans []*Span) *otlpRequest {
+	scope := otlpScopeSpans{Scope: otlpScope{Name: "github.com/heroku/busl"}}
+	for _, s := range spans {
+		scope.Spans = append(scope.Spans, newOTLPSpan(s))
+	}
+	return &otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{newOTLPAttribute("service.name", service)}},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}}
+}
+
+// OTLPExporter posts the spans to an OTLP/HTTP endpoint, JSON encoded
+type OTLPExporter struct {
+	URL    string // e.g. http://localhost:4318/v1/traces
+	Header http.Header
+	Client *http.Client
+}
+
+// Export implements Exporter
+func (e *OTLPExporter) Export(service string, spans []*Span) error {
+	var encoded bytes.Buffer
+	if err := json.NewEncoder(&encoded).Encode(newOTLPRequest(service, spans)); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", e.URL, &encoded)
+	if err != nil {
+		return err
+	}
+	for name, values := range e.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := e.Client
+	if client == nil {
+		client = &http.Client{Timeout: exportTimeout}
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("OTLP endpoint replied %s", res.Status)
+	}
+	return nil
+}
+
+// ConsoleExporter writes the spans as JSON lines, for local testing
+type ConsoleExporter struct {
+	W io.Writer
+}
+
+// Export implements Exporter
+func (e *ConsoleExporter) Export(service string, spans []*Span) error {
+	enc := json.NewEncoder(e.W)
+	for _, s := range spans {
+		span := newOTLPSpan(s)
+		if err := enc.Encode(struct {
+			Service string `json:"service"`
+			otlpSpan
+		}{service, span}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FromEnv sets the exporter of the service from the standard
+// OpenTelemetry environment variables: OTEL_TRACES_EXPORTER, otlp or
+// console (none by default), OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, OTEL_EXPORTER_OTLP_HEADERS and
+// OTEL_SERVICE_NAME overriding service.
+func FromEnv(service string) error {
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		service = name
+	}
+
+	switch exporter := os.Getenv("OTEL_TRACES_EXPORTER"); exporter {
+	case "", "none":
+		return nil
+	case "console", "stdout":
+		SetExporter(service, &ConsoleExporter{W: os.Stdout})
+		return nil
+	case "otlp":
+		e, err := otlpFromEnv()
+		if err != nil {
+			return err
+		}
+		SetExporter(service, e)
+		return nil
+	default:
+		return fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q", exporter)
+	}
+}
+
+func otlpFromEnv() (*OTLPExporter, error) {
+	e := &OTLPExporter{URL: os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"), Header: http.Header{}}
+	if e.URL == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			base = "http://localhost:4318"
+		}
+		e.URL = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	if _, err := url.Parse(e.URL); err != nil {
+		return nil, err
+	}
+
+	for _, pair := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS entry %q", pair)
+		}
+		value, err := url.QueryUnescape(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, err
+		}
+		e.Header.Set(strings.TrimSpace(kv[0]), value)
+	}
+	return e, nil
+}
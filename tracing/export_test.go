@@ -0,0 +1,124 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	var body map[string]interface{}
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		header = r.Header
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer server.Close()
+
+	e := &OTLPExporter{URL: server.URL + "/v1/traces", Header: http.Header{"Authorization": {"Bearer secret"}}}
+	SetExporter("busl", e)
+	ctx, parent := Start(context.Background(), "parent", KindServer)
+	parent.SetAttribute("http.status_code", 500)
+	parent.SetAttribute("busl.stream", "1/2/3")
+	parent.RecordError(errors.New("HTTP 500"))
+	_, child := Start(ctx, "child", KindClient)
+	child.End()
+	parent.End()
+	Shutdown()
+
+	assert.Equal(t, "application/json", header.Get("Content-Type"))
+	assert.Equal(t, "Bearer secret", header.Get("Authorization"))
+
+	resource := body["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"attributes": []interface{}{map[string]interface{}{
+		"key": "service.name", "value": map[string]interface{}{"stringValue": "busl"},
+	}}}, resource["resource"])
+
+	spans := resource["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+	c, p := spans[0].(map[string]interface{}), spans[1].(map[string]interface{})
+	assert.Equal(t, "child", c["name"])
+	assert.Equal(t, float64(KindClient), c["kind"])
+	assert.Equal(t, p["traceId"], c["traceId"])
+	assert.Equal(t, p["spanId"], c["parentSpanId"])
+	assert.Nil(t, c["status"])
+
+	assert.Equal(t, "parent", p["name"])
+	assert.Nil(t, p["parentSpanId"])
+	assert.Len(t, p["traceId"], 32)
+	assert.Len(t, p["spanId"], 16)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"key": "http.status_code", "value": map[string]interface{}{"intValue": "500"}},
+		map[string]interface{}{"key": "busl.stream", "value": map[string]interface{}{"stringValue": "1/2/3"}},
+	}, p["attributes"])
+	assert.Equal(t, map[string]interface{}{"code": float64(2), "message": "HTTP 500"}, p["status"])
+}
+
+func TestOTLPExporterError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	_, span := Start(context.Background(), "span", KindInternal)
+	span.End()
+	e := &OTLPExporter{URL: server.URL}
+	assert.Error(t, e.Export("busl", []*Span{span}))
+}
+
+func TestConsoleExporter(t *testing.T) {
+	var buf bytes.Buffer
+	SetExporter("busl", &ConsoleExporter{W: &buf})
+	_, span := Start(context.Background(), "span", KindInternal)
+	span.End()
+	Shutdown()
+
+	var line struct {
+		Service string
+		Name    string
+		TraceID string
+	}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "busl", line.Service)
+	assert.Equal(t, "span", line.Name)
+	assert.Len(t, line.TraceID, 32)
+}
+
+func TestFromEnv(t *testing.T) {
+	defer Shutdown()
+	defer os.Unsetenv("OTEL_TRACES_EXPORTER")
+	defer os.Unsetenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	defer os.Unsetenv("OTEL_EXPORTER_OTLP_HEADERS")
+
+	assert.Nil(t, FromEnv("busl"))
+	assert.False(t, enabled())
+
+	os.Setenv("OTEL_TRACES_EXPORTER", "stdout")
+	assert.Nil(t, FromEnv("busl"))
+	assert.True(t, enabled())
+
+	os.Setenv("OTEL_TRACES_EXPORTER", "otlp")
+	os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://collector:4318/")
+	os.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "api-key=a%20b, x-team=busl")
+	assert.Nil(t, FromEnv("busl"))
+	e := current.exporter.(*OTLPExporter)
+	assert.Equal(t, "http://collector:4318/v1/traces", e.URL)
+	assert.Equal(t, "a b", e.Header.Get("Api-Key"))
+	assert.Equal(t, "busl", e.Header.Get("X-Team"))
+
+	os.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "invalid")
+	assert.Error(t, FromEnv("busl"))
+
+	os.Setenv("OTEL_TRACES_EXPORTER", "zipkin")
+	assert.Error(t, FromEnv("busl"))
+}
@@ -0,0 +1,108 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recorder keeps the spans exported
+type recorder struct {
+	spans []*Span
+}
+
+func (r *recorder) Export(service string, spans []*Span) error {
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func TestParseTraceparent(t *testing.T) {
+	sc, ok := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.True(t, ok)
+	assert.True(t, sc.Sampled)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.Traceparent())
+
+	sc, ok = ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	assert.True(t, ok)
+	assert.False(t, sc.Sampled)
+
+	// Later versions may add fields.
+	_, ok = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	assert.True(t, ok)
+
+	for _, h := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01",
+	} {
+		_, ok := ParseTraceparent(h)
+		assert.False(t, ok, h)
+	}
+}
+
+func TestStart(t *testing.T) {
+	r := &recorder{}
+	SetExporter("test", r)
+
+	ctx, parent := Start(context.Background(), "parent", KindServer)
+	assert.True(t, parent.Context().IsValid())
+	assert.True(t, parent.Context().Sampled)
+
+	_, child := Start(ctx, "child", KindInternal)
+	assert.Equal(t, parent.Context().TraceID, child.Context().TraceID)
+	assert.NotEqual(t, parent.Context().SpanID, child.Context().SpanID)
+	assert.Equal(t, parent.Context().SpanID, child.parent)
+
+	child.RecordError(errors.New("failed"))
+	child.End()
+	child.End()
+	parent.End()
+	Shutdown()
+
+	if assert.Len(t, r.spans, 2) {
+		assert.Equal(t, "child", r.spans[0].name)
+		assert.Equal(t, "failed", r.spans[0].errorMsg)
+		assert.Equal(t, "parent", r.spans[1].name)
+	}
+}
+
+func TestStartWithoutExporter(t *testing.T) {
+	_, span := Start(context.Background(), "root", KindServer)
+	assert.True(t, span.Context().IsValid())
+	assert.False(t, span.Context().Sampled)
+	span.End()
+}
+
+func TestNilSpan(t *testing.T) {
+	var span *Span
+	span.SetName("name")
+	span.SetAttribute("key", "value")
+	span.RecordError(errors.New("failed"))
+	span.End()
+	assert.False(t, span.Context().IsValid())
+}
+
+func TestPropagation(t *testing.T) {
+	header := http.Header{}
+	Inject(context.Background(), header)
+	assert.Equal(t, "", header.Get("Traceparent"))
+
+	header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := Extract(context.Background(), header)
+	ctx, span := Start(ctx, "server", KindServer)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.Context().Traceparent()[3:35])
+	assert.True(t, span.Context().Sampled)
+
+	out := http.Header{}
+	Inject(ctx, out)
+	assert.Equal(t, span.Context().Traceparent(), out.Get("Traceparent"))
+}
@@ -4,9 +4,69 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Metric identifies a measurement. Labels are name, value pairs;
+// Data is extra key=value pairs, only kept in the logs.
+type Metric struct {
+	Name   string
+	Labels []string
+	Data   string
+}
+
+// Sink receives the metrics
+type Sink interface {
+	Count(m Metric, count int64)
+	Sample(m Metric, value int64)
+	Measure(m Metric, d time.Duration)
+}
+
+var sinks atomic.Value
+
+func init() {
+	SetSinks(LogSink{})
+}
+
+// SetSinks sets where metrics are reported, the logs by default
+func SetSinks(s ...Sink) {
+	sinks.Store(s)
+}
+
+func currentSinks() []Sink {
+	return sinks.Load().([]Sink)
+}
+
+// LogSink logs metrics for l2met, label values being appended
+// to the metric names.
+type LogSink struct{}
+
+// Count logs a count# line
+func (LogSink) Count(m Metric, count int64) { logMetric("count", m, fmt.Sprint(count)) }
+
+// Sample logs a sample# line
+func (LogSink) Sample(m Metric, value int64) { logMetric("sample", m, fmt.Sprint(value)) }
+
+// Measure logs a measure# line, in seconds
+func (LogSink) Measure(m Metric, d time.Duration) {
+	logMetric("measure", m, fmt.Sprintf("%f", d.Seconds()))
+}
+
+func logMetric(kind string, m Metric, value string) {
+	name := m.Name
+	for i := 1; i < len(m.Labels); i += 2 {
+		name += "." + m.Labels[i]
+	}
+
+	if m.Data == "" {
+		log.Printf("%s#%s.%s=%s", kind, prefix, name, value)
+	} else {
+		log.Printf("%s#%s.%s=%s %s", kind, prefix, name, value, m.Data)
+	}
+}
+
 // Count parses a string into a count for logging to librato
 func Count(metric string) { CountMany(metric, 1) }
 
@@ -15,21 +75,52 @@ func CountMany(metric string, count int64) { CountWithData(metric, count, "") }
 
 // CountWithData parses metrics for logging to librato
 func CountWithData(metric string, count int64, extraData string, v ...interface{}) {
-	if extraData == "" {
-		log.Printf("count#busl.%s=%d", metric, count)
-	} else {
-		log.Printf("count#busl.%s=%d %s", metric, count, fmt.Sprintf(extraData, v...))
+	CountWithLabels(metric, nil, count, extraData, v...)
+}
+
+// CountWithLabels counts metric by the given label name, value pairs
+func CountWithLabels(metric string, labels []string, count int64, extraData string, v ...interface{}) {
+	m := Metric{Name: metric, Labels: labels, Data: data(extraData, v)}
+	for _, s := range currentSinks() {
+		s.Count(m, count)
 	}
 }
 
 func Sample(metric string, value int64) { SampleWithData(metric, value, "") }
 
 func SampleWithData(metric string, value int64, extraData string, v ...interface{}) {
+	m := Metric{Name: metric, Data: data(extraData, v)}
+	for _, s := range currentSinks() {
+		s.Sample(m, value)
+	}
+}
+
+var gauges sync.Map // metric name to *int64
+
+// GaugeAdd adds delta to a gauge, e.g. counting the clients
+// connected, and samples its value.
+func GaugeAdd(metric string, delta int64) {
+	g, _ := gauges.LoadOrStore(metric, new(int64))
+	Sample(metric, atomic.AddInt64(g.(*int64), delta))
+}
+
+// MeasureSince measures the seconds elapsed since start, as
+// metric.seconds
+func MeasureSince(metric string, start time.Time) {
+	measure(Metric{Name: metric + ".seconds"}, time.Since(start))
+}
+
+func measure(m Metric, d time.Duration) {
+	for _, s := range currentSinks() {
+		s.Measure(m, d)
+	}
+}
+
+func data(extraData string, v []interface{}) string {
 	if extraData == "" {
-		log.Printf("sample#busl.%s=%d", metric, value)
-	} else {
-		log.Printf("sample#busl.%s=%d %s", metric, value, fmt.Sprintf(extraData, v...))
+		return ""
 	}
+	return fmt.Sprintf(extraData, v...)
 }
 
 func SMeasure(subject string, object string) string {
@@ -41,7 +132,17 @@ func TimerStart(subject string, extras ...string) (time.Time, string, []string)
 	return time.Now(), subject, extras
 }
 
+// TimerEnd logs the time elapsed since TimerStart, and reports it to
+// the other sinks, the log line already being the l2met measure.
 func TimerEnd(startTime time.Time, subject string, extras []string) {
-	elapsed := fmt.Sprintf("%f", time.Now().Sub(startTime).Seconds())
+	d := time.Since(startTime)
+	elapsed := fmt.Sprintf("%f", d.Seconds())
 	log.Printf("%s.timer.end %s %s", subject, SMeasure(subject+".elapsed.seconds", elapsed), strings.Join(extras, " "))
+
+	m := Metric{Name: subject + ".elapsed.seconds", Data: strings.Join(extras, " ")}
+	for _, s := range currentSinks() {
+		if _, ok := s.(LogSink); !ok {
+			s.Measure(m, d)
+		}
+	}
 }
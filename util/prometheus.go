@@ -0,0 +1,185 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Buckets of the histograms, in seconds, from quick redis and storage
+// requests to streams followed for an hour.
+var histogramBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300, 900, 3600}
+
+// Prometheus keeps the metrics in memory, and exposes them in the
+// Prometheus text format. Counts are counters, samples gauges and
+// measures histograms.
+type Prometheus struct {
+	mu       sync.Mutex
+	families map[string]*promFamily
+}
+
+type promFamily struct {
+	kind   string // counter, gauge or histogram
+	series map[string]*promSeries
+}
+
+type promSeries struct {
+	labels  []string
+	value   float64
+	buckets []uint64 // cumulated by ServeHTTP
+	count   uint64
+}
+
+// NewPrometheus returns an empty Prometheus sink
+func NewPrometheus() *Prometheus {
+	return &Prometheus{families: make(map[string]*promFamily)}
+}
+
+// Count adds to the counter of the metric
+func (p *Prometheus) Count(m Metric, count int64) {
+	p.with("counter", promName(m.Name)+"_total", m.Labels, func(s *promSeries) {
+		s.value += float64(count)
+	})
+}
+
+// Sample sets the gauge of the metric
+func (p *Prometheus) Sample(m Metric, value int64) {
+	p.with("gauge", promName(m.Name), m.Labels, func(s *promSeries) {
+		s.value = float64(value)
+	})
+}
+
+// Measure observes the histogram of the metric
+func (p *Prometheus) Measure(m Metric, d time.Duration) {
+	p.with("histogram", promName(m.Name), m.Labels, func(s *promSeries) {
+		if s.buckets == nil {
+			s.buckets = make([]uint64, len(histogramBuckets))
+		}
+		seconds := d.Seconds()
+		if i := sort.SearchFloat64s(histogramBuckets, seconds); i < len(histogramBuckets) {
+			s.buckets[i]++
+		}
+		s.value += seconds
+		s.count++
+	})
+}
+
+func (p *Prometheus) with(kind, name string, labels []string, fn func(*promSeries)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	f := p.families[name]
+	if f == nil {
+		f = &promFamily{kind: kind, series: make(map[string]*promSeries)}
+		p.families[name] = f
+	}
+	if f.kind != kind {
+		// Reported as another kind of metric already.
+		return
+	}
+
+	key := strings.Join(labels, "\xff")
+	s := f.series[key]
+	if s == nil {
+		s = &promSeries{labels: labels}
+		f.series[key] = s
+	}
+	fn(s)
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+
+	p.mu.Lock()
+	names := make([]string, 0, len(p.families))
+	for name := range p.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := p.families[name]
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", name, f.kind)
+
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			s := f.series[key]
+			if f.kind != "histogram" {
+				fmt.Fprintf(&buf, "%s%s %s\n", name, promLabels(s.labels), formatFloat(s.value))
+				continue
+			}
+
+			var cumulated uint64
+			for i, le := range histogramBuckets {
+				cumulated += s.buckets[i]
+				fmt.Fprintf(&buf, "%s_bucket%s %d\n", name, promLabels(s.labels, "le", formatFloat(le)), cumulated)
+			}
+			fmt.Fprintf(&buf, "%s_bucket%s %d\n", name, promLabels(s.labels, "le", "+Inf"), s.count)
+			fmt.Fprintf(&buf, "%s_sum%s %s\n", name, promLabels(s.labels), formatFloat(s.value))
+			fmt.Fprintf(&buf, "%s_count%s %d\n", name, promLabels(s.labels), s.count)
+		}
+	}
+	p.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+// promName converts metric names, e.g. RedisBroker.tailCache.hit,
+// to busl_redis_broker_tail_cache_hit.
+func promName(metric string) string {
+	var b bytes.Buffer
+	b.WriteString(prefix)
+
+	runes := []rune(metric)
+	underscore := true
+	b.WriteRune('_')
+	for i, r := range runes {
+		switch {
+		case unicode.IsUpper(r) && r < unicode.MaxASCII:
+			if i > 0 && !underscore && !unicode.IsUpper(runes[i-1]) {
+				b.WriteRune('_')
+			}
+			b.WriteRune(unicode.ToLower(r))
+			underscore = false
+		case (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9'):
+			b.WriteRune(r)
+			underscore = false
+		case !underscore:
+			b.WriteRune('_')
+			underscore = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "_")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promLabels(labels []string, extra ...string) string {
+	labels = append(labels[:len(labels):len(labels)], extra...)
+	if len(labels) < 2 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+labelEscaper.Replace(labels[i+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
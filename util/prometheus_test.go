@@ -0,0 +1,116 @@
+package util
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPromName(t *testing.T) {
+	for metric, name := range map[string]string{
+		"http.status":                        "busl_http_status",
+		"RedisBroker.tailCache.hit":          "busl_redis_broker_tail_cache_hit",
+		"server.storeOutput.elapsed.seconds": "busl_server_store_output_elapsed_seconds",
+		"server.sub.keepAlive":               "busl_server_sub_keep_alive",
+		"redis.connections":                  "busl_redis_connections",
+	} {
+		assert.Equal(t, name, promName(metric))
+	}
+}
+
+func TestPrometheus(t *testing.T) {
+	p := NewPrometheus()
+	p.Count(Metric{Name: "storage.put.success"}, 1)
+	p.Count(Metric{Name: "storage.put.success", Data: "request_id=1"}, 2)
+	p.Count(Metric{Name: "http.status", Labels: []string{"status", "2xx"}}, 3)
+	p.Count(Metric{Name: "http.status", Labels: []string{"status", "5xx"}}, 1)
+	p.Sample(Metric{Name: "server.subscribers"}, 4)
+	p.Sample(Metric{Name: "server.subscribers"}, 2)
+	p.Measure(Metric{Name: "storage.get.duration.seconds"}, 20*time.Millisecond)
+	p.Measure(Metric{Name: "storage.get.duration.seconds"}, 2*time.Hour)
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	body, _ := ioutil.ReadAll(w.Body)
+
+	for _, line := range []string{
+		"# TYPE busl_storage_put_success_total counter",
+		"busl_storage_put_success_total 3",
+		`busl_http_status_total{status="2xx"} 3`,
+		`busl_http_status_total{status="5xx"} 1`,
+		"# TYPE busl_server_subscribers gauge",
+		"busl_server_subscribers 2",
+		"# TYPE busl_storage_get_duration_seconds histogram",
+		`busl_storage_get_duration_seconds_bucket{le="0.01"} 0`,
+		`busl_storage_get_duration_seconds_bucket{le="0.025"} 1`,
+		`busl_storage_get_duration_seconds_bucket{le="3600"} 1`,
+		`busl_storage_get_duration_seconds_bucket{le="+Inf"} 2`,
+		"busl_storage_get_duration_seconds_sum 7200.02",
+		"busl_storage_get_duration_seconds_count 2",
+	} {
+		assert.Contains(t, strings.Split(string(body), "\n"), line)
+	}
+}
+
+func TestPromLabels(t *testing.T) {
+	assert.Equal(t, "", promLabels(nil))
+	assert.Equal(t, `{a="x\"y\\z\n"}`, promLabels([]string{"a", "x\"y\\z\n"}))
+	labels := []string{"a", "1"}
+	assert.Equal(t, `{a="1",le="+Inf"}`, promLabels(labels, "le", "+Inf"))
+	assert.Equal(t, `{a="1"}`, promLabels(labels))
+}
+
+type recordingSink struct {
+	*Prometheus
+	counts []Metric
+}
+
+func (s *recordingSink) Count(m Metric, count int64) {
+	s.counts = append(s.counts, m)
+}
+
+func TestSinks(t *testing.T) {
+	defer SetSinks(LogSink{})
+
+	s := &recordingSink{Prometheus: NewPrometheus()}
+	SetSinks(s)
+	CountWithData("server.close", 1, "request_id=%q", "1")
+	CountWithLabels("http.status", []string{"status", "2xx"}, 1, "")
+	assert.Equal(t, []Metric{
+		{Name: "server.close", Data: `request_id="1"`},
+		{Name: "http.status", Labels: []string{"status", "2xx"}},
+	}, s.counts)
+
+	GaugeAdd("test.gauge", 2)
+	GaugeAdd("test.gauge", -1)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, w.Body.String(), "busl_test_gauge 1\n")
+}
+
+func TestTimerEnd(t *testing.T) {
+	defer SetSinks(LogSink{})
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	p := NewPrometheus()
+	SetSinks(LogSink{}, p)
+	TimerEnd(TimerStart("test.timer", "request_id=1"))
+
+	// The log line is the only l2met measure.
+	assert.Contains(t, buf.String(), "test.timer.timer.end measure#busl.test.timer.elapsed.seconds=")
+	assert.Equal(t, 1, strings.Count(buf.String(), "measure#"))
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, w.Body.String(), "busl_test_timer_elapsed_seconds_count 1\n")
+}
@@ -1,8 +1,11 @@
 package util
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
 )
@@ -15,8 +18,9 @@ func NewResponseLogger(r *http.Request, w http.ResponseWriter) *ResponseLogger {
 // ResponseLogger is a logger for HTTP responses
 type ResponseLogger struct {
 	http.ResponseWriter
-	request *http.Request
-	status  int
+	request   *http.Request
+	status    int
+	principal string
 }
 
 // WriteHeader writes a new header to the response
@@ -35,6 +39,26 @@ func (l *ResponseLogger) Flush() {
 	l.ResponseWriter.(http.Flusher).Flush()
 }
 
+// Hijack lets the caller take over the connection, e.g. for WebSockets
+func (l *ResponseLogger) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := l.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Hijacking unsupported")
+	}
+	l.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// Status returns the status of the response
+func (l *ResponseLogger) Status() int {
+	return l.status
+}
+
+// SetPrincipal records who the request was authenticated as
+func (l *ResponseLogger) SetPrincipal(name string) {
+	l.principal = name
+}
+
 func (l *ResponseLogger) requestID() (id string) {
 	if id = l.request.Header.Get("Request-Id"); id == "" {
 		id = l.request.Header.Get("X-Request-Id")
@@ -56,7 +80,11 @@ func (l *ResponseLogger) requestID() (id string) {
 // WriteLog logs the response
 func (l *ResponseLogger) WriteLog() {
 	maskedStatus := strconv.Itoa(l.status/100) + "xx"
-	CountWithData(fmt.Sprintf("http.status.%s", maskedStatus), 1, "request_id=%s", l.requestID())
-	log.Printf("method=%s path=\"%s\" host=\"%s\" fwd=\"%s\" status=%d user_agent=\"%s\" request_id=%s",
+	CountWithLabels("http.status", []string{"status", maskedStatus}, 1, "request_id=%s", l.requestID())
+	line := fmt.Sprintf("method=%s path=\"%s\" host=\"%s\" fwd=\"%s\" status=%d user_agent=\"%s\" request_id=%s",
 		l.request.Method, l.request.URL.Path, l.request.Host, l.request.Header.Get("X-Forwarded-For"), l.status, l.request.UserAgent(), l.requestID())
+	if l.principal != "" {
+		line += fmt.Sprintf(" principal=%q", l.principal)
+	}
+	log.Print(line)
 }